@@ -2,6 +2,9 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"strings"
 
 	"github.com/mcfriend99/exwrap/impl"
 )
@@ -9,12 +12,158 @@ import (
 var OsMatrix []string = []string{"windows", "linux", "darwin"}
 var ArchMatrix []string = []string{"windows", "linux", "darwin"}
 
+// A flag that can be given many times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: exwrap [command] [flags]\n\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  build      Build the executable (default)\n")
+	fmt.Fprintf(os.Stderr, "  inspect    Show what a built executable carries\n")
+	fmt.Fprintf(os.Stderr, "  extract    Unpack a built executable without installing it\n")
+	fmt.Fprintf(os.Stderr, "  repack     Change the scripts of a built executable\n")
+	fmt.Fprintf(os.Stderr, "  diff-pack  Create a patch between two built executables\n")
+	fmt.Fprintf(os.Stderr, "\nRun exwrap <command> -help for the flags of a command.\n")
+}
+
 func main() {
+	// the build command is implied when only flags are given.
+	command, args := "build", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "build":
+		build(args)
+	case "inspect":
+		inspect(args)
+	case "extract":
+		extract(args)
+	case "repack":
+		repack(args)
+	case "diff-pack":
+		diffPack(args)
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n\n", command)
+		usage()
+		os.Exit(2)
+	}
+}
+
+func build(args []string) {
 	var cmd impl.CommandLine
-	flag.StringVar(&cmd.ConfigFile, "config", impl.DefaultConfigFile, "The exwrap configuration file.")
-	flag.StringVar(&cmd.BuildDirectory, "dir", impl.DefaultBuildDirectory, "The exwrap build directory.")
-	flag.Parse()
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	flags.StringVar(&cmd.ConfigFile, "config", impl.DefaultConfigFile, "The exwrap configuration file.")
+	flags.StringVar(&cmd.BuildDirectory, "dir", impl.DefaultBuildDirectory, "The exwrap build directory.")
+	flags.StringVar(&cmd.SignKey, "sign-key", "", "A PEM encoded Ed25519 private key to sign the payload with.")
+	flags.StringVar(&cmd.EncryptKeyFile, "encrypt-key-file", "", "A file holding the key to encrypt the payload with.")
+	flags.Parse(args)
 
 	// load config file
 	_ = impl.Generate(impl.LoadConfig(cmd), cmd)
 }
+
+func inspect(args []string) {
+	var cmd impl.CommandLine
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	flags.StringVar(&cmd.EncryptKeyFile, "encrypt-key-file", "", "A file holding the key of an encrypted payload.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: exwrap inspect [flags] <executable>\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	impl.Inspect(cmd, flags.Arg(0))
+}
+
+func extract(args []string) {
+	var cmd impl.CommandLine
+	var output string
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+	flags.StringVar(&output, "o", "", "The directory to extract into (Defaults to <executable>.extracted).")
+	flags.StringVar(&cmd.EncryptKeyFile, "encrypt-key-file", "", "A file holding the key of an encrypted payload.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: exwrap extract [flags] <executable>\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if output == "" {
+		output = strings.TrimSuffix(flags.Arg(0), ".exe") + ".extracted"
+	}
+
+	impl.Extract(cmd, flags.Arg(0), output)
+}
+
+func repack(args []string) {
+	var cmd impl.CommandLine
+	var output string
+	var settings stringList
+	flags := flag.NewFlagSet("repack", flag.ExitOnError)
+	flags.Var(&settings, "set", "A key=value setting to change (E.g. install_path=/opt/app), may be given many times.\nLists take JSON arrays (E.g. entry_point='[\"bin/app\", \"-v\"]').")
+	flags.StringVar(&output, "o", "", "The repacked executable (Defaults to replacing the executable).")
+	flags.StringVar(&cmd.SignKey, "sign-key", "", "A PEM encoded Ed25519 private key to sign the payload with.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: exwrap repack [flags] <executable>\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if output == "" {
+		output = flags.Arg(0)
+	}
+
+	impl.Repack(cmd, flags.Arg(0), output, settings)
+}
+
+func diffPack(args []string) {
+	var cmd impl.CommandLine
+	var output string
+	flags := flag.NewFlagSet("diff-pack", flag.ExitOnError)
+	flags.StringVar(&output, "o", "", "The patch to create (Defaults to <new executable>.expatch).")
+	flags.StringVar(&cmd.SignKey, "sign-key", "", "A PEM encoded Ed25519 private key to sign the patch with.")
+	flags.StringVar(&cmd.EncryptKeyFile, "encrypt-key-file", "", "A file holding the key of encrypted payloads.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: exwrap diff-pack [flags] <old executable> <new executable>\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if output == "" {
+		output = strings.TrimSuffix(flags.Arg(1), ".exe") + ".expatch"
+	}
+
+	impl.DiffPack(cmd, flags.Arg(0), flags.Arg(1), output)
+}
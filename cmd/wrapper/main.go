@@ -2,17 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
 
-	"github.com/maja42/ember"
-	"github.com/maja42/ember/embedding"
 	"github.com/mcfriend99/exwrap/impl"
+	"golang.org/x/term"
 )
 
 type output struct {
@@ -24,11 +26,15 @@ func damaged(err error) {
 	log.Fatalln("Damaged executable:", err.Error())
 }
 
+func untrusted(err error) {
+	log.Fatalln("Untrusted executable:", err.Error())
+}
+
 func failed(err error) {
 	log.Fatalln("Failed executable:", err.Error())
 }
 
-func readEmbededConfig(r ember.Reader, v any) {
+func readEmbededConfig(r io.Reader, v any) {
 	if buffer, err := io.ReadAll(r); err == nil {
 		if err = json.Unmarshal(buffer, v); err != nil {
 			damaged(err)
@@ -38,7 +44,7 @@ func readEmbededConfig(r ember.Reader, v any) {
 	}
 }
 
-func extractEmbededFile(r ember.Reader, v any) {
+func extractEmbededFile(r io.Reader, v any) {
 	if buffer, err := io.ReadAll(r); err == nil {
 		if err = json.Unmarshal(buffer, v); err != nil {
 			damaged(err)
@@ -49,40 +55,52 @@ func extractEmbededFile(r ember.Reader, v any) {
 }
 
 func main() {
-	embedding.SkipCompatibilityCheck = true
-	attachments, err := ember.Open()
-	if err != nil {
-		log.Fatal(err)
+	attachments, err := impl.OpenSelf()
+	if errors.Is(err, impl.ErrNoContainer) {
+		// installed apps have their launch script next to them. anything
+		// else is an incomplete installer (E.g. a truncated download).
+		if !impl.FileExists(impl.GetLaunchScript(impl.GetAppDir())) {
+			damaged(fmt.Errorf("%w and no installed app next to it, the file may be incomplete", err))
+		}
+
+		launchApp()
+		return
+	} else if err != nil {
+		damaged(err)
 	}
 	defer attachments.Close()
 
+	// nothing started from here should take the payload for its own.
+	os.Unsetenv(impl.PayloadEnv)
+
+	// make sure nothing is missing or corrupt before touching the
+	// filesystem.
+	if err = attachments.Verify(); err != nil {
+		damaged(err)
+	}
+
+	// stubs with a public key only install what it signed.
+	if keys, err := impl.GetTrustedKeys(); err != nil {
+		damaged(err)
+	} else if len(keys) > 0 {
+		if err = attachments.VerifySignature(keys); err != nil {
+			untrusted(err)
+		}
+	}
+
 	contents := attachments.List()
 
 	var setup impl.SetupScript
 	var launch impl.LaunchScript
 
-	hasArchive := false
-	_ = os.RemoveAll(impl.GetInstallExtractDir())
-
+	// the setup script tells where to find the key of an encrypted
+	// archive.
 	for _, name := range contents {
 		// s := attachments.Size(name)
 		// fmt.Printf("\nAttachment %q has %d bytes:\n", name, s)
 		r := attachments.Reader(name)
 
 		switch name {
-		case impl.EmbededArchiveName:
-			hasArchive = true
-			os.MkdirAll(impl.GetInstallExtractDir(), 0755)
-
-			if file, err := os.OpenFile(impl.GetInstallExtractFile(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755); err == nil {
-				if _, err := io.Copy(file, r); err != nil {
-					damaged(err)
-				}
-			} else {
-				damaged(err)
-			}
-
-			break
 		case impl.EmbededSetupScript:
 			readEmbededConfig(r, &setup)
 			break
@@ -92,14 +110,89 @@ func main() {
 		}
 	}
 
-	if hasArchive {
-		install(setup, launch)
+	// patches update an existing installation instead.
+	if r := attachments.Reader(impl.EmbededPatchName); r != nil {
+		if impl.IsEncrypted(r) {
+			d := decryptArchive(setup, r)
+			applyPatch(setup, launch, d, d.Size())
+		} else {
+			applyPatch(setup, launch, r, r.Size())
+		}
+		return
+	}
+
+	// the archive is extracted straight out of the executable (or its
+	// sidecar).
+	if r, err := attachments.Archive(); err != nil {
+		damaged(err)
+	} else if r != nil {
+		if impl.IsEncrypted(r) {
+			d := decryptArchive(setup, r)
+			install(setup, launch, d, d.Size())
+		} else {
+			install(setup, launch, r, r.Size())
+		}
 	} else {
 		launchApp()
 	}
 }
 
-func install(setup impl.SetupScript, launch impl.LaunchScript) {
+// decryptArchive opens the encrypted archive with the key from the
+// environment, the license file or the user, in that order.
+func decryptArchive(setup impl.SetupScript, r io.ReaderAt) *impl.DecryptReader {
+	open := func(key string, source string) *impl.DecryptReader {
+		d, err := impl.NewDecryptReader(r, strings.TrimSpace(key))
+		if errors.Is(err, impl.ErrWrongKey) {
+			failed(fmt.Errorf("wrong key in %s", source))
+		} else if err != nil {
+			damaged(err)
+		}
+		return d
+	}
+
+	if key := os.Getenv(setup.KeyEnv); setup.KeyEnv != "" && key != "" {
+		return open(key, setup.KeyEnv)
+	}
+
+	if keyFile := setup.KeyFile; keyFile != "" {
+		if !filepath.IsAbs(keyFile) {
+			payload, err := impl.GetPayloadPath()
+			if err != nil {
+				failed(err)
+			}
+			keyFile = filepath.Join(filepath.Dir(payload), keyFile)
+		}
+
+		if data, err := os.ReadFile(keyFile); err == nil {
+			return open(string(data), keyFile)
+		}
+	}
+
+	// only ask when someone is there to answer.
+	if stdin := int(os.Stdin.Fd()); setup.KeyPrompt && term.IsTerminal(stdin) {
+		for attempt := 0; attempt < 3; attempt++ {
+			fmt.Fprint(os.Stderr, "Installation key: ")
+			key, err := term.ReadPassword(stdin)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				break
+			}
+
+			d, err := impl.NewDecryptReader(r, strings.TrimSpace(string(key)))
+			if err == nil {
+				return d
+			} else if !errors.Is(err, impl.ErrWrongKey) {
+				damaged(err)
+			}
+			fmt.Fprintln(os.Stderr, "Wrong key.")
+		}
+	}
+
+	failed(fmt.Errorf("the payload is encrypted and no valid key was given (set %s)", setup.KeyEnv))
+	return nil
+}
+
+func install(setup impl.SetupScript, launch impl.LaunchScript, archive io.ReaderAt, size int64) {
 	target := impl.GetInstallDir(setup.InstallDirectory)
 	_ = os.RemoveAll(target)
 	os.MkdirAll(target, 0755)
@@ -121,10 +214,40 @@ func install(setup impl.SetupScript, launch impl.LaunchScript) {
 		runSetupCommand(target, setup.PreInstallCommands)
 	}
 
-	if err := impl.Unzip(impl.GetInstallExtractFile(), target); err != nil {
+	if err := impl.UnzipReader(archive, size, target); err != nil {
 		damaged(err)
 	}
 
+	if err := impl.Relocate(target, setup.Relocations); err != nil {
+		failed(err)
+	}
+
+	installStub(target, setup)
+	markExecutables(target, setup)
+
+	if data, err := json.Marshal(launch.EntryPoint); err == nil {
+		os.WriteFile(impl.GetLaunchScript(target), data, os.ModePerm)
+	} else {
+		log.Fatalln("Corrupt entrypoint.")
+	}
+
+	// run post-install commands
+	if len(setup.PostInstallCommands) > 0 {
+		runSetupCommand(target, setup.PostInstallCommands)
+	}
+
+	err = os.Chdir(workingDir)
+	if err != nil {
+		// TODO: decide what to do here.
+		// For now, do nothing...
+	}
+
+	log.Println("Installation Completed!")
+}
+
+// installStub writes the stub of the running executable (without its
+// attachments) into the installation.
+func installStub(target string, setup impl.SetupScript) {
 	if exe, err := os.Executable(); err == nil {
 		exeTarget := path.Join(target, setup.ExeName)
 		if impl.FileExists(exeTarget) {
@@ -137,7 +260,9 @@ func install(setup impl.SetupScript, launch impl.LaunchScript) {
 	} else {
 		failed(err)
 	}
+}
 
+func markExecutables(target string, setup impl.SetupScript) {
 	if runtime.GOOS != "windows" {
 		for _, file := range setup.Executables {
 			file = path.Join(target, file)
@@ -146,27 +271,31 @@ func install(setup impl.SetupScript, launch impl.LaunchScript) {
 			}
 		}
 	}
+}
 
-	if data, err := json.Marshal(launch.EntryPoint); err == nil {
-		os.WriteFile(impl.GetLaunchScript(target), data, os.ModePerm)
-	} else {
-		log.Fatalln("Corrupt entrypoint.")
+// applyPatch updates the installation to the release of the patch. No
+// install commands are run.
+func applyPatch(setup impl.SetupScript, launch impl.LaunchScript, patch io.ReaderAt, size int64) {
+	target := impl.GetInstallDir(setup.InstallDirectory)
+	if !impl.FileExists(path.Join(target, setup.ExeName)) {
+		failed(fmt.Errorf("no installation found in %s", target))
 	}
 
-	_ = os.RemoveAll(impl.GetInstallExtractDir())
-
-	// run post-install commands
-	if len(setup.PostInstallCommands) > 0 {
-		runSetupCommand(target, setup.PostInstallCommands)
+	if err := impl.ApplyPatch(patch, size, target, setup.Relocations); err != nil {
+		failed(err)
 	}
 
-	err = os.Chdir(workingDir)
-	if err != nil {
-		// TODO: decide what to do here.
-		// For now, do nothing...
+	installStub(target, setup)
+	markExecutables(target, setup)
+
+	// the installed app finds its launch script by its own name.
+	if data, err := json.Marshal(launch.EntryPoint); err == nil {
+		os.WriteFile(path.Join(target, setup.ExeName+".launch"), data, os.ModePerm)
+	} else {
+		log.Fatalln("Corrupt entrypoint.")
 	}
 
-	log.Println("Installation Completed!")
+	log.Println("Update Completed!")
 }
 
 func launchApp() {
@@ -188,6 +317,21 @@ func launchApp() {
 		if runtime.GOOS == "darwin" && hasDarwinAppLock {
 			runtimeDir = path.Join(appDir, "../Resources")
 		}
+
+		// apps are relocated into their final location on first launch.
+		relocationsScript := impl.GetRelocationsScript(appDir)
+		if data, err := os.ReadFile(relocationsScript); err == nil {
+			var relocations []string
+			if err = json.Unmarshal(data, &relocations); err != nil {
+				damaged(err)
+			}
+
+			if err = impl.Relocate(runtimeDir, relocations); err != nil {
+				failed(err)
+			}
+			_ = os.Remove(relocationsScript)
+		}
+
 		os.Chdir(runtimeDir)
 
 		var cmd *exec.Cmd
@@ -2,4 +2,9 @@ module github.com/mcfriend99/exwrap
 
 go 1.22.2
 
-require github.com/maja42/ember v1.2.1
+require (
+	golang.org/x/crypto v0.31.0
+	golang.org/x/term v0.27.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
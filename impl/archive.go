@@ -0,0 +1,251 @@
+package impl
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+func isZipArchive(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".whl")
+}
+
+func isTarArchive(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// getArchiveMemberDest returns the path of an archive member inside the
+// payload. Cleaning the name as an absolute path keeps members from
+// landing outside of the prefix (ZipSlip).
+func getArchiveMemberDest(prefix string, name string) string {
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	return strings.TrimLeft(path.Join(prefix, name), "/")
+}
+
+// listArchiveEntries returns the files in the zip archive (or wheel) or
+// gzipped tarball at src as payload entries under the prefix.
+// The archive stays open until the build is closed.
+func listArchiveEntries(build *payloadBuild, src string, prefix string) ([]payloadEntry, error) {
+	if isZipArchive(src) {
+		return listZipEntries(build, src, prefix)
+	} else if isTarArchive(src) {
+		return listTarEntries(build, src, prefix)
+	}
+
+	return nil, fmt.Errorf("unsupported archive format: %s", src)
+}
+
+func listZipEntries(build *payloadBuild, src string, prefix string) ([]payloadEntry, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return nil, err
+	}
+	build.archives = append(build.archives, r)
+
+	files := make(map[string]*zip.File, 0)
+	for _, f := range r.File {
+		files[path.Clean("/"+f.Name)] = f
+	}
+
+	entries := make([]payloadEntry, 0)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		dest := getArchiveMemberDest(prefix, f.Name)
+
+		// symbolic links store their target as their content.
+		file, ok := f, true
+		for hops := 0; ok && file.Mode()&fs.ModeSymlink != 0; hops++ {
+			data, err := readZipFile(file)
+			if err != nil {
+				return nil, err
+			}
+			target := string(data)
+
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(file.Name), target)
+			}
+
+			file, ok = files[path.Clean("/"+target)]
+			ok = ok && hops < 40
+		}
+
+		if !ok || file.FileInfo().IsDir() {
+			fmt.Printf("Link skipped: %s!%s\n", src, f.Name)
+			continue
+		}
+
+		mode := file.Mode()
+		if mode.Perm() == 0 {
+			// archives created on windows carry no permissions.
+			mode |= 0644
+		}
+
+		entries = append(entries, payloadEntry{
+			Source: fmt.Sprintf("%s!%s", src, f.Name),
+			Dest:   dest,
+			Mode:   mode,
+			Open:   file.Open,
+		})
+	}
+
+	return entries, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// hashZipFile returns the SHA-256 of the content of f, copying it to w
+// along the way when w is not nil.
+func hashZipFile(f *zip.File, w io.Writer) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	hash := sha256.New()
+	out := io.Writer(hash)
+	if w != nil {
+		out = io.MultiWriter(w, hash)
+	}
+
+	if _, err = io.Copy(out, rc); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// A tarball can only be read from start to end, so its members are
+// decompressed once, while it is listed, into a spool file. The entries
+// read them from there, in any order and as often as needed (the
+// secrets, licenses and payload passes each read every member).
+type tarSpool struct {
+	file *os.File
+}
+
+func (s *tarSpool) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// tarMember is a member of a spooled tarball.
+type tarMember struct {
+	*io.SectionReader
+}
+
+func (m tarMember) Close() error {
+	return nil
+}
+
+func listTarEntries(build *payloadBuild, src string, prefix string) ([]payloadEntry, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	spool, err := os.CreateTemp("", "exwrap-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	build.archives = append(build.archives, &tarSpool{spool})
+
+	type member struct {
+		header *tar.Header
+		offset int64
+		size   int64
+	}
+
+	// links are resolved once all the members are known, as they may
+	// point to members further down the tarball.
+	members := make([]member, 0)
+	files := make(map[string]member, 0)
+
+	reader := tar.NewReader(gz)
+	offset := int64(0)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		m := member{header: header, offset: offset}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if m.size, err = io.Copy(spool, reader); err != nil {
+				return nil, err
+			}
+			offset += m.size
+		case tar.TypeSymlink, tar.TypeLink:
+		default:
+			continue
+		}
+
+		members = append(members, m)
+		files[path.Clean("/"+header.Name)] = m
+	}
+
+	entries := make([]payloadEntry, 0)
+	for _, m := range members {
+		dest := getArchiveMemberDest(prefix, m.header.Name)
+
+		// follow links (to links) up to the file they point at.
+		file, ok := m, true
+		for hops := 0; ok && file.header.Typeflag != tar.TypeReg; hops++ {
+			target := file.header.Linkname
+			if file.header.Typeflag == tar.TypeSymlink && !path.IsAbs(target) {
+				target = path.Join(path.Dir(file.header.Name), target)
+			}
+
+			file, ok = files[path.Clean("/"+target)]
+			ok = ok && hops < 40
+		}
+
+		if !ok {
+			fmt.Printf("Link skipped: %s!%s => %s\n", src, m.header.Name, m.header.Linkname)
+			continue
+		}
+
+		offset, size := file.offset, file.size
+
+		entries = append(entries, payloadEntry{
+			Source: fmt.Sprintf("%s!%s", src, m.header.Name),
+			Dest:   dest,
+			Mode:   fs.FileMode(file.header.Mode).Perm(),
+			Open: func() (io.ReadCloser, error) {
+				return tarMember{io.NewSectionReader(spool, offset, size)}, nil
+			},
+		})
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,222 @@
+package impl
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testArchiveMember is a member of a test archive. Links have a target
+// and no content.
+type testArchiveMember struct {
+	name    string
+	content string
+	symlink string
+	link    string
+}
+
+var testArchiveMembers = []testArchiveMember{
+	// a link to a member further down the archive.
+	{name: "early", symlink: "dir/b.txt"},
+	{name: "a.txt", content: "a"},
+	{name: "dir/b.txt", content: "b"},
+	{name: "../evil.txt", content: "evil"},
+	{name: "dir/up", symlink: "../a.txt"},
+	{name: "broken", symlink: "missing"},
+	{name: "loop", symlink: "loop"},
+}
+
+func writeTestZip(t *testing.T, file string, members []testArchiveMember) {
+	t.Helper()
+
+	out, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	w := zip.NewWriter(out)
+	w.Create("dir/")
+	for _, m := range members {
+		header := &zip.FileHeader{Name: m.name, Method: zip.Deflate}
+		header.SetMode(0644)
+
+		content := m.content
+		if m.symlink != "" {
+			header.SetMode(fs.ModeSymlink | 0777)
+			content = m.symlink
+		}
+
+		f, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTarGz(t *testing.T, file string, members []testArchiveMember) {
+	t.Helper()
+
+	out, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	w := tar.NewWriter(gz)
+	w.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, m := range members {
+		header := &tar.Header{Name: m.name, Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(m.content))}
+		if m.symlink != "" {
+			header = &tar.Header{Name: m.name, Typeflag: tar.TypeSymlink, Linkname: m.symlink, Mode: 0777}
+		} else if m.link != "" {
+			header = &tar.Header{Name: m.name, Typeflag: tar.TypeLink, Linkname: m.link, Mode: 0644}
+		}
+
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(m.content))
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+}
+
+// readTestEntries reads the entries backwards (twice), which a tarball
+// would only allow by starting over.
+func readTestEntries(t *testing.T, entries []payloadEntry) map[string]string {
+	t.Helper()
+
+	contents := make(map[string]string, 0)
+	for range 2 {
+		for i := len(entries) - 1; i >= 0; i-- {
+			file, err := entries[i].Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if old, ok := contents[entries[i].Dest]; ok && old != string(data) {
+				t.Errorf("%s read as %q, then %q", entries[i].Dest, old, data)
+			}
+			contents[entries[i].Dest] = string(data)
+		}
+	}
+
+	return contents
+}
+
+func TestListArchiveEntries(t *testing.T) {
+	// hard links only exist in tarballs and name the member as it is
+	// in the archive.
+	tarMembers := append(slices.Clone(testArchiveMembers), testArchiveMember{name: "dir/hard", link: "a.txt"})
+
+	want := map[string]string{
+		"vendor/early":     "b",
+		"vendor/a.txt":     "a",
+		"vendor/dir/b.txt": "b",
+		"vendor/evil.txt":  "evil",
+		"vendor/dir/up":    "a",
+	}
+	wantTar := map[string]string{"vendor/dir/hard": "a"}
+	for k, v := range want {
+		wantTar[k] = v
+	}
+
+	tests := []struct {
+		name    string
+		write   func(*testing.T, string, []testArchiveMember)
+		members []testArchiveMember
+		want    map[string]string
+	}{
+		{"app.zip", writeTestZip, testArchiveMembers, want},
+		{"app-1.0-py3-none-any.whl", writeTestZip, testArchiveMembers, want},
+		{"app.tar.gz", writeTestTarGz, tarMembers, wantTar},
+		{"app.tgz", writeTestTarGz, tarMembers, wantTar},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), tt.name)
+			tt.write(t, src, tt.members)
+
+			build := &payloadBuild{}
+			defer build.close()
+
+			entries, err := listArchiveEntries(build, src, "vendor")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := readTestEntries(t, entries)
+			if len(got) != len(tt.want) {
+				t.Errorf("%d entries, want %d: %q", len(got), len(tt.want), got)
+			}
+			for dest, content := range tt.want {
+				if got[dest] != content {
+					t.Errorf("%s = %q, want %q", dest, got[dest], content)
+				}
+			}
+		})
+	}
+
+	if _, err := listArchiveEntries(&payloadBuild{}, "app.rar", ""); err == nil {
+		t.Error("unsupported archive accepted")
+	}
+}
+
+func TestListTarEntriesRemovesSpool(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "app.tar.gz")
+	writeTestTarGz(t, src, testArchiveMembers)
+
+	build := &payloadBuild{}
+	if _, err := listArchiveEntries(build, src, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	spool := build.archives[0].(*tarSpool).file.Name()
+	build.close()
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("%s left behind: %v", spool, err)
+	}
+}
+
+func TestGetArchiveMemberDest(t *testing.T) {
+	tests := []struct {
+		prefix string
+		name   string
+		want   string
+	}{
+		{"vendor", "a/b.txt", "vendor/a/b.txt"},
+		{"vendor", "../evil.txt", "vendor/evil.txt"},
+		{"vendor", "a/../../../evil.txt", "vendor/evil.txt"},
+		{"vendor", "/etc/passwd", "vendor/etc/passwd"},
+		{"vendor", "..\\..\\evil.txt", "vendor/evil.txt"},
+		{"", "../evil.txt", "evil.txt"},
+	}
+
+	for _, tt := range tests {
+		if got := getArchiveMemberDest(tt.prefix, tt.name); got != tt.want {
+			t.Errorf("getArchiveMemberDest(%q, %q) = %q, want %q", tt.prefix, tt.name, got, tt.want)
+		}
+	}
+}
@@ -3,4 +3,10 @@ package impl
 type CommandLine struct {
 	ConfigFile     string
 	BuildDirectory string
+
+	// A PEM encoded Ed25519 private key to sign the payload with.
+	SignKey string
+
+	// A file holding the key to encrypt the payload with.
+	EncryptKeyFile string
 }
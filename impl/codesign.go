@@ -0,0 +1,320 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// An ad-hoc code signature is a super blob holding a single code
+// directory: the SHA-256 hashes of every page of the file up to the
+// signature. It carries no identity, so anything that changes a signed
+// file can sign it again, the same way the linker does. Apple Silicon
+// refuses to run code without a valid signature.
+const (
+	csMagicEmbeddedSignature = 0xfade0cc0
+	csMagicCodeDirectory     = 0xfade0c02
+	csSlotCodeDirectory      = 0
+	csAdHoc                  = 0x2
+	csHashTypeSha256         = 2
+	csExecSegMainBinary      = 0x1
+	csPageSizeBits           = 12
+	csPageSize               = 1 << csPageSizeBits
+
+	// the size of a version 0x20400 code directory header.
+	csCodeDirectorySize = 88
+)
+
+// The identifier and flags of the ad-hoc signature of a Mach-O file.
+type machoSignature struct {
+	Identifier string
+	Flags      uint32
+}
+
+// machoLoadCommands returns the load commands of the thin Mach-O file in
+// data as slices of it, so that they can be changed in place.
+func machoLoadCommands(data []byte, order binary.ByteOrder) ([][]byte, error) {
+	headerSize := 28
+	if order.Uint32(data) == macho.Magic64 {
+		headerSize = 32
+	}
+
+	cmds := make([][]byte, 0)
+	off := headerSize
+	for i := uint32(0); i < order.Uint32(data[16:]); i++ {
+		if off+8 > len(data) {
+			return nil, errors.New("truncated load commands")
+		}
+
+		size := int(order.Uint32(data[off+4:]))
+		if size < 8 || off+size > len(data) {
+			return nil, errors.New("malformed load command")
+		}
+
+		cmds = append(cmds, data[off:off+size])
+		off += size
+	}
+
+	return cmds, nil
+}
+
+func findMachOLoadCommand(cmds [][]byte, order binary.ByteOrder, cmd macho.LoadCmd) []byte {
+	for _, raw := range cmds {
+		if macho.LoadCmd(order.Uint32(raw)) == cmd {
+			return raw
+		}
+	}
+
+	return nil
+}
+
+// findMachOSegment returns the load command of the named segment.
+func findMachOSegment(cmds [][]byte, order binary.ByteOrder, name string) []byte {
+	for _, raw := range cmds {
+		cmd := macho.LoadCmd(order.Uint32(raw))
+		if (cmd == macho.LoadCmdSegment || cmd == macho.LoadCmdSegment64) && len(raw) >= 24 &&
+			string(bytes.TrimRight(raw[8:24], "\x00")) == name {
+			return raw
+		}
+	}
+
+	return nil
+}
+
+// machoSegmentFile returns the file offset and size of a segment.
+func machoSegmentFile(order binary.ByteOrder, raw []byte) (uint64, uint64) {
+	if macho.LoadCmd(order.Uint32(raw)) == macho.LoadCmdSegment64 {
+		return order.Uint64(raw[40:]), order.Uint64(raw[48:])
+	}
+
+	return uint64(order.Uint32(raw[32:])), uint64(order.Uint32(raw[36:]))
+}
+
+func setMachOSegmentFile(order binary.ByteOrder, raw []byte, offset uint64, size uint64) {
+	if macho.LoadCmd(order.Uint32(raw)) == macho.LoadCmdSegment64 {
+		order.PutUint64(raw[40:], offset)
+		order.PutUint64(raw[48:], size)
+	} else {
+		order.PutUint32(raw[32:], uint32(offset))
+		order.PutUint32(raw[36:], uint32(size))
+	}
+}
+
+// readMachOSignature returns the ad-hoc signature of the thin Mach-O
+// file in data, or nil when it is not signed. Files signed with an
+// identity can't be signed again, so they are an error.
+func readMachOSignature(data []byte, order binary.ByteOrder) (*machoSignature, error) {
+	cmds, err := machoLoadCommands(data, order)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := findMachOLoadCommand(cmds, order, machoCodeSignatureCommand)
+	if cmd == nil {
+		return nil, nil
+	}
+	if len(cmd) < 16 {
+		return nil, errors.New("malformed code signature command")
+	}
+
+	off, size := uint64(order.Uint32(cmd[8:])), uint64(order.Uint32(cmd[12:]))
+	if off+size > uint64(len(data)) || size < 12 {
+		return nil, errors.New("truncated code signature")
+	}
+
+	// the blobs are big endian whatever the file is.
+	blob := data[off : off+size]
+	if binary.BigEndian.Uint32(blob) != csMagicEmbeddedSignature {
+		return nil, errors.New("malformed code signature")
+	}
+
+	count := uint64(binary.BigEndian.Uint32(blob[8:]))
+	for i := uint64(0); i < count && 12+8*i+8 <= size; i++ {
+		entry := blob[12+8*i:]
+		if binary.BigEndian.Uint32(entry) != csSlotCodeDirectory {
+			continue
+		}
+
+		cd := uint64(binary.BigEndian.Uint32(entry[4:]))
+		if cd+24 > size || binary.BigEndian.Uint32(blob[cd:]) != csMagicCodeDirectory {
+			return nil, errors.New("malformed code directory")
+		}
+
+		flags := binary.BigEndian.Uint32(blob[cd+12:])
+		if flags&csAdHoc == 0 {
+			return nil, errors.New("the file is signed with an identity")
+		}
+
+		ident := cd + uint64(binary.BigEndian.Uint32(blob[cd+20:]))
+		if ident >= size {
+			return nil, errors.New("malformed code directory")
+		}
+		name := blob[ident:]
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+
+		return &machoSignature{Identifier: string(name), Flags: flags}, nil
+	}
+
+	return nil, errors.New("code signature without a code directory")
+}
+
+// cutMachOLinkedit removes the bytes from start to end out of the
+// __LINKEDIT segment of a thin Mach-O file, moving the data that follows
+// (and the offsets pointing at it) down.
+func cutMachOLinkedit(data []byte, order binary.ByteOrder, start uint64, end uint64) ([]byte, error) {
+	if start >= end {
+		return data, nil
+	}
+
+	cmds, err := machoLoadCommands(data, order)
+	if err != nil {
+		return nil, err
+	}
+
+	linkedit := findMachOSegment(cmds, order, "__LINKEDIT")
+	if linkedit == nil {
+		return nil, errors.New("missing __LINKEDIT segment")
+	}
+
+	offset, size := machoSegmentFile(order, linkedit)
+	if start < offset || end > offset+size || end > uint64(len(data)) {
+		return nil, errors.New("cut outside of __LINKEDIT")
+	}
+
+	for _, raw := range cmds {
+		shiftMachOLinkeditOffsets(order, raw, end, end-start)
+	}
+	setMachOSegmentFile(order, linkedit, offset, size-(end-start))
+
+	return append(data[:start], data[end:]...), nil
+}
+
+// signMachOAdHoc replaces the code signature of a thin Mach-O file with
+// a new ad-hoc one for its current content.
+func signMachOAdHoc(data []byte, signature *machoSignature) ([]byte, error) {
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	order := f.ByteOrder
+
+	cmds, err := machoLoadCommands(data, order)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := findMachOLoadCommand(cmds, order, machoCodeSignatureCommand)
+	linkedit := findMachOSegment(cmds, order, "__LINKEDIT")
+	text := findMachOSegment(cmds, order, "__TEXT")
+	if cmd == nil || linkedit == nil || text == nil {
+		return nil, errors.New("unsupported segment layout")
+	}
+
+	// the signature covers everything in front of it, so it goes last.
+	oldOff, oldSize := uint64(order.Uint32(cmd[8:])), uint64(order.Uint32(cmd[12:]))
+	linkeditOff, linkeditSize := machoSegmentFile(order, linkedit)
+	if oldOff+oldSize != linkeditOff+linkeditSize || oldOff+oldSize != uint64(len(data)) {
+		return nil, errors.New("the code signature is not at the end of the file")
+	}
+
+	if data, err = cutMachOLinkedit(data, order, oldOff, oldOff+oldSize); err != nil {
+		return nil, err
+	}
+
+	if cmds, err = machoLoadCommands(data, order); err != nil {
+		return nil, err
+	}
+	cmd = findMachOLoadCommand(cmds, order, machoCodeSignatureCommand)
+	linkedit = findMachOSegment(cmds, order, "__LINKEDIT")
+	textOff, textSize := machoSegmentFile(order, findMachOSegment(cmds, order, "__TEXT"))
+
+	codeSize := alignUp(uint64(len(data)), 16)
+	pages := (codeSize + csPageSize - 1) / csPageSize
+	hashOff := uint64(csCodeDirectorySize + len(signature.Identifier) + 1)
+	cdSize := hashOff + pages*sha256.Size
+	size := 20 + cdSize
+
+	order.PutUint32(cmd[8:], uint32(codeSize))
+	order.PutUint32(cmd[12:], uint32(size))
+	setMachOSegmentFile(order, linkedit, linkeditOff, codeSize+size-linkeditOff)
+
+	// __LINKEDIT must still be mapped whole.
+	if filesize := codeSize + size - linkeditOff; macho.LoadCmd(order.Uint32(linkedit)) == macho.LoadCmdSegment64 {
+		if order.Uint64(linkedit[32:]) < filesize {
+			order.PutUint64(linkedit[32:], filesize)
+		}
+	} else if uint64(order.Uint32(linkedit[28:])) < filesize {
+		order.PutUint32(linkedit[28:], uint32(filesize))
+	}
+
+	data = append(data, make([]byte, codeSize-uint64(len(data)))...)
+
+	execSegFlags := uint64(0)
+	if f.Type == macho.TypeExec {
+		execSegFlags = csExecSegMainBinary
+	}
+
+	sig := make([]byte, 0, size)
+	sig = binary.BigEndian.AppendUint32(sig, csMagicEmbeddedSignature)
+	sig = binary.BigEndian.AppendUint32(sig, uint32(size))
+	sig = binary.BigEndian.AppendUint32(sig, 1)
+	sig = binary.BigEndian.AppendUint32(sig, csSlotCodeDirectory)
+	sig = binary.BigEndian.AppendUint32(sig, 20)
+
+	sig = binary.BigEndian.AppendUint32(sig, csMagicCodeDirectory)
+	sig = binary.BigEndian.AppendUint32(sig, uint32(cdSize))
+	sig = binary.BigEndian.AppendUint32(sig, 0x20400)
+	sig = binary.BigEndian.AppendUint32(sig, signature.Flags)
+	sig = binary.BigEndian.AppendUint32(sig, uint32(hashOff))
+	sig = binary.BigEndian.AppendUint32(sig, csCodeDirectorySize)
+	sig = binary.BigEndian.AppendUint32(sig, 0)
+	sig = binary.BigEndian.AppendUint32(sig, uint32(pages))
+	sig = binary.BigEndian.AppendUint32(sig, uint32(codeSize))
+	sig = append(sig, sha256.Size, csHashTypeSha256, 0, csPageSizeBits)
+	sig = binary.BigEndian.AppendUint32(sig, 0)
+	sig = binary.BigEndian.AppendUint32(sig, 0)
+	sig = binary.BigEndian.AppendUint32(sig, 0)
+	sig = binary.BigEndian.AppendUint32(sig, 0)
+	sig = binary.BigEndian.AppendUint64(sig, 0)
+	sig = binary.BigEndian.AppendUint64(sig, textOff)
+	sig = binary.BigEndian.AppendUint64(sig, textSize)
+	sig = binary.BigEndian.AppendUint64(sig, execSegFlags)
+	sig = append(sig, signature.Identifier...)
+	sig = append(sig, 0)
+
+	for off := uint64(0); off < codeSize; off += csPageSize {
+		hash := sha256.Sum256(data[off:min(off+csPageSize, codeSize)])
+		sig = append(sig, hash[:]...)
+	}
+
+	if uint64(len(sig)) != size {
+		return nil, fmt.Errorf("code signature of %d bytes, expected %d", len(sig), size)
+	}
+
+	return append(data, sig...), nil
+}
+
+// resignMachO signs the thin files of the Mach-O file in data (thin or
+// fat) that have an ad-hoc signature again, after they were changed.
+// Files signed with an identity are an error, as only their signer can
+// sign them again.
+func resignMachO(data []byte) ([]byte, error) {
+	return mapMachOSlices(data, func(slice []byte) ([]byte, error) {
+		f, err := macho.NewFile(bytes.NewReader(slice))
+		if err != nil {
+			return nil, err
+		}
+
+		signature, err := readMachOSignature(slice, f.ByteOrder)
+		if err != nil || signature == nil {
+			return slice, err
+		}
+
+		return signMachOAdHoc(slice, signature)
+	})
+}
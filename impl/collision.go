@@ -0,0 +1,75 @@
+package impl
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// isSameSource reports whether two entry sources are the same file, even
+// when reached through different paths on the host.
+func isSameSource(a string, b string) bool {
+	if a == b {
+		return true
+	}
+
+	x, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	y, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(x, y)
+}
+
+// resolveCollisions settles the entries that end up at the same path in
+// the payload according to the collision policy. The same file found
+// twice (E.g. from an extra directory inside the root) is not a
+// collision.
+func resolveCollisions(config Config, entries []payloadEntry) []payloadEntry {
+	winners := make(map[string]int, 0)
+	collisions := 0
+
+	for i, entry := range entries {
+		dest := path.Clean(filepath.ToSlash(entry.Dest))
+
+		j, ok := winners[dest]
+		if !ok {
+			winners[dest] = i
+			continue
+		}
+
+		if isSameSource(entries[j].Source, entry.Source) {
+			continue
+		}
+
+		collisions++
+		switch config.CollisionPolicy {
+		case "first":
+			fmt.Printf("Collision: %s => %s (keeping %s)\n", entry.Source, dest, entries[j].Source)
+		case "last":
+			fmt.Printf("Collision: %s => %s (keeping %s)\n", entries[j].Source, dest, entry.Source)
+			winners[dest] = i
+		default:
+			fmt.Printf("Collision: %s and %s => %s\n", entries[j].Source, entry.Source, dest)
+		}
+	}
+
+	if collisions > 0 && config.CollisionPolicy == "error" {
+		log.Fatalf("Found %d file collision(s). Set collision_policy to \"first\" or \"last\" to allow them.", collisions)
+	}
+
+	resolved := make([]payloadEntry, 0, len(winners))
+	for i, entry := range entries {
+		if winners[path.Clean(filepath.ToSlash(entry.Dest))] == i {
+			resolved = append(resolved, entry)
+		}
+	}
+
+	return resolved
+}
@@ -0,0 +1,104 @@
+package impl
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func collisionEntries(sources ...string) []payloadEntry {
+	entries := make([]payloadEntry, 0, len(sources))
+	for _, src := range sources {
+		dest := "lib/" + filepath.Base(src)
+		if i := strings.Index(src, "!"); i >= 0 {
+			dest = "lib/" + src[i+1:]
+		}
+		entries = append(entries, payloadEntry{Source: src, Dest: dest})
+	}
+
+	return entries
+}
+
+func entrySources(entries []payloadEntry) []string {
+	sources := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		sources = append(sources, entry.Source)
+	}
+
+	return sources
+}
+
+func TestResolveCollisions(t *testing.T) {
+	abs, err := filepath.Abs(filepath.Join("testdata", "elf", "lib.c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same file through a symbolic link.
+	link := filepath.Join(t.TempDir(), "lib.c")
+	if err := os.Symlink(abs, link); err != nil {
+		t.Skip("no symbolic links:", err)
+	}
+
+	tests := []struct {
+		name    string
+		policy  string
+		sources []string
+		want    []string
+	}{
+		{"first", "first", []string{"a.zip!lib.c", abs, "b.zip!lib.c"}, []string{"a.zip!lib.c"}},
+		{"last", "last", []string{"a.zip!lib.c", abs, "b.zip!lib.c"}, []string{"b.zip!lib.c"}},
+		{"error without collisions", "error", []string{"a.zip!lib.c", "a.zip!other.c"}, []string{"a.zip!lib.c", "a.zip!other.c"}},
+		{"same path twice", "error", []string{abs, abs}, []string{abs}},
+		{"same file through a link", "error", []string{abs, link}, []string{abs}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := entrySources(resolveCollisions(Config{CollisionPolicy: tt.policy}, collisionEntries(tt.sources...)))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("kept %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCollisionsError(t *testing.T) {
+	if os.Getenv("EXWRAP_TEST_COLLISION") == "1" {
+		resolveCollisions(Config{CollisionPolicy: "error"}, collisionEntries("a.zip!lib.c", "b.zip!lib.c"))
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestResolveCollisionsError$")
+	cmd.Env = append(os.Environ(), "EXWRAP_TEST_COLLISION=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "Found 1 file collision(s).") {
+		t.Errorf("collision not fatal: %v\n%s", err, out)
+	}
+}
+
+func TestLoadConfigExtrasAbsolute(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "exwrap.json")
+	config := `{
+		"entry_point": ["lib.c"],
+		"extra_files": {"testdata/elf/lib.c": "lib.c"},
+		"extra_dirs": {"testdata/elf": "elf"}
+	}`
+	if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := LoadConfig(CommandLine{ConfigFile: file})
+
+	files, _ := filepath.Abs(filepath.Join("testdata", "elf", "lib.c"))
+	dirs, _ := filepath.Abs(filepath.Join("testdata", "elf"))
+	if got := getSortedKeys(c.ExtraFiles); !slices.Equal(got, []string{files}) {
+		t.Errorf("extra files = %q, want %q", got, files)
+	}
+	if got := getSortedKeys(c.ExtraDirectories); !slices.Equal(got, []string{dirs}) {
+		t.Errorf("extra directories = %q, want %q", got, dirs)
+	}
+}
@@ -2,11 +2,15 @@ package impl
 
 import (
 	"encoding/json"
+	"io/fs"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // MacOS specific configuration
@@ -17,6 +21,134 @@ type DarwinConfig struct {
 	// When true, exwrap generates and app bundle instead of an installer.
 	// Default: false
 	CreateApp bool `json:"create_app,omitempty"`
+
+	// A list of dynamic libraries (.dylib) to copy into the
+	// Contents/Frameworks directory of the app bundle.
+	// Only used when create_app is true.
+	Frameworks []string `json:"frameworks,omitempty"`
+
+	// A list of glob patterns matching the binaries in the app whose
+	// references to the frameworks should be rewritten to
+	// @executable_path/../Frameworks. For example, ["myapp", "lib/*.so"].
+	// That path holds for the app and for entry points at the root of
+	// the app (Contents/Resources), and for anything they load.
+	// The frameworks themselves are always rewritten.
+	Relink []string `json:"relink,omitempty"`
+}
+
+// Python specific configuration
+type PythonConfig struct {
+	// The path of a virtual environment relative to the root
+	// (E.g. ".venv"). When set, the shebangs of its scripts and its
+	// pyvenv.cfg are rewritten so that the environment keeps working
+	// from wherever it is installed. The console script launchers
+	// (Scripts/*.exe) of windows environments are left as they are.
+	Venv string `json:"venv,omitempty"`
+}
+
+// Shared library bundling configuration
+type LibrariesConfig struct {
+	// When true, the shared libraries the ELF executables (from the
+	// executables list) depend on are resolved on the build machine
+	// and added to the final executable.
+	// Default: false
+	Bundle bool `json:"bundle,omitempty"`
+
+	// The directory the libraries are added to.
+	// Defaults to "lib".
+	Directory string `json:"dir,omitempty"`
+
+	// Extra directories to search for libraries before the
+	// standard library paths of the build machine.
+	SearchPaths []string `json:"search_paths,omitempty"`
+
+	// When set, only libraries whose name matches one of these
+	// glob patterns are bundled.
+	Allow []string `json:"allow,omitempty"`
+
+	// Libraries whose name matches one of these glob patterns
+	// are never bundled.
+	// Defaults to the libraries of the GNU C library.
+	Deny []string `json:"deny,omitempty"`
+
+	// A list of glob patterns matching the paths (in the final
+	// executable) of ELF executables and libraries whose RUNPATH
+	// should point at the libraries directory relative to their
+	// own location ($ORIGIN). For example, ["bin/*", "lib/*"].
+	RunPath []string `json:"runpath,omitempty"`
+}
+
+// A rule deciding where files end up in the final executable
+type MappingRule struct {
+	// A glob pattern (see templates) matched against the path of a
+	// file relative to the root, or its absolute path for files
+	// outside of it. A pattern matching a directory matches all the
+	// files in it. For example, "assets", "src/**/*.py".
+	From string `json:"from"`
+
+	// The path of the file in the final executable as a Go template.
+	// On top of the template variables, it has access to
+	// {{ .Path }} (the path matched against), {{ .Base }}, {{ .Dir }}
+	// and {{ .Rest }} (the part of the path below the directory
+	// matched, or the file name when the file itself matched).
+	// Defaults to {{ .Path }}.
+	To string `json:"to,omitempty"`
+
+	// When true, the matching files are left out.
+	Exclude bool `json:"exclude,omitempty"`
+}
+
+// Third-party license collection configuration
+type LicensesConfig struct {
+	// When true, the license files (LICENSE, COPYING, NOTICE and
+	// variants like LICENSE-MIT or LICENSE.txt) and the licenses
+	// declared by python distributions (*.dist-info) and node packages
+	// (package.json) in the final executable are collected into a
+	// notices file, along with a JSON summary.
+	// Default: false
+	Collect bool `json:"collect,omitempty"`
+
+	// The path of the notices file in the final executable. The
+	// summary is added next to it with a .json extension.
+	// Defaults to "THIRD_PARTY_NOTICES".
+	File string `json:"file,omitempty"`
+
+	// A list of glob patterns matching the licenses that fail the
+	// build when used by any component. For example, ["GPL-*", "AGPL*"].
+	Deny []string `json:"deny,omitempty"`
+}
+
+// Payload encryption configuration. Payloads are encrypted when a key
+// is given at build time (See exwrap build -encrypt-key-file), these
+// settings tell the installer where to find it.
+type EncryptionConfig struct {
+	// The environment variable the installer reads the key from.
+	// Defaults to "EXWRAP_KEY".
+	KeyEnv string `json:"key_env,omitempty"`
+
+	// A license file holding the key, read when the environment
+	// variable is not set. Relative paths are relative to the
+	// directory of the installer.
+	// Defaults to "<target_name>.key".
+	KeyFile string `json:"key_file,omitempty"`
+
+	// When true, the installer fails instead of prompting for the
+	// key when neither of the above has it.
+	// Default: false
+	NoPrompt bool `json:"no_prompt,omitempty"`
+}
+
+// Sidecar payload configuration
+type SidecarConfig struct {
+	// When true, the payload is written next to the executable in
+	// <target_name>.dat instead of into it. Both must be shipped
+	// together.
+	// Default: false
+	Enabled bool `json:"enabled,omitempty"`
+
+	// When set, the payload is split into volumes of at most this many
+	// megabytes (<target_name>.dat.001, <target_name>.dat.002, ...).
+	VolumeSize int64 `json:"volume_size,omitempty"`
 }
 
 type Config struct {
@@ -32,6 +164,9 @@ type Config struct {
 	// Defaults to the name of the root folder.
 	TargetName string `json:"target_name,omitempty"`
 
+	// The version of the application.
+	Version string `json:"version,omitempty"`
+
 	// A list of commands to be run in order before installation begins
 	PostInstallCommands []string `json:"post_install_cmds,omitempty"`
 
@@ -50,24 +185,78 @@ type Config struct {
 	TargetOs string `json:"os,omitempty"`
 
 	// The processor architecture for which you are generating an
-	// executable for.
+	// executable for. "universal" builds a Linux installer that runs
+	// on amd64, arm64, arm and 386 alike, or a MacOS executable (or
+	// app) that runs on amd64 and arm64 alike.
 	// Defaults to your processor architecture.
 	TargetArch string `json:"arch,omitempty"`
 
-	// A key/value pair that tells exwrap to replace any path the
-	// matches or starts with the pattern indicated in the value
-	// with the one indicated in the key.
-	// In the format "override => match"
+	// Files and directories placed elsewhere in the final executable.
+	// In the format "source => destination"
+	// Each one becomes a mapping rule matching the source literally (no
+	// glob): a file goes to the destination and a directory takes the
+	// files in it along, while an empty destination leaves a file out.
+	// These rules and those of extra_dirs and extra_files are tried
+	// with the longest source first, so a nested path wins over the
+	// directory it is in.
+	// Rules in mappings take precedence over these.
 	PathOverrides map[string]string `json:"path_overrides,omitempty"`
 
-	// Extra directories to add to the final executable.
+	// Extra directories to add to the final executable, read from the
+	// host filesystem even when FS is set.
 	// In the format "source => destination"
+	// Rules in mappings take precedence over these.
 	ExtraDirectories map[string]string `json:"extra_dirs"`
 
-	// Extra files to add to the final executable.
+	// Extra files to add to the final executable, read from the host
+	// filesystem even when FS is set.
 	// In the format "source => destination"
+	// Rules in mappings take precedence over these.
 	ExtraFiles map[string]string `json:"extra_files"`
 
+	// Archives whose files are added to the final executable without
+	// unpacking them first. Supports .zip, .whl, .tar.gz and .tgz files.
+	// In the format "source => destination prefix"
+	ExtraArchives map[string]string `json:"extra_archives,omitempty"`
+
+	// An ordered list of rules deciding where files end up in the
+	// final executable. The first rule matching a file wins.
+	Mappings []MappingRule `json:"mappings,omitempty"`
+
+	// A list of glob patterns (see templates) matched against the
+	// paths of the files in the root relative to it. When set, only
+	// the matching files of the root are added to the final executable
+	// and exclusions still apply. A pattern matching a directory
+	// matches all the files in it. For example, ["app", "*.py"].
+	Include []string `json:"include,omitempty"`
+
+	// What to do when several files end up at the same path in the
+	// final executable. One of "error" (fail the build), "first"
+	// (keep the file found first) or "last" (keep the file found
+	// last). Files are found in the root first, followed by
+	// extra_dirs, extra_files and extra_archives.
+	// Defaults to "error".
+	CollisionPolicy string `json:"collision_policy,omitempty"`
+
+	// What to do when paths in the final executable can't be created
+	// on windows or darwin (E.g. names only differing by case,
+	// reserved names like "aux.py", or paths too long once joined with
+	// the install path). One of "error", "warn" or "off".
+	// Defaults to "error".
+	FsCheckPolicy string `json:"fs_check_policy,omitempty"`
+
+	// What to do when files in the final executable likely hold
+	// secrets (E.g. .env files, private keys, AWS access keys, Django
+	// SECRET_KEY literals or Git repositories). One of "warn", "error"
+	// or "off".
+	// Defaults to "warn".
+	SecretsPolicy string `json:"secrets_policy,omitempty"`
+
+	// A list of glob patterns (see templates) matching the paths (in
+	// the final executable) of files that are not secrets. A pattern
+	// matching a directory matches all the files in it.
+	SecretsAllow []string `json:"secrets_allow,omitempty"`
+
 	// A list of directories to not add to the final executable.
 	ExcludeDirectories []string `json:"exclude_dirs"`
 
@@ -94,8 +283,75 @@ type Config struct {
 	// the same name
 	Icon string `json:"icon,omitempty"`
 
+	// A list of glob patterns matching files in the final executable
+	// (E.g. "config.ini", "**/settings.py") that are rendered as Go
+	// templates when added to it. Templates have access to
+	// {{ .Version }}, {{ .TargetName }}, {{ .TargetOs }},
+	// {{ .TargetArch }}, {{ .InstallPath }}, {{ .BuildTime }} and
+	// the variables set in vars.
+	Templates []string `json:"templates,omitempty"`
+
+	// User defined variables available to templates.
+	Variables map[string]string `json:"vars,omitempty"`
+
+	// The time the build started at in RFC 3339 format. It honors
+	// the SOURCE_DATE_EPOCH environment variable for reproducible
+	// builds.
+	BuildTime string `json:"-"`
+
+	// When true, debug information and symbol tables are removed
+	// from the ELF, Mach-O and PE binaries in the final executable.
+	// Mach-O files keep their global symbols (like `strip -x`) and
+	// are signed again when they carry an ad-hoc signature. Files
+	// signed with an identity (including PE files) are left alone.
+	// Default: false
+	Strip bool `json:"strip,omitempty"`
+
+	// The hex encoded Ed25519 public key to pin into the wrapper stub.
+	// When set, the executable only installs when its payload is
+	// signed with the matching private key (See exwrap build -sign-key).
+	// The key is only as trustworthy as the stub holding it, so this
+	// guards against tampering only when the executable is code signed
+	// (Authenticode, codesign).
+	// Darwin stubs are signed ad-hoc again once the key is pinned.
+	PublicKey string `json:"public_key,omitempty"`
+
+	// Shared library bundling configurations.
+	Libraries LibrariesConfig `json:"libraries,omitempty"`
+
+	// Third-party license collection configurations.
+	Licenses LicensesConfig `json:"licenses,omitempty"`
+
+	// Payload encryption configurations.
+	Encryption EncryptionConfig `json:"encryption,omitempty"`
+
+	// Sidecar payload configurations.
+	Sidecar SidecarConfig `json:"sidecar,omitempty"`
+
 	// Darwin (MacOS) specific configurations.
 	Darwin DarwinConfig `json:"mac_os,omitempty"`
+
+	// Python specific configurations.
+	Python PythonConfig `json:"python,omitempty"`
+
+	// The filesystem the files of the root are read from, with the
+	// root at its top. Programs using exwrap as a library may set it
+	// to any fs.FS (E.g. an embed.FS or a zip.Reader).
+	// Extra files, directories and archives live outside of the root
+	// and are always read from the host filesystem.
+	// Defaults to the root directory on disk.
+	FS fs.FS `json:"-"`
+}
+
+// getBuildTime returns the current time, or the one in
+// SOURCE_DATE_EPOCH for reproducible builds.
+func getBuildTime() string {
+	buildTime := time.Now()
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		buildTime = time.Unix(epoch, 0)
+	}
+
+	return buildTime.UTC().Format(time.RFC3339)
 }
 
 func LoadConfig(cmd CommandLine) Config {
@@ -127,6 +383,10 @@ func LoadConfig(cmd CommandLine) Config {
 		}
 	}
 
+	if config.FS == nil {
+		config.FS = os.DirFS(config.Root)
+	}
+
 	// ensure some major compatibilities
 	config.SourceOs = strings.ToLower(config.SourceOs)
 	config.SourceArch = strings.ToLower(config.SourceArch)
@@ -179,6 +439,7 @@ func LoadConfig(cmd CommandLine) Config {
 	} else {
 		for i, x := range config.ExtraDirectories {
 			if abs, err := getFileAbsPath(i); err == nil {
+				delete(config.ExtraDirectories, i)
 				config.ExtraDirectories[abs] = x
 			} else {
 				delete(config.ExtraDirectories, i)
@@ -191,6 +452,7 @@ func LoadConfig(cmd CommandLine) Config {
 	} else {
 		for i, x := range config.ExtraFiles {
 			if abs, err := getFileAbsPath(i); err == nil {
+				delete(config.ExtraFiles, i)
 				config.ExtraFiles[abs] = x
 			} else {
 				delete(config.ExtraFiles, i)
@@ -198,6 +460,40 @@ func LoadConfig(cmd CommandLine) Config {
 		}
 	}
 
+	if config.ExtraArchives == nil {
+		config.ExtraArchives = make(map[string]string, 0)
+	} else {
+		for i, x := range config.ExtraArchives {
+			if abs, err := getFileAbsPath(i); err == nil {
+				delete(config.ExtraArchives, i)
+				config.ExtraArchives[abs] = x
+			} else {
+				delete(config.ExtraArchives, i)
+			}
+		}
+	}
+
+	config.CollisionPolicy = strings.ToLower(config.CollisionPolicy)
+	if config.CollisionPolicy == "" {
+		config.CollisionPolicy = "error"
+	} else if !stringListContains([]string{"error", "first", "last"}, config.CollisionPolicy) {
+		log.Fatalln("Invalid collision policy:", config.CollisionPolicy)
+	}
+
+	config.FsCheckPolicy = strings.ToLower(config.FsCheckPolicy)
+	if config.FsCheckPolicy == "" {
+		config.FsCheckPolicy = "error"
+	} else if !stringListContains([]string{"error", "warn", "off"}, config.FsCheckPolicy) {
+		log.Fatalln("Invalid filesystem check policy:", config.FsCheckPolicy)
+	}
+
+	config.SecretsPolicy = strings.ToLower(config.SecretsPolicy)
+	if config.SecretsPolicy == "" {
+		config.SecretsPolicy = "warn"
+	} else if !stringListContains([]string{"warn", "error", "off"}, config.SecretsPolicy) {
+		log.Fatalln("Invalid secrets policy:", config.SecretsPolicy)
+	}
+
 	if config.ExcludeDirectories == nil {
 		config.ExcludeDirectories = make([]string, 0)
 		config.ExcludeDirectories = append(config.ExcludeDirectories, cmd.BuildDirectory)
@@ -229,10 +525,75 @@ func LoadConfig(cmd CommandLine) Config {
 		config.ExcludeFiles = newList
 	}
 
+	newIncludeList := make([]string, 0)
+	for _, x := range config.Include {
+		newIncludeList = append(newIncludeList, path.Clean(filepath.ToSlash(x)))
+	}
+	config.Include = newIncludeList
+
+	if config.Libraries.Directory == "" {
+		config.Libraries.Directory = "lib"
+	} else {
+		config.Libraries.Directory = path.Clean(filepath.ToSlash(config.Libraries.Directory))
+	}
+
+	if config.Licenses.File == "" {
+		config.Licenses.File = "THIRD_PARTY_NOTICES"
+	} else {
+		config.Licenses.File = strings.TrimLeft(path.Clean(filepath.ToSlash(config.Licenses.File)), "/")
+	}
+
+	if config.Encryption.KeyEnv == "" {
+		config.Encryption.KeyEnv = "EXWRAP_KEY"
+	}
+
+	if config.Encryption.KeyFile == "" {
+		config.Encryption.KeyFile = config.TargetName + ".key"
+	}
+
+	if config.Sidecar.VolumeSize < 0 {
+		log.Fatalln("The sidecar volume size cannot be negative.")
+	}
+
+	if config.Libraries.Deny == nil {
+		config.Libraries.Deny = defaultLibraryDenyList
+	}
+
+	newSearchPathList := make([]string, 0)
+	for _, x := range config.Libraries.SearchPaths {
+		if abs, err := getFileAbsPath(x); err == nil {
+			newSearchPathList = append(newSearchPathList, abs)
+		}
+	}
+	config.Libraries.SearchPaths = newSearchPathList
+
+	newFrameworkList := make([]string, 0)
+	for _, x := range config.Darwin.Frameworks {
+		if abs, err := getFileAbsPath(x); err == nil {
+			newFrameworkList = append(newFrameworkList, abs)
+		}
+	}
+	config.Darwin.Frameworks = newFrameworkList
+
 	if config.Darwin.PlistFile == "" {
 		config.Darwin.PlistFile = path.Join(getResourcesDirectory(), "Info.plist")
 	}
 
+	config.BuildTime = getBuildTime()
+
+	if config.Variables == nil {
+		config.Variables = make(map[string]string, 0)
+	}
+
+	if config.Python.Venv != "" {
+		if filepath.IsAbs(config.Python.Venv) {
+			if rel, err := filepath.Rel(config.Root, config.Python.Venv); err == nil {
+				config.Python.Venv = rel
+			}
+		}
+		config.Python.Venv = path.Clean(filepath.ToSlash(config.Python.Venv))
+	}
+
 	if config.PreInstallCommands == nil {
 		config.PreInstallCommands = make([]string, 0)
 	}
@@ -10,8 +10,7 @@ const (
 	EmbededArchiveName    = "archive"
 	EmbededSetupScript    = "setup"
 	EmbededLaunchScript   = "launch"
-	TmpExtractDir         = ".exwraptmp"
-	WinTmpExtractDir      = "~exwraptmp"
-	ExtractDstDir         = "tmp"
-	ExtractDstFile        = "app.zip"
+	EmbededPatchName      = "patch"
+	EmbededSidecarName    = "sidecar"
+	InstallDirPlaceholder = "@@EXWRAP_INSTALL_DIR@@"
 )
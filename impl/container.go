@@ -0,0 +1,369 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The version of exwrap. Release builds set it with
+// -ldflags "-X github.com/mcfriend99/exwrap/impl.Version=<version>".
+var Version = "dev"
+
+// A container is the wrapper stub followed by its attachments, a table
+// of contents (JSON) and a fixed size trailer:
+//
+//	stub | attachments | toc | signature block | trailer
+//
+// The trailer (little endian) is laid out as
+//
+//	version (2) | flags (2) | reserved (4) | payload offset (8) |
+//	toc offset (8) | toc size (8) | payload sha256 (32) | magic (8)
+//
+// where the payload is everything from the first attachment to the end
+// of the table of contents. Attachment offsets in the table of contents
+// are relative to the payload offset. The signature block is only there
+// for signed containers (see signing.go).
+const (
+	ContainerVersion     = 1
+	containerMagic       = "EXWRAP\x00\x01"
+	containerTrailerSize = 72
+
+	// the largest table of contents read into memory.
+	containerMaxTocSize = 16 << 20
+)
+
+// Container flags
+const (
+	containerFlagSigned uint16 = 1 << iota
+)
+
+var ErrNoContainer = errors.New("no attachments found")
+
+type ContainerAttachment struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type ContainerTOC struct {
+	// The version of exwrap that generated the container.
+	Generator   string                `json:"generator"`
+	Attachments []ContainerAttachment `json:"attachments"`
+}
+
+type containerTrailer struct {
+	Version       uint16
+	Flags         uint16
+	Reserved      uint32
+	PayloadOffset uint64
+	TocOffset     uint64
+	TocSize       uint64
+	PayloadHash   [32]byte
+	Magic         [8]byte
+}
+
+type Container struct {
+	file      *os.File
+	trailer   containerTrailer
+	toc       ContainerTOC
+	tocData   []byte
+	signature []byte
+	sidecar   *Sidecar
+}
+
+// writeContainer appends the attachments (name => content), the table of
+// contents and the trailer to out, which must be positioned right
+// after the stub of stubSize bytes. The container is signed with key
+// unless it is nil.
+func writeContainer(out io.Writer, stubSize int64, attachments map[string]io.Reader, key ed25519.PrivateKey) error {
+	names := make([]string, 0, len(attachments))
+	for name := range attachments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	payload := sha256.New()
+	toc := ContainerTOC{Generator: Version, Attachments: make([]ContainerAttachment, 0)}
+	offset := int64(0)
+
+	for _, name := range names {
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(out, payload, hash), attachments[name])
+		if err != nil {
+			return fmt.Errorf("Failed to write attachment %q: %s", name, err)
+		}
+
+		fmt.Printf("\tAdding %q (%d bytes)\n", name, size)
+
+		toc.Attachments = append(toc.Attachments, ContainerAttachment{
+			Name:   name,
+			Offset: offset,
+			Size:   size,
+			SHA256: hex.EncodeToString(hash.Sum(nil)),
+		})
+		offset += size
+	}
+
+	tocData, err := json.Marshal(toc)
+	if err != nil {
+		return err
+	}
+	payload.Write(tocData)
+
+	if _, err = out.Write(tocData); err != nil {
+		return err
+	}
+
+	trailer := containerTrailer{
+		Version:       ContainerVersion,
+		PayloadOffset: uint64(stubSize),
+		TocOffset:     uint64(stubSize + offset),
+		TocSize:       uint64(len(tocData)),
+	}
+
+	if key != nil {
+		if _, err = out.Write(signContainer(key, tocData)); err != nil {
+			return err
+		}
+		trailer.Flags |= containerFlagSigned
+	}
+	copy(trailer.PayloadHash[:], payload.Sum(nil))
+	copy(trailer.Magic[:], containerMagic)
+
+	return binary.Write(out, binary.LittleEndian, trailer)
+}
+
+// OpenContainer opens the container at file, checking that its trailer
+// and table of contents are sound. It returns ErrNoContainer for files
+// without any attachments (E.g. a bare stub).
+func OpenContainer(file string) (*Container, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Container{file: f}
+	if err = c.readTrailer(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// OpenSelf opens the container of the running executable (See
+// GetPayloadPath).
+func OpenSelf() (*Container, error) {
+	payload, err := GetPayloadPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenContainer(payload)
+}
+
+func (c *Container) readTrailer() error {
+	stat, err := c.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := stat.Size()
+	if size < containerTrailerSize {
+		return ErrNoContainer
+	}
+
+	r := io.NewSectionReader(c.file, size-containerTrailerSize, containerTrailerSize)
+	if err = binary.Read(r, binary.LittleEndian, &c.trailer); err != nil {
+		return err
+	}
+
+	if string(c.trailer.Magic[:]) != containerMagic {
+		return ErrNoContainer
+	}
+
+	if c.trailer.Version > ContainerVersion {
+		return fmt.Errorf("unsupported container version %d (this stub supports up to %d)", c.trailer.Version, ContainerVersion)
+	}
+
+	t := c.trailer
+	if t.TocSize > containerMaxTocSize {
+		return fmt.Errorf("malformed container trailer: table of contents of %d bytes", t.TocSize)
+	}
+
+	// the table of contents (and signature) end right at the trailer.
+	// offsets are checked one at a time as they could overflow.
+	end := uint64(size - containerTrailerSize)
+	if c.Signed() {
+		if end < signatureBlockSize {
+			return errors.New("malformed container trailer")
+		}
+		end -= signatureBlockSize
+	}
+
+	if t.TocSize > end || t.TocOffset != end-t.TocSize || t.PayloadOffset > t.TocOffset {
+		return errors.New("malformed container trailer")
+	}
+
+	c.tocData = make([]byte, t.TocSize)
+	if _, err = c.file.ReadAt(c.tocData, int64(t.TocOffset)); err != nil {
+		return err
+	}
+
+	if c.Signed() {
+		c.signature = make([]byte, signatureBlockSize)
+		if _, err = c.file.ReadAt(c.signature, int64(t.TocOffset+t.TocSize)); err != nil {
+			return err
+		}
+	}
+
+	if err = json.Unmarshal(c.tocData, &c.toc); err != nil {
+		return fmt.Errorf("malformed table of contents: %s", err)
+	}
+
+	// attachments are laid out back to back.
+	sort.Slice(c.toc.Attachments, func(i, j int) bool {
+		return c.toc.Attachments[i].Offset < c.toc.Attachments[j].Offset
+	})
+
+	payloadSize := t.TocOffset - t.PayloadOffset
+	next := int64(0)
+	for _, a := range c.toc.Attachments {
+		if a.Offset != next || a.Size < 0 || uint64(a.Size) > payloadSize-uint64(next) {
+			return fmt.Errorf("malformed table of contents: attachment %q is misplaced", a.Name)
+		}
+		next += a.Size
+	}
+
+	if uint64(next) != payloadSize {
+		return errors.New("malformed table of contents: attachments don't fill the payload")
+	}
+
+	return nil
+}
+
+func (c *Container) Close() error {
+	if c.sidecar != nil {
+		c.sidecar.Close()
+	}
+
+	return c.file.Close()
+}
+
+// Generator returns the version of exwrap that built the container.
+func (c *Container) Generator() string {
+	return c.toc.Generator
+}
+
+// PayloadOffset returns where the attachments start, which is the size
+// of the stub.
+func (c *Container) PayloadOffset() int64 {
+	return int64(c.trailer.PayloadOffset)
+}
+
+// Stub returns a reader for the wrapper stub the attachments follow.
+func (c *Container) Stub() *io.SectionReader {
+	return io.NewSectionReader(c.file, 0, c.PayloadOffset())
+}
+
+// List returns the names of the attachments in the order they are
+// laid out in.
+func (c *Container) List() []string {
+	names := make([]string, 0, len(c.toc.Attachments))
+	for _, a := range c.toc.Attachments {
+		names = append(names, a.Name)
+	}
+
+	return names
+}
+
+func (c *Container) attachment(name string) (ContainerAttachment, bool) {
+	for _, a := range c.toc.Attachments {
+		if a.Name == name {
+			return a, true
+		}
+	}
+
+	return ContainerAttachment{}, false
+}
+
+// Size returns the size of the attachment, or -1 if there is none.
+func (c *Container) Size(name string) int64 {
+	if a, ok := c.attachment(name); ok {
+		return a.Size
+	}
+
+	return -1
+}
+
+// Reader returns a reader for the content of the attachment, or nil if
+// there is none.
+func (c *Container) Reader(name string) *io.SectionReader {
+	if a, ok := c.attachment(name); ok {
+		return io.NewSectionReader(c.file, c.PayloadOffset()+a.Offset, a.Size)
+	}
+
+	return nil
+}
+
+// Archive returns a reader for the payload archive, whether it is
+// attached or in a sidecar next to the container (which is checked
+// first, see sidecar.go). It returns nil if there is neither.
+func (c *Container) Archive() (*io.SectionReader, error) {
+	if r := c.Reader(EmbededArchiveName); r != nil {
+		return r, nil
+	}
+
+	r := c.Reader(EmbededSidecarName)
+	if r == nil {
+		return nil, nil
+	}
+
+	if c.sidecar == nil {
+		manifest, err := readSidecarManifest(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.sidecar, err = openSidecar(manifest, filepath.Dir(c.file.Name())); err != nil {
+			return nil, err
+		}
+	}
+
+	return io.NewSectionReader(c.sidecar, 0, c.sidecar.Size()), nil
+}
+
+// Verify checks the content of every attachment and the payload as a
+// whole against their SHA-256 hashes.
+func (c *Container) Verify() error {
+	payload := sha256.New()
+
+	for _, a := range c.toc.Attachments {
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(payload, hash), c.Reader(a.Name)); err != nil {
+			return err
+		}
+
+		if hex.EncodeToString(hash.Sum(nil)) != a.SHA256 {
+			return fmt.Errorf("attachment %q is corrupt (checksum mismatch)", a.Name)
+		}
+	}
+
+	payload.Write(c.tocData)
+	if !bytes.Equal(payload.Sum(nil), c.trailer.PayloadHash[:]) {
+		return errors.New("payload is corrupt (checksum mismatch)")
+	}
+
+	return nil
+}
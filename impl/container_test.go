@@ -0,0 +1,239 @@
+package impl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const testStub = "#!stub\n"
+
+// writeTestContainer writes a stub followed by the payload, the table of
+// contents and a trailer describing them, as changed by mutate.
+func writeTestContainer(t *testing.T, payload string, toc string, mutate func(*containerTrailer)) string {
+	t.Helper()
+
+	trailer := containerTrailer{
+		Version:       ContainerVersion,
+		PayloadOffset: uint64(len(testStub)),
+		TocOffset:     uint64(len(testStub) + len(payload)),
+		TocSize:       uint64(len(toc)),
+	}
+	copy(trailer.Magic[:], containerMagic)
+	if mutate != nil {
+		mutate(&trailer)
+	}
+
+	var out bytes.Buffer
+	out.WriteString(testStub + payload + toc)
+	binary.Write(&out, binary.LittleEndian, trailer)
+
+	file := filepath.Join(t.TempDir(), "container")
+	if err := os.WriteFile(file, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestContainerRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	out.WriteString(testStub)
+
+	attachments := map[string]io.Reader{
+		"b": bytes.NewReader([]byte("world")),
+		"a": bytes.NewReader([]byte("hello")),
+	}
+	if err := writeContainer(&out, int64(len(testStub)), attachments, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "container")
+	if err := os.WriteFile(file, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := OpenContainer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Verify(); err != nil {
+		t.Error(err)
+	}
+	if got := c.List(); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("attachments = %q, want [a b]", got)
+	}
+	if data, _ := io.ReadAll(c.Reader("b")); string(data) != "world" {
+		t.Errorf("b = %q, want world", data)
+	}
+	if c.PayloadOffset() != int64(len(testStub)) {
+		t.Errorf("payload offset = %d, want %d", c.PayloadOffset(), len(testStub))
+	}
+}
+
+func TestOpenContainerCorrupted(t *testing.T) {
+	const payload = "helloworld"
+	const toc = `{"generator":"dev","attachments":[` +
+		`{"name":"a","offset":0,"size":5,"sha256":""},` +
+		`{"name":"b","offset":5,"size":5,"sha256":""}]}`
+
+	tests := []struct {
+		name    string
+		toc     string
+		mutate  func(*containerTrailer)
+		noMagic bool
+	}{
+		{
+			name: "table of contents past the trailer",
+			toc:  toc,
+			mutate: func(tr *containerTrailer) {
+				tr.TocOffset++
+			},
+		},
+		{
+			name: "table of contents cut short",
+			toc:  toc,
+			mutate: func(tr *containerTrailer) {
+				tr.TocOffset += 16
+				tr.TocSize -= 16
+			},
+		},
+		{
+			name: "table of contents wrapping around",
+			toc:  toc,
+			mutate: func(tr *containerTrailer) {
+				tr.TocOffset += tr.TocSize + 1
+				tr.TocSize = math.MaxUint64
+			},
+		},
+		{
+			name: "huge table of contents",
+			toc:  toc,
+			mutate: func(tr *containerTrailer) {
+				tr.TocSize = containerMaxTocSize + 1
+				tr.TocOffset = 0
+				tr.PayloadOffset = 0
+			},
+		},
+		{
+			name: "payload after the table of contents",
+			toc:  toc,
+			mutate: func(tr *containerTrailer) {
+				tr.PayloadOffset = tr.TocOffset + 1
+			},
+		},
+		{
+			name: "missing signature block",
+			toc:  toc,
+			mutate: func(tr *containerTrailer) {
+				tr.Flags |= containerFlagSigned
+			},
+		},
+		{
+			name: "unsupported version",
+			toc:  toc,
+			mutate: func(tr *containerTrailer) {
+				tr.Version = ContainerVersion + 1
+			},
+		},
+		{
+			name: "malformed table of contents",
+			toc:  `{"attachments":[`,
+		},
+		{
+			name: "overlapping attachments",
+			toc: `{"attachments":[` +
+				`{"name":"a","offset":0,"size":6},` +
+				`{"name":"b","offset":5,"size":5}]}`,
+		},
+		{
+			name: "attachments wrapping around",
+			toc: `{"attachments":[` +
+				`{"name":"a","offset":0,"size":9223372036854775807},` +
+				`{"name":"b","offset":9223372036854775807,"size":9223372036854775807},` +
+				`{"name":"c","offset":-2,"size":12}]}`,
+		},
+		{
+			name:    "bad magic",
+			toc:     toc,
+			noMagic: true,
+			mutate: func(tr *containerTrailer) {
+				tr.Magic[0] ^= 0xff
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := OpenContainer(writeTestContainer(t, payload, tt.toc, tt.mutate))
+			if err == nil {
+				c.Close()
+				t.Fatal("corrupted container accepted")
+			}
+			if (err == ErrNoContainer) != tt.noMagic {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	// and the untouched one is fine.
+	c, err := OpenContainer(writeTestContainer(t, payload, toc, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestVerifyCorrupted(t *testing.T) {
+	var out bytes.Buffer
+	out.WriteString(testStub)
+
+	attachments := map[string]io.Reader{
+		"a": bytes.NewReader([]byte("hello")),
+		"b": bytes.NewReader([]byte("world")),
+	}
+	if err := writeContainer(&out, int64(len(testStub)), attachments, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := out.Bytes()
+
+	// the payload hash sits 40 bytes before the end, ahead of the magic.
+	tests := []struct {
+		name   string
+		offset int
+	}{
+		{"first attachment", bytes.Index(data, []byte("hello"))},
+		{"end of the payload", bytes.Index(data, []byte("world")) + 4},
+		{"table of contents", bytes.Index(data, []byte(`"generator":"`)) + len(`"generator":"`)},
+		{"payload hash", len(data) - 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := bytes.Clone(data)
+			damaged[tt.offset] ^= 0x01
+
+			file := filepath.Join(t.TempDir(), "container")
+			if err := os.WriteFile(file, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := OpenContainer(file)
+			if err != nil {
+				t.Fatalf("the damage is only found by Verify: %s", err)
+			}
+			defer c.Close()
+
+			if err := c.Verify(); err == nil {
+				t.Error("corrupted container verified")
+			}
+		})
+	}
+}
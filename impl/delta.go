@@ -0,0 +1,220 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A delta rebuilds a new version of a file from the old one in the
+// style of bsdiff. It is a header followed by records, each one made of
+// a control block and its data:
+//
+//	magic (8) | new size (8)
+//	diff length (8) | extra length (8) | seek (8) | diff | extra
+//
+// A record adds its diff bytes to as many bytes of the old file
+// (starting where the last record left off), appends its extra bytes as
+// they are, and then moves the position in the old file by seek. The
+// diff bytes are mostly zeros where the versions are alike, so deltas
+// compress well.
+const (
+	deltaMagic     = "EXDELTA\x01"
+	deltaBlockSize = 32
+	deltaHashPrime = 16777619
+)
+
+type deltaMatch struct {
+	newPos int
+	oldPos int
+	length int
+}
+
+func hashDeltaBlock(block []byte) uint32 {
+	h := uint32(0)
+	for _, c := range block {
+		h = h*deltaHashPrime + uint32(c)
+	}
+
+	return h
+}
+
+// findDeltaMatches returns the runs of new found in old, in the order
+// of new. The blocks of old are indexed by their hash and looked up
+// with a rolling hash of new, so runs of at least twice the block size
+// are always found.
+func findDeltaMatches(old []byte, new []byte) []deltaMatch {
+	matches := make([]deltaMatch, 0)
+	if len(old) < deltaBlockSize || len(new) < deltaBlockSize {
+		return matches
+	}
+
+	index := make(map[uint32]int, len(old)/deltaBlockSize)
+	for i := 0; i+deltaBlockSize <= len(old); i += deltaBlockSize {
+		h := hashDeltaBlock(old[i : i+deltaBlockSize])
+		if _, ok := index[h]; !ok {
+			index[h] = i
+		}
+	}
+
+	pow := uint32(1)
+	for i := 1; i < deltaBlockSize; i++ {
+		pow *= deltaHashPrime
+	}
+
+	h := hashDeltaBlock(new[:deltaBlockSize])
+	end := 0
+	for s := 0; s+deltaBlockSize <= len(new); s++ {
+		if s > 0 {
+			h = (h-uint32(new[s-1])*pow)*deltaHashPrime + uint32(new[s+deltaBlockSize-1])
+		}
+		if s < end {
+			continue
+		}
+
+		pos, ok := index[h]
+		if !ok || !bytes.Equal(old[pos:pos+deltaBlockSize], new[s:s+deltaBlockSize]) {
+			continue
+		}
+
+		start, oldStart := s, pos
+		for start > end && oldStart > 0 && new[start-1] == old[oldStart-1] {
+			start--
+			oldStart--
+		}
+
+		n := s - start + deltaBlockSize
+		for start+n < len(new) && oldStart+n < len(old) && new[start+n] == old[oldStart+n] {
+			n++
+		}
+
+		matches = append(matches, deltaMatch{newPos: start, oldPos: oldStart, length: n})
+		end = start + n
+	}
+
+	return matches
+}
+
+// extendDelta returns how far a run can be extended over new and old
+// while at least half of the bytes match, as bsdiff does. Backwards
+// extensions start from the end of both.
+func extendDelta(new []byte, old []byte, backwards bool) int {
+	score, best, length := 0, 0, 0
+
+	for i := 1; i <= len(new) && i <= len(old); i++ {
+		if backwards && new[len(new)-i] == old[len(old)-i] || !backwards && new[i-1] == old[i-1] {
+			score++
+		}
+
+		if score*2-i > best*2-length {
+			best, length = score, i
+		}
+	}
+
+	return length
+}
+
+// makeDelta writes the delta from old to new to w.
+func makeDelta(w io.Writer, old []byte, new []byte) error {
+	out := bufio.NewWriter(w)
+	out.WriteString(deltaMagic)
+	binary.Write(out, binary.LittleEndian, uint64(len(new)))
+
+	matches := findDeltaMatches(old, new)
+	diffNew, diffOld, diffLen := 0, 0, 0
+
+	for i := 0; i <= len(matches); i++ {
+		gapStart, gapOld := diffNew+diffLen, diffOld+diffLen
+
+		// the end of new is like a match of nothing.
+		next := deltaMatch{newPos: len(new), oldPos: gapOld}
+		if i < len(matches) {
+			next = matches[i]
+		}
+
+		lenf := extendDelta(new[gapStart:next.newPos], old[gapOld:], false)
+		lenb := 0
+		if i < len(matches) {
+			lenb = extendDelta(new[gapStart+lenf:next.newPos], old[:next.oldPos], true)
+		}
+		diffLen += lenf
+
+		control := []int64{
+			int64(diffLen),
+			int64(next.newPos - lenb - gapStart - lenf),
+			int64(next.oldPos-lenb) - int64(diffOld+diffLen),
+		}
+		if err := binary.Write(out, binary.LittleEndian, control); err != nil {
+			return err
+		}
+
+		for k := 0; k < diffLen; k++ {
+			out.WriteByte(new[diffNew+k] - old[diffOld+k])
+		}
+		out.Write(new[gapStart+lenf : next.newPos-lenb])
+
+		diffNew, diffOld, diffLen = next.newPos-lenb, next.oldPos-lenb, lenb+next.length
+	}
+
+	return out.Flush()
+}
+
+// applyDelta writes the new version of the file rebuilt from the old
+// one and the delta to w.
+func applyDelta(w io.Writer, old io.ReaderAt, delta io.Reader) error {
+	in := bufio.NewReader(delta)
+
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != deltaMagic {
+		return errors.New("not a delta")
+	}
+
+	var size uint64
+	if err := binary.Read(in, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	buffer := make([]byte, 32*1024)
+	oldBuffer := make([]byte, len(buffer))
+	oldPos := int64(0)
+
+	for written := uint64(0); written < size; {
+		control := make([]int64, 3)
+		if err := binary.Read(in, binary.LittleEndian, control); err != nil {
+			return err
+		}
+
+		diffLen, extraLen, seek := control[0], control[1], control[2]
+		if diffLen < 0 || extraLen < 0 || uint64(diffLen+extraLen) > size-written || oldPos < 0 {
+			return errors.New("malformed delta")
+		}
+
+		for done := int64(0); done < diffLen; {
+			n := min(int64(len(buffer)), diffLen-done)
+			if _, err := io.ReadFull(in, buffer[:n]); err != nil {
+				return err
+			}
+			if _, err := old.ReadAt(oldBuffer[:n], oldPos+done); err != nil {
+				return err
+			}
+
+			for k := int64(0); k < n; k++ {
+				buffer[k] += oldBuffer[k]
+			}
+			out.Write(buffer[:n])
+			done += n
+		}
+
+		if _, err := io.CopyN(out, in, extraLen); err != nil {
+			return err
+		}
+
+		written += uint64(diffLen + extraLen)
+		oldPos += diffLen + seek
+	}
+
+	return out.Flush()
+}
@@ -0,0 +1,237 @@
+package impl
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The libraries provided by the C library itself. They are tied to the
+// system they run on and must never be bundled.
+var defaultLibraryDenyList = []string{
+	"ld-linux*.so*",
+	"ld64.so*",
+	"linux-vdso.so*",
+	"linux-gate.so*",
+	"libc.so*",
+	"libm.so*",
+	"libmvec.so*",
+	"libdl.so*",
+	"libpthread.so*",
+	"librt.so*",
+	"libresolv.so*",
+	"libutil.so*",
+	"libnsl.so*",
+	"libanl.so*",
+	"libcrypt.so*",
+	"libthread_db.so*",
+	"libBrokenLocale.so*",
+	"libnss_*.so*",
+}
+
+var multiarchTriplets = map[string]string{
+	"386":   "i386-linux-gnu",
+	"amd64": "x86_64-linux-gnu",
+	"arm":   "arm-linux-gnueabihf",
+	"arm64": "aarch64-linux-gnu",
+}
+
+type elfDependencies struct {
+	Needed   []string
+	RunPaths []string
+	Machine  elf.Machine
+	Class    elf.Class
+
+	// The runpaths relative to the file itself ($ORIGIN), as
+	// directories of the payload.
+	PayloadPaths []string
+}
+
+func readElfDependencies(entry payloadEntry) (*elfDependencies, error) {
+	file, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, ok := file.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	needed, err := f.ImportedLibraries()
+	if err != nil {
+		return nil, err
+	}
+
+	deps := &elfDependencies{
+		Needed:  needed,
+		Machine: f.Machine,
+		Class:   f.Class,
+	}
+
+	// DT_RPATH is ignored by the loader when DT_RUNPATH is present.
+	runpaths, _ := f.DynString(elf.DT_RUNPATH)
+	if len(runpaths) == 0 {
+		runpaths, _ = f.DynString(elf.DT_RPATH)
+	}
+
+	// $ORIGIN is where the file ends up in the payload. The sources of
+	// archive members and generated files are no directories.
+	origin := path.Dir(filepath.ToSlash(entry.Dest))
+	for _, x := range runpaths {
+		for _, dir := range strings.Split(x, ":") {
+			if !strings.Contains(dir, "$ORIGIN") && !strings.Contains(dir, "${ORIGIN}") {
+				if dir != "" {
+					deps.RunPaths = append(deps.RunPaths, dir)
+				}
+				continue
+			}
+
+			deps.PayloadPaths = append(deps.PayloadPaths, path.Clean(expandElfOrigin(dir, origin)))
+
+			// libraries bundled from the host still find their
+			// siblings there.
+			if FileExists(entry.Source) {
+				deps.RunPaths = append(deps.RunPaths, expandElfOrigin(dir, filepath.Dir(entry.Source)))
+			}
+		}
+	}
+
+	return deps, nil
+}
+
+func expandElfOrigin(dir string, origin string) string {
+	dir = strings.ReplaceAll(dir, "${ORIGIN}", origin)
+	return strings.ReplaceAll(dir, "$ORIGIN", origin)
+}
+
+func getLibrarySearchPaths(config Config) []string {
+	dirs := make([]string, 0)
+	dirs = append(dirs, config.Libraries.SearchPaths...)
+
+	if env := os.Getenv("LD_LIBRARY_PATH"); env != "" {
+		dirs = append(dirs, filepath.SplitList(env)...)
+	}
+
+	if triplet, ok := multiarchTriplets[config.TargetArch]; ok {
+		dirs = append(dirs,
+			path.Join("/lib", triplet),
+			path.Join("/usr/lib", triplet),
+			path.Join("/usr/local/lib", triplet),
+		)
+	}
+
+	return append(dirs, "/lib64", "/usr/lib64", "/lib", "/usr/lib", "/usr/local/lib")
+}
+
+func findSharedLibrary(name string, dirs []string, deps *elfDependencies) string {
+	for _, dir := range dirs {
+		file := filepath.Join(dir, name)
+		if !FileExists(file) {
+			continue
+		}
+
+		// skip libraries built for another architecture (E.g. 32-bit
+		// libraries that live alongside the 64-bit ones).
+		if f, err := elf.Open(file); err == nil {
+			compatible := f.Machine == deps.Machine && f.Class == deps.Class
+			f.Close()
+
+			if compatible {
+				return file
+			}
+		}
+	}
+
+	return ""
+}
+
+func isBundledLibrary(config Config, name string) bool {
+	if len(config.Libraries.Allow) > 0 && !hasGlobMatchInList(config.Libraries.Allow, name) {
+		return false
+	}
+
+	return !hasGlobMatchInList(config.Libraries.Deny, name)
+}
+
+// isShippedLibrary reports whether the library is in the payload next
+// to the file needing it, as found through its $ORIGIN runpaths.
+func isShippedLibrary(bundled map[string]bool, deps *elfDependencies, name string) bool {
+	for _, dir := range deps.PayloadPaths {
+		if bundled[path.Join(dir, name)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bundleSharedLibraries adds the shared libraries needed by the ELF
+// executables in the payload (and the libraries they need in turn) to
+// the entries under the configured libraries directory.
+func bundleSharedLibraries(config Config, entries []payloadEntry) []payloadEntry {
+	// libraries already shipped with the application are left alone.
+	bundled := make(map[string]bool, 0)
+	for _, entry := range entries {
+		bundled[path.Clean(filepath.ToSlash(entry.Dest))] = true
+	}
+
+	queue := make([]payloadEntry, 0)
+	for _, entry := range entries {
+		if stringListContains(config.Executables, filepath.ToSlash(entry.Dest)) {
+			queue = append(queue, entry)
+		}
+	}
+
+	searchPaths := getLibrarySearchPaths(config)
+
+	for len(queue) > 0 {
+		file := queue[0]
+		queue = queue[1:]
+
+		deps, err := readElfDependencies(file)
+		if err != nil {
+			// not an ELF file (E.g. a script).
+			continue
+		}
+
+		for _, name := range deps.Needed {
+			dest := path.Join(config.Libraries.Directory, name)
+			if bundled[dest] || !isBundledLibrary(config, name) || isShippedLibrary(bundled, deps, name) {
+				continue
+			}
+			bundled[dest] = true
+
+			lib := findSharedLibrary(name, append(deps.RunPaths, searchPaths...), deps)
+			if lib == "" {
+				fmt.Printf("Library not found: %s (needed by %s)\n", name, file.Source)
+				continue
+			}
+
+			if resolved, err := filepath.EvalSymlinks(lib); err == nil {
+				lib = resolved
+			}
+
+			entry := newFilePayloadEntry(lib, dest)
+			entries = append(entries, entry)
+			queue = append(queue, entry)
+		}
+	}
+
+	return entries
+}
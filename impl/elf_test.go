@@ -0,0 +1,114 @@
+package impl
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestBundleSharedLibraries(t *testing.T) {
+	// every fixture needs libc.so.6, which the search path provides.
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "libc.so.6")
+	if err := os.WriteFile(lib, readFixture(t, "elf/norunpath.elf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	origin, err := setElfRunPath(readFixture(t, "elf/norunpath.elf"), "$ORIGIN/../vendor")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := func(source string, data []byte) payloadEntry {
+		entry := newBytesPayloadEntry("bin/app", data)
+		entry.Source = source
+		return entry
+	}
+
+	tests := []struct {
+		name    string
+		entries []payloadEntry
+		want    []string
+	}{
+		{
+			name:    "bundled once",
+			entries: []payloadEntry{app("bin/app", readFixture(t, "elf/runpath.elf"))},
+			want:    []string{"lib/libc.so.6"},
+		},
+		{
+			// only a library in the libraries directory is the same one.
+			name: "same name elsewhere",
+			entries: []payloadEntry{
+				app("bin/app", readFixture(t, "elf/runpath.elf")),
+				newBytesPayloadEntry("docs/libc.so.6", []byte("not a library")),
+			},
+			want: []string{"lib/libc.so.6"},
+		},
+		{
+			name: "already in the libraries directory",
+			entries: []payloadEntry{
+				app("bin/app", readFixture(t, "elf/runpath.elf")),
+				newBytesPayloadEntry("lib/libc.so.6", readFixture(t, "elf/norunpath.elf")),
+			},
+		},
+		{
+			// $ORIGIN is the directory of the member in the payload,
+			// not a directory of the archive path.
+			name: "shipped next to an archive member",
+			entries: []payloadEntry{
+				app("app.zip!bin/app", origin),
+				newBytesPayloadEntry("vendor/libc.so.6", readFixture(t, "elf/norunpath.elf")),
+			},
+		},
+		{
+			name:    "not shipped next to an archive member",
+			entries: []payloadEntry{app("app.zip!bin/app", origin)},
+			want:    []string{"lib/libc.so.6"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Executables: []string{"bin/app"},
+				Libraries:   LibrariesConfig{Directory: "lib", SearchPaths: []string{dir}},
+			}
+
+			entries := bundleSharedLibraries(config, slices.Clone(tt.entries))
+
+			added := make([]string, 0)
+			for _, entry := range entries[len(tt.entries):] {
+				added = append(added, entry.Dest)
+				if entry.Source != lib {
+					t.Errorf("%s bundled from %s, want %s", entry.Dest, entry.Source, lib)
+				}
+			}
+			if !slices.Equal(added, tt.want) {
+				t.Errorf("bundled %q, want %q", added, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadElfDependenciesOrigin(t *testing.T) {
+	data, err := setElfRunPath(readFixture(t, "elf/norunpath.elf"), "$ORIGIN:${ORIGIN}/../lib:/opt/lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := newBytesPayloadEntry("app/bin/tool", data)
+	entry.Source = "tools.tar.gz!bin/tool"
+
+	deps, err := readElfDependencies(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"app/bin", "app/lib"}; !slices.Equal(deps.PayloadPaths, want) {
+		t.Errorf("payload paths = %q, want %q", deps.PayloadPaths, want)
+	}
+	if want := []string{"/opt/lib"}; !slices.Equal(deps.RunPaths, want) {
+		t.Errorf("runpaths = %q, want %q", deps.RunPaths, want)
+	}
+}
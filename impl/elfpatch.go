@@ -0,0 +1,583 @@
+package impl
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+)
+
+var errElfNotDynamic = errors.New("not a dynamically linked ELF file")
+
+// elfImage gives raw access to the headers of an ELF file held in
+// memory so they can be rewritten in place.
+type elfImage struct {
+	data  []byte
+	order binary.ByteOrder
+	is64  bool
+}
+
+type elfProg struct {
+	Type   elf.ProgType
+	Flags  elf.ProgFlag
+	Off    uint64
+	Vaddr  uint64
+	Paddr  uint64
+	Filesz uint64
+	Memsz  uint64
+	Align  uint64
+}
+
+type elfSection struct {
+	Name      uint32
+	Type      elf.SectionType
+	Flags     uint64
+	Addr      uint64
+	Off       uint64
+	Size      uint64
+	Link      uint32
+	Info      uint32
+	Addralign uint64
+	Entsize   uint64
+}
+
+type elfDyn struct {
+	Tag elf.DynTag
+	Val uint64
+}
+
+func newElfImage(data []byte) (*elfImage, error) {
+	if len(data) < 52 || !bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		return nil, errors.New("not an ELF file")
+	}
+
+	e := &elfImage{data: data}
+
+	switch elf.Class(data[elf.EI_CLASS]) {
+	case elf.ELFCLASS32:
+		e.is64 = false
+	case elf.ELFCLASS64:
+		e.is64 = true
+		if len(data) < 64 {
+			return nil, errors.New("truncated ELF header")
+		}
+	default:
+		return nil, errors.New("unknown ELF class")
+	}
+
+	switch elf.Data(data[elf.EI_DATA]) {
+	case elf.ELFDATA2LSB:
+		e.order = binary.LittleEndian
+	case elf.ELFDATA2MSB:
+		e.order = binary.BigEndian
+	default:
+		return nil, errors.New("unknown ELF data encoding")
+	}
+
+	if e.phoff()+uint64(e.phnum())*uint64(e.phentsize()) > uint64(len(data)) {
+		return nil, errors.New("truncated ELF program headers")
+	}
+	if e.shoff()+uint64(e.shnum())*uint64(e.shentsize()) > uint64(len(data)) {
+		return nil, errors.New("truncated ELF section headers")
+	}
+
+	return e, nil
+}
+
+func (e *elfImage) get(off uint64, size int) uint64 {
+	switch size {
+	case 2:
+		return uint64(e.order.Uint16(e.data[off:]))
+	case 4:
+		return uint64(e.order.Uint32(e.data[off:]))
+	default:
+		return e.order.Uint64(e.data[off:])
+	}
+}
+
+func (e *elfImage) put(off uint64, size int, v uint64) {
+	switch size {
+	case 2:
+		e.order.PutUint16(e.data[off:], uint16(v))
+	case 4:
+		e.order.PutUint32(e.data[off:], uint32(v))
+	default:
+		e.order.PutUint64(e.data[off:], v)
+	}
+}
+
+// the size of an address (and of most other fields) for the class.
+func (e *elfImage) wordSize() int {
+	if e.is64 {
+		return 8
+	}
+
+	return 4
+}
+
+func (e *elfImage) headerField(off32 uint64, off64 uint64, size int) uint64 {
+	if e.is64 {
+		return e.get(off64, size)
+	}
+
+	return e.get(off32, size)
+}
+
+func (e *elfImage) setHeaderField(off32 uint64, off64 uint64, size int, v uint64) {
+	if e.is64 {
+		e.put(off64, size, v)
+	} else {
+		e.put(off32, size, v)
+	}
+}
+
+func (e *elfImage) phoff() uint64 {
+	return e.headerField(0x1c, 0x20, e.wordSize())
+}
+
+func (e *elfImage) shoff() uint64 {
+	return e.headerField(0x20, 0x28, e.wordSize())
+}
+
+func (e *elfImage) phentsize() int {
+	return int(e.headerField(0x2a, 0x36, 2))
+}
+
+func (e *elfImage) phnum() int {
+	return int(e.headerField(0x2c, 0x38, 2))
+}
+
+func (e *elfImage) shentsize() int {
+	return int(e.headerField(0x2e, 0x3a, 2))
+}
+
+func (e *elfImage) shnum() int {
+	return int(e.headerField(0x30, 0x3c, 2))
+}
+
+func (e *elfImage) shstrndx() int {
+	return int(e.headerField(0x32, 0x3e, 2))
+}
+
+func (e *elfImage) prog(i int) elfProg {
+	off := e.phoff() + uint64(i*e.phentsize())
+
+	if e.is64 {
+		return elfProg{
+			Type:   elf.ProgType(e.get(off, 4)),
+			Flags:  elf.ProgFlag(e.get(off+4, 4)),
+			Off:    e.get(off+8, 8),
+			Vaddr:  e.get(off+16, 8),
+			Paddr:  e.get(off+24, 8),
+			Filesz: e.get(off+32, 8),
+			Memsz:  e.get(off+40, 8),
+			Align:  e.get(off+48, 8),
+		}
+	}
+
+	return elfProg{
+		Type:   elf.ProgType(e.get(off, 4)),
+		Off:    e.get(off+4, 4),
+		Vaddr:  e.get(off+8, 4),
+		Paddr:  e.get(off+12, 4),
+		Filesz: e.get(off+16, 4),
+		Memsz:  e.get(off+20, 4),
+		Flags:  elf.ProgFlag(e.get(off+24, 4)),
+		Align:  e.get(off+28, 4),
+	}
+}
+
+func (e *elfImage) setProg(i int, p elfProg) {
+	off := e.phoff() + uint64(i*e.phentsize())
+
+	if e.is64 {
+		e.put(off, 4, uint64(p.Type))
+		e.put(off+4, 4, uint64(p.Flags))
+		e.put(off+8, 8, p.Off)
+		e.put(off+16, 8, p.Vaddr)
+		e.put(off+24, 8, p.Paddr)
+		e.put(off+32, 8, p.Filesz)
+		e.put(off+40, 8, p.Memsz)
+		e.put(off+48, 8, p.Align)
+	} else {
+		e.put(off, 4, uint64(p.Type))
+		e.put(off+4, 4, p.Off)
+		e.put(off+8, 4, p.Vaddr)
+		e.put(off+12, 4, p.Paddr)
+		e.put(off+16, 4, p.Filesz)
+		e.put(off+20, 4, p.Memsz)
+		e.put(off+24, 4, uint64(p.Flags))
+		e.put(off+28, 4, p.Align)
+	}
+}
+
+func (e *elfImage) section(i int) elfSection {
+	off := e.shoff() + uint64(i*e.shentsize())
+	w := e.wordSize()
+	u := uint64(w)
+
+	return elfSection{
+		Name:      uint32(e.get(off, 4)),
+		Type:      elf.SectionType(e.get(off+4, 4)),
+		Flags:     e.get(off+8, w),
+		Addr:      e.get(off+8+u, w),
+		Off:       e.get(off+8+2*u, w),
+		Size:      e.get(off+8+3*u, w),
+		Link:      uint32(e.get(off+8+4*u, 4)),
+		Info:      uint32(e.get(off+12+4*u, 4)),
+		Addralign: e.get(off+16+4*u, w),
+		Entsize:   e.get(off+16+5*u, w),
+	}
+}
+
+func (e *elfImage) setSection(i int, s elfSection) {
+	off := e.shoff() + uint64(i*e.shentsize())
+	w := e.wordSize()
+	u := uint64(w)
+
+	e.put(off, 4, uint64(s.Name))
+	e.put(off+4, 4, uint64(s.Type))
+	e.put(off+8, w, s.Flags)
+	e.put(off+8+u, w, s.Addr)
+	e.put(off+8+2*u, w, s.Off)
+	e.put(off+8+3*u, w, s.Size)
+	e.put(off+8+4*u, 4, uint64(s.Link))
+	e.put(off+12+4*u, 4, uint64(s.Info))
+	e.put(off+16+4*u, w, s.Addralign)
+	e.put(off+16+5*u, w, s.Entsize)
+}
+
+func (e *elfImage) dynamic(off uint64, size uint64) []elfDyn {
+	entries := make([]elfDyn, 0)
+	w := e.wordSize()
+
+	for x := off; x+uint64(2*w) <= off+size && x+uint64(2*w) <= uint64(len(e.data)); x += uint64(2 * w) {
+		entry := elfDyn{Tag: elf.DynTag(e.get(x, w)), Val: e.get(x+uint64(w), w)}
+		entries = append(entries, entry)
+
+		if entry.Tag == elf.DT_NULL {
+			break
+		}
+	}
+
+	return entries
+}
+
+func (e *elfImage) encodeDynamic(entries []elfDyn) []byte {
+	w := e.wordSize()
+	buf := make([]byte, len(entries)*2*w)
+
+	for i, entry := range entries {
+		if w == 8 {
+			e.order.PutUint64(buf[i*16:], uint64(entry.Tag))
+			e.order.PutUint64(buf[i*16+8:], entry.Val)
+		} else {
+			e.order.PutUint32(buf[i*8:], uint32(entry.Tag))
+			e.order.PutUint32(buf[i*8+4:], uint32(entry.Val))
+		}
+	}
+
+	return buf
+}
+
+// addrToOffset maps a virtual address to its offset in the file.
+func (e *elfImage) addrToOffset(addr uint64) (uint64, bool) {
+	for i := 0; i < e.phnum(); i++ {
+		p := e.prog(i)
+		if p.Type == elf.PT_LOAD && addr >= p.Vaddr && addr < p.Vaddr+p.Filesz {
+			return p.Off + addr - p.Vaddr, true
+		}
+	}
+
+	return 0, false
+}
+
+func (e *elfImage) findProg(t elf.ProgType) int {
+	for i := 0; i < e.phnum(); i++ {
+		if e.prog(i).Type == t {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// findSpareProg looks for a program header that can be turned into a
+// new segment without affecting how the file gets loaded. That's either
+// an unused entry or a note segment the loader doesn't care about.
+func (e *elfImage) findSpareProg() int {
+	if i := e.findProg(elf.PT_NULL); i >= 0 {
+		return i
+	}
+
+	hasProperties := e.findProg(elf.PT_GNU_PROPERTY) >= 0
+
+	for i := 0; i < e.phnum(); i++ {
+		p := e.prog(i)
+		if p.Type == elf.PT_NOTE && (hasProperties || !e.hasGnuPropertyNote(p)) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (e *elfImage) hasGnuPropertyNote(p elfProg) bool {
+	align := p.Align
+	if align < 4 {
+		align = 4
+	}
+
+	for x := p.Off; x+12 <= p.Off+p.Filesz && x+12 <= uint64(len(e.data)); {
+		namesz := e.get(x, 4)
+		descsz := e.get(x+4, 4)
+		noteType := e.get(x+8, 4)
+
+		name := x + 12
+		if noteType == 5 && namesz == 4 && name+4 <= uint64(len(e.data)) &&
+			string(e.data[name:name+4]) == "GNU\x00" {
+			return true
+		}
+
+		desc := alignUp(name+namesz, align)
+		x = alignUp(desc+descsz, align)
+	}
+
+	return false
+}
+
+// addLoadSegment appends content to the file as a new PT_LOAD segment
+// (replacing the program header at index i) placed after every other
+// segment in memory. It returns the file offset and the virtual address
+// of the content.
+func (e *elfImage) addLoadSegment(i int, content []byte, flags elf.ProgFlag) (uint64, uint64) {
+	align := uint64(0x1000)
+	end := uint64(0)
+	last := -1
+
+	for x := 0; x < e.phnum(); x++ {
+		p := e.prog(x)
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+
+		if p.Align > align {
+			align = p.Align
+		}
+		if p.Vaddr+p.Memsz > end {
+			end = p.Vaddr + p.Memsz
+		}
+		last = x
+	}
+
+	// only the offset and the address need to be congruent modulo the
+	// alignment, so the file doesn't have to be padded to it.
+	off := alignUp(uint64(len(e.data)), 16)
+	vaddr := alignUp(end, align) + off%align
+
+	e.data = append(e.data, make([]byte, off-uint64(len(e.data)))...)
+	e.data = append(e.data, content...)
+
+	e.setProg(i, elfProg{
+		Type:   elf.PT_LOAD,
+		Flags:  flags,
+		Off:    off,
+		Vaddr:  vaddr,
+		Paddr:  vaddr,
+		Filesz: uint64(len(content)),
+		Memsz:  uint64(len(content)),
+		Align:  align,
+	})
+
+	// the loader expects load segments sorted by address, so the new
+	// entry is moved right behind the last one.
+	for i < last {
+		a, b := e.prog(i), e.prog(i+1)
+		e.setProg(i, b)
+		e.setProg(i+1, a)
+		i++
+	}
+	for i > last+1 {
+		a, b := e.prog(i), e.prog(i-1)
+		e.setProg(i, b)
+		e.setProg(i-1, a)
+		i--
+	}
+
+	return off, vaddr
+}
+
+// moveSection points the section header whose content starts at off
+// at its new location.
+func (e *elfImage) moveSection(t elf.SectionType, off uint64, newOff uint64, newAddr uint64, newSize uint64) {
+	for i := 0; i < e.shnum(); i++ {
+		s := e.section(i)
+		if s.Type == t && s.Off == off {
+			s.Off = newOff
+			s.Addr = newAddr
+			s.Size = newSize
+			e.setSection(i, s)
+		}
+	}
+}
+
+// setElfRunPath sets the DT_RUNPATH of the ELF file to runpath (replacing
+// any DT_RPATH) much like `patchelf --set-rpath` does.
+func setElfRunPath(data []byte, runpath string) ([]byte, error) {
+	e, err := newElfImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dynIndex := e.findProg(elf.PT_DYNAMIC)
+	if dynIndex < 0 {
+		return nil, errElfNotDynamic
+	}
+	dynProg := e.prog(dynIndex)
+	entries := e.dynamic(dynProg.Off, dynProg.Filesz)
+
+	// the terminator is where new entries go.
+	if len(entries) == 0 || entries[len(entries)-1].Tag != elf.DT_NULL {
+		return nil, errors.New("malformed dynamic section: no DT_NULL terminator")
+	}
+
+	var strtabAddr, strsz uint64
+	runpathIndex := -1
+	nulls := 0
+
+	for i, entry := range entries {
+		switch entry.Tag {
+		case elf.DT_STRTAB:
+			strtabAddr = entry.Val
+		case elf.DT_STRSZ:
+			strsz = entry.Val
+		case elf.DT_RPATH, elf.DT_RUNPATH:
+			runpathIndex = i
+		}
+	}
+
+	// linkers may leave room for extra entries as trailing DT_NULLs.
+	for x := dynProg.Off + uint64(len(entries)*2*e.wordSize()); x+uint64(2*e.wordSize()) <= dynProg.Off+dynProg.Filesz; x += uint64(2 * e.wordSize()) {
+		if e.get(x, e.wordSize()) == uint64(elf.DT_NULL) {
+			nulls++
+		}
+	}
+
+	strtabOff, ok := e.addrToOffset(strtabAddr)
+	if !ok || strtabOff+strsz > uint64(len(data)) {
+		return nil, errors.New("dynamic string table not found")
+	}
+
+	if runpathIndex >= 0 && entries[runpathIndex].Val >= strsz {
+		return nil, errors.New("malformed dynamic section: RUNPATH outside of the string table")
+	}
+
+	// the new path fits in place of the old one.
+	if runpathIndex >= 0 {
+		old := strtabOff + entries[runpathIndex].Val
+		if end := bytes.IndexByte(e.data[old:strtabOff+strsz], 0); end >= len(runpath) {
+			copy(e.data[old:], runpath)
+			clear(e.data[old+uint64(len(runpath)) : old+uint64(end)])
+
+			entries[runpathIndex].Tag = elf.DT_RUNPATH
+			copy(e.data[dynProg.Off:], e.encodeDynamic(entries))
+			return e.data, nil
+		}
+	}
+
+	// otherwise, a copy of the string table with the path appended gets
+	// loaded from a new segment at the end of the file.
+	spare := e.findSpareProg()
+	if spare < 0 {
+		return nil, errors.New("no program header available for a new segment")
+	}
+
+	content := make([]byte, 0, strsz+uint64(len(runpath))+1)
+	content = append(content, e.data[strtabOff:strtabOff+strsz]...)
+	content = append(content, runpath...)
+	content = append(content, 0)
+	runpathEntry := elfDyn{Tag: elf.DT_RUNPATH, Val: strsz}
+
+	moveDynamic := false
+	if runpathIndex >= 0 {
+		entries[runpathIndex] = runpathEntry
+	} else if nulls > 0 {
+		entries = append(entries[:len(entries)-1], runpathEntry, elfDyn{Tag: elf.DT_NULL})
+	} else {
+		entries = append(entries[:len(entries)-1], runpathEntry, elfDyn{Tag: elf.DT_NULL})
+		moveDynamic = true
+	}
+
+	flags := elf.PF_R
+	dynOffset := uint64(0)
+	if moveDynamic {
+		// the loader relocates the dynamic section in place.
+		flags |= elf.PF_W
+		dynOffset = alignUp(uint64(len(content)), uint64(e.wordSize()))
+		content = append(content, make([]byte, dynOffset-uint64(len(content)))...)
+		content = append(content, e.encodeDynamic(entries)...)
+	}
+
+	off, vaddr := e.addLoadSegment(spare, content, flags)
+
+	for i := range entries {
+		switch entries[i].Tag {
+		case elf.DT_STRTAB:
+			entries[i].Val = vaddr
+		case elf.DT_STRSZ:
+			entries[i].Val = strsz + uint64(len(runpath)) + 1
+		}
+	}
+
+	e.moveSection(elf.SHT_STRTAB, strtabOff, off, vaddr, strsz+uint64(len(runpath))+1)
+
+	if moveDynamic {
+		oldOff := dynProg.Off
+
+		dynProg.Off = off + dynOffset
+		dynProg.Vaddr = vaddr + dynOffset
+		dynProg.Paddr = dynProg.Vaddr
+		dynProg.Filesz = uint64(len(entries) * 2 * e.wordSize())
+		dynProg.Memsz = dynProg.Filesz
+
+		// the program headers may have been reordered by now.
+		e.setProg(e.findProg(elf.PT_DYNAMIC), dynProg)
+		e.moveSection(elf.SHT_DYNAMIC, oldOff, dynProg.Off, dynProg.Vaddr, dynProg.Filesz)
+	}
+
+	copy(e.data[dynProg.Off:], e.encodeDynamic(entries))
+	return e.data, nil
+}
+
+func alignUp(v uint64, align uint64) uint64 {
+	if align == 0 {
+		return v
+	}
+
+	return (v + align - 1) / align * align
+}
+
+func matchRunPathFile(config Config, dest string, head []byte) bool {
+	return hasGlobMatchInList(config.Libraries.RunPath, dest) && bytes.HasPrefix(head, []byte(elf.ELFMAG))
+}
+
+// applyRunPath points the RUNPATH of an ELF file at the libraries
+// directory relative to the file itself.
+func applyRunPath(config Config, build *payloadBuild, dest string, data []byte) ([]byte, error) {
+	runpath := "$ORIGIN"
+	if rel := getRelativeSlashPath(path.Dir(dest), config.Libraries.Directory); rel != "." {
+		runpath = fmt.Sprintf("$ORIGIN/%s", rel)
+	}
+
+	patched, err := setElfRunPath(data, runpath)
+	if err == errElfNotDynamic {
+		return data, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to set RUNPATH of %s: %s", dest, err.Error())
+	}
+
+	fmt.Printf("RUNPATH updated: %s => %s\n", dest, runpath)
+	return patched, nil
+}
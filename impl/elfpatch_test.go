@@ -0,0 +1,189 @@
+package impl
+
+import (
+	"bytes"
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func countProgs(f *elf.File, t elf.ProgType) int {
+	n := 0
+	for _, p := range f.Progs {
+		if p.Type == t {
+			n++
+		}
+	}
+
+	return n
+}
+
+// trimElfDynamic drops the spare DT_NULL entries linkers leave at the end
+// of the dynamic section, so there's no room for a new entry.
+func trimElfDynamic(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	e, err := newElfImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := e.findProg(elf.PT_DYNAMIC)
+	p := e.prog(i)
+	size := uint64(len(e.dynamic(p.Off, p.Filesz)) * 2 * e.wordSize())
+
+	e.moveSection(elf.SHT_DYNAMIC, p.Off, p.Off, p.Vaddr, size)
+	p.Filesz, p.Memsz = size, size
+	e.setProg(i, p)
+
+	return e.data
+}
+
+func TestSetElfRunPath(t *testing.T) {
+	long := "$ORIGIN/" + strings.Repeat("x", 3*1024)
+
+	tests := []struct {
+		name         string
+		fixture      string
+		trim         bool
+		runpath      string
+		newLoad      bool
+		movedDynamic bool
+	}{
+		{"shorter runpath in place", "elf/runpath.elf", false, "$ORIGIN", false, false},
+		{"rpath turned into runpath in place", "elf/rpath.elf", false, "$ORIGIN/lib", false, false},
+		{"longer runpath in a new segment", "elf/runpath.elf", false, long, true, false},
+		{"longer rpath in a new segment", "elf/rpath.elf", false, long, true, false},
+		{"new runpath in a spare dynamic entry", "elf/norunpath.elf", false, "$ORIGIN/../lib", true, false},
+		{"new runpath with a moved dynamic section", "elf/norunpath.elf", true, "$ORIGIN/../lib", true, true},
+		{"long new runpath with a moved dynamic section", "elf/norunpath.elf", true, long, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := readFixture(t, tt.fixture)
+			if tt.trim {
+				data = trimElfDynamic(t, data)
+			}
+
+			before, err := elf.NewFile(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := setElfRunPath(bytes.Clone(data), tt.runpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := elf.NewFile(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("patched file does not parse: %s", err)
+			}
+
+			if got, _ := f.DynString(elf.DT_RUNPATH); !slices.Equal(got, []string{tt.runpath}) {
+				t.Errorf("RUNPATH = %q, want %q", got, tt.runpath)
+			}
+			if got, _ := f.DynString(elf.DT_RPATH); len(got) != 0 {
+				t.Errorf("RPATH = %q, want none", got)
+			}
+			if got, _ := f.DynString(elf.DT_NEEDED); !slices.Equal(got, []string{"libc.so.6"}) {
+				t.Errorf("NEEDED = %q, want [libc.so.6]", got)
+			}
+
+			loads := countProgs(f, elf.PT_LOAD)
+			if want := countProgs(before, elf.PT_LOAD); tt.newLoad {
+				want++
+				if loads != want {
+					t.Errorf("%d PT_LOAD segments, want %d", loads, want)
+				}
+			} else if loads != want || len(out) != len(data) {
+				t.Errorf("file changed size or segments, want the path patched in place")
+			}
+
+			// load segments must stay sorted, congruent with their
+			// alignment and apart from each other.
+			var end uint64
+			for _, p := range f.Progs {
+				if p.Type != elf.PT_LOAD {
+					continue
+				}
+				if p.Vaddr < end {
+					t.Errorf("PT_LOAD at %#x overlaps or is out of order", p.Vaddr)
+				}
+				if p.Align > 0 && p.Off%p.Align != p.Vaddr%p.Align {
+					t.Errorf("PT_LOAD at %#x is misaligned", p.Vaddr)
+				}
+				end = p.Vaddr + p.Memsz
+			}
+
+			var dynamic *elf.Prog
+			for _, p := range f.Progs {
+				if p.Type == elf.PT_DYNAMIC {
+					dynamic = p
+				}
+			}
+
+			var oldDynamic uint64
+			for _, p := range before.Progs {
+				if p.Type == elf.PT_DYNAMIC {
+					oldDynamic = p.Off
+				}
+			}
+
+			if moved := dynamic.Off != oldDynamic; moved != tt.movedDynamic {
+				t.Errorf("dynamic section moved = %v, want %v", moved, tt.movedDynamic)
+			}
+			if s := f.Section(".dynamic"); s == nil || s.Offset != dynamic.Off || s.Size != dynamic.Filesz {
+				t.Errorf(".dynamic section header does not match PT_DYNAMIC")
+			}
+
+			strtab, _ := f.DynValue(elf.DT_STRTAB)
+			if s := f.Section(".dynstr"); s == nil || len(strtab) != 1 || s.Addr != strtab[0] {
+				t.Errorf(".dynstr section header does not match DT_STRTAB")
+			}
+		})
+	}
+}
+
+func TestSetElfRunPathMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		filesz func(wordSize int) uint64
+	}{
+		{"empty dynamic section", func(int) uint64 { return 0 }},
+		{"no terminator", func(wordSize int) uint64 { return uint64(2 * wordSize) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := newElfImage(readFixture(t, "elf/runpath.elf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			i := e.findProg(elf.PT_DYNAMIC)
+			p := e.prog(i)
+			p.Filesz = tt.filesz(e.wordSize())
+			e.setProg(i, p)
+
+			if _, err := setElfRunPath(e.data, "$ORIGIN/lib"); err == nil {
+				t.Error("malformed dynamic section accepted")
+			}
+		})
+	}
+}
@@ -1,13 +1,39 @@
 package impl
 
 import (
+	"crypto/ed25519"
 	"fmt"
+	"io"
 	"os"
-
-	"github.com/maja42/ember/embedding"
 )
 
+// Embed writes the stub at base followed by the attachments
+// (name => path) to destination. See container.go for the layout.
 func Embed(base string, destination string, attachments map[string]string) error {
+	return EmbedSigned(base, destination, attachments, nil)
+}
+
+// EmbedSigned is like Embed, but also signs the attachments with key
+// (unless it is nil).
+func EmbedSigned(base string, destination string, attachments map[string]string, key ed25519.PrivateKey) error {
+	readers := make(map[string]io.Reader, 0)
+	for name, file := range attachments {
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("Failed to open attachment %q: %s", name, err)
+		}
+		defer f.Close()
+
+		readers[name] = f
+	}
+
+	return embedReaders(base, destination, readers, key)
+}
+
+// embedReaders writes the stub at base followed by the content of the
+// readers (name => reader) to destination, signed with key unless it is
+// nil.
+func embedReaders(base string, destination string, attachments map[string]io.Reader, key ed25519.PrivateKey) error {
 	// Open executable
 	exe, err := os.Open(base)
 	if err != nil {
@@ -20,21 +46,30 @@ func Embed(base string, destination string, attachments map[string]string) error
 	if err != nil {
 		return fmt.Errorf("Failed to open output file %q: %s", destination, err)
 	}
-	defer func() {
-		_ = out.Close()
-		if err := recover(); err != nil { // execution failed; delete created output file
-			_ = os.Remove(destination)
-		}
-	}()
 
-	logger := func(format string, args ...interface{}) {
-		fmt.Printf("\t"+format+"\n", args...)
+	// a stub that already carries attachments only gives its own part.
+	stubSize, err := getStubSize(exe)
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(exe, 0, stubSize))
+	}
+	if err == nil {
+		err = writeContainer(out, stubSize, attachments, key)
+	}
+
+	if c := out.Close(); err == nil {
+		err = c
+	}
+	if err != nil {
+		// execution failed; delete created output file
+		_ = os.Remove(destination)
+		return err
 	}
 
-	embedding.SkipCompatibilityCheck = true
-	return embedding.EmbedFiles(out, exe, attachments, logger)
+	return nil
 }
 
+// RemoveEmbed writes the stub at base to destination without any of
+// its attachments.
 func RemoveEmbed(base string, destination string) error {
 	// Open executable
 	exe, err := os.Open(base)
@@ -48,17 +83,38 @@ func RemoveEmbed(base string, destination string) error {
 	if err != nil {
 		return fmt.Errorf("Failed to open output file %q: %s", destination, err)
 	}
-	defer func() {
-		_ = out.Close()
-		if err := recover(); err != nil { // execution failed; delete created output file
-			_ = os.Remove(destination)
+
+	stubSize, err := getStubSize(exe)
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(exe, 0, stubSize))
+	}
+
+	if c := out.Close(); err == nil {
+		err = c
+	}
+	if err != nil {
+		// execution failed; delete created output file
+		_ = os.Remove(destination)
+		return err
+	}
+
+	return nil
+}
+
+// getStubSize returns the size of the stub of the executable, which is
+// all of it when there are no attachments.
+func getStubSize(exe *os.File) (int64, error) {
+	c := &Container{file: exe}
+	if err := c.readTrailer(); err == ErrNoContainer {
+		stat, err := exe.Stat()
+		if err != nil {
+			return 0, err
 		}
-	}()
 
-	logger := func(format string, args ...interface{}) {
-		// fmt.Printf("\t"+format+"\n", args...)
+		return stat.Size(), nil
+	} else if err != nil {
+		return 0, err
 	}
 
-	embedding.SkipCompatibilityCheck = true
-	return embedding.RemoveEmbedding(out, exe, logger)
+	return c.PayloadOffset(), nil
 }
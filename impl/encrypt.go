@@ -0,0 +1,254 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// An encrypted payload is a header followed by the plain text in chunks
+// of chunkSize bytes, each one sealed with AES-256-GCM on its own so it
+// can be decrypted without reading the ones before it. The key is
+// derived from a passphrase with PBKDF2-HMAC-SHA256. The nonce of a
+// chunk is the nonce prefix followed by its index, and the header is
+// authenticated along with every chunk.
+//
+// The header (little endian) is laid out as
+//
+//	magic (8) | iterations (4) | chunk size (4) | plain size (8) |
+//	salt (16) | nonce prefix (4) | reserved (4)
+const (
+	encryptionMagic      = "EXWENC\x00\x01"
+	encryptionHeaderSize = 48
+	encryptionChunkSize  = 64 * 1024
+	encryptionIterations = 600000
+
+	// the header is read before it can be authenticated, so what it
+	// asks for is bounded.
+	encryptionMaxChunkSize  = 16 << 20
+	encryptionMaxIterations = 10 * encryptionIterations
+)
+
+var ErrWrongKey = errors.New("wrong key")
+
+type encryptionHeader struct {
+	Magic       [8]byte
+	Iterations  uint32
+	ChunkSize   uint32
+	PlainSize   uint64
+	Salt        [16]byte
+	NoncePrefix [4]byte
+	Reserved    uint32
+}
+
+func newPayloadCipher(passphrase string, header encryptionHeader) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(passphrase), header.Salt[:], int(header.Iterations), 32, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func getChunkNonce(header encryptionHeader, index uint64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header.NoncePrefix[:])
+	binary.LittleEndian.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+// IsEncrypted reports whether r starts with the header of an encrypted
+// payload.
+func IsEncrypted(r io.ReaderAt) bool {
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+
+	return string(magic) == encryptionMagic
+}
+
+// EncryptFile encrypts the file at src into dst with the passphrase.
+func EncryptFile(src string, dst string, passphrase string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := encryptionHeader{
+		Iterations: encryptionIterations,
+		ChunkSize:  encryptionChunkSize,
+		PlainSize:  uint64(stat.Size()),
+	}
+	copy(header.Magic[:], encryptionMagic)
+	if _, err = rand.Read(header.Salt[:]); err != nil {
+		return err
+	}
+	if _, err = rand.Read(header.NoncePrefix[:]); err != nil {
+		return err
+	}
+
+	var headerData bytes.Buffer
+	binary.Write(&headerData, binary.LittleEndian, header)
+
+	aead, err := newPayloadCipher(passphrase, header)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err = out.Write(headerData.Bytes()); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, encryptionChunkSize)
+	sealed := make([]byte, 0, encryptionChunkSize+aead.Overhead())
+
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(in, chunk)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		sealed = aead.Seal(sealed[:0], getChunkNonce(header, index), chunk[:n], headerData.Bytes())
+		if _, err = out.Write(sealed); err != nil {
+			return err
+		}
+	}
+
+	return out.Close()
+}
+
+// A DecryptReader gives random access to the plain text of an
+// encrypted payload.
+type DecryptReader struct {
+	r          io.ReaderAt
+	header     encryptionHeader
+	headerData []byte
+	aead       cipher.AEAD
+
+	// the last chunk decrypted.
+	index uint64
+	chunk []byte
+}
+
+// NewDecryptReader opens the encrypted payload in r with the passphrase,
+// returning ErrWrongKey if it doesn't decrypt the payload.
+func NewDecryptReader(r io.ReaderAt, passphrase string) (*DecryptReader, error) {
+	d := &DecryptReader{r: r, headerData: make([]byte, encryptionHeaderSize)}
+
+	if _, err := r.ReadAt(d.headerData, 0); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(bytes.NewReader(d.headerData), binary.LittleEndian, &d.header); err != nil {
+		return nil, err
+	}
+
+	if string(d.header.Magic[:]) != encryptionMagic {
+		return nil, errors.New("not an encrypted payload")
+	}
+	if d.header.ChunkSize == 0 || d.header.ChunkSize > encryptionMaxChunkSize {
+		return nil, fmt.Errorf("malformed encryption header: chunks of %d bytes", d.header.ChunkSize)
+	}
+	if d.header.Iterations == 0 || d.header.Iterations > encryptionMaxIterations {
+		return nil, fmt.Errorf("malformed encryption header: %d iterations", d.header.Iterations)
+	}
+
+	var err error
+	if d.aead, err = newPayloadCipher(passphrase, d.header); err != nil {
+		return nil, err
+	}
+
+	// decrypting the first chunk tells whether the key is right.
+	if d.header.PlainSize > 0 {
+		if err = d.load(0); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// Size returns the size of the plain text.
+func (d *DecryptReader) Size() int64 {
+	return int64(d.header.PlainSize)
+}
+
+func (d *DecryptReader) load(index uint64) error {
+	if d.chunk != nil && d.index == index {
+		return nil
+	}
+
+	chunkSize := uint64(d.header.ChunkSize)
+	size := min(chunkSize, d.header.PlainSize-index*chunkSize)
+	sealedSize := chunkSize + uint64(d.aead.Overhead())
+
+	sealed := make([]byte, size+uint64(d.aead.Overhead()))
+	if _, err := d.r.ReadAt(sealed, int64(encryptionHeaderSize+index*sealedSize)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	chunk, err := d.aead.Open(d.chunk[:0], getChunkNonce(d.header, index), sealed, d.headerData)
+	if err != nil {
+		// the failed open cleared the chunk decrypted last.
+		d.chunk = nil
+		if index == 0 {
+			return ErrWrongKey
+		}
+		return errors.New("encrypted payload is corrupt")
+	}
+
+	d.index = index
+	d.chunk = chunk
+	return nil
+}
+
+func (d *DecryptReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := uint64(off) + uint64(n)
+		if pos >= d.header.PlainSize {
+			return n, io.EOF
+		}
+
+		index := pos / uint64(d.header.ChunkSize)
+		if err := d.load(index); err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], d.chunk[pos-index*uint64(d.header.ChunkSize):])
+	}
+
+	return n, nil
+}
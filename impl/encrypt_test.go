@@ -0,0 +1,170 @@
+package impl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPassphrase = "correct horse battery staple"
+
+// encryptTestData encrypts data with the test passphrase and returns the
+// encrypted payload.
+func encryptTestData(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "plain"), filepath.Join(dir, "encrypted")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptFile(src, dst, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encrypted
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	// a few chunks, the last one partial.
+	data := make([]byte, 3*encryptionChunkSize+1234)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	encrypted := encryptTestData(t, data)
+	if !IsEncrypted(bytes.NewReader(encrypted)) {
+		t.Fatal("payload not recognized as encrypted")
+	}
+	if bytes.Contains(encrypted, data[:64]) {
+		t.Fatal("plain text found in the encrypted payload")
+	}
+
+	d, err := NewDecryptReader(bytes.NewReader(encrypted), testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != int64(len(data)) {
+		t.Fatalf("size = %d, want %d", d.Size(), len(data))
+	}
+
+	got, err := io.ReadAll(io.NewSectionReader(d, 0, d.Size()))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("decrypted payload differs: %v", err)
+	}
+
+	// reads across chunks, in any order.
+	for _, off := range []int{2*encryptionChunkSize - 10, 5, encryptionChunkSize, len(data) - 3} {
+		p := make([]byte, 20)
+		n, err := d.ReadAt(p, int64(off))
+		if want := min(len(p), len(data)-off); n != want || !bytes.Equal(p[:n], data[off:off+n]) {
+			t.Errorf("ReadAt(%d) = %d bytes, %v", off, n, err)
+		}
+	}
+
+	empty := encryptTestData(t, nil)
+	if d, err := NewDecryptReader(bytes.NewReader(empty), testPassphrase); err != nil || d.Size() != 0 {
+		t.Errorf("empty payload: %v", err)
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	encrypted := encryptTestData(t, []byte("hello"))
+
+	if _, err := NewDecryptReader(bytes.NewReader(encrypted), "wrong"); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("error = %v, want ErrWrongKey", err)
+	}
+}
+
+func TestDecryptDamaged(t *testing.T) {
+	data := make([]byte, 2*encryptionChunkSize+100)
+	rand.New(rand.NewSource(2)).Read(data)
+	encrypted := encryptTestData(t, data)
+
+	sealedSize := encryptionChunkSize + 16
+	readAll := func(encrypted []byte) error {
+		d, err := NewDecryptReader(bytes.NewReader(encrypted), testPassphrase)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadAll(io.NewSectionReader(d, 0, d.Size()))
+		return err
+	}
+
+	t.Run("truncated chunk", func(t *testing.T) {
+		if err := readAll(encrypted[:len(encrypted)-10]); err != io.ErrUnexpectedEOF {
+			t.Errorf("error = %v, want io.ErrUnexpectedEOF", err)
+		}
+	})
+
+	t.Run("changed chunk", func(t *testing.T) {
+		damaged := bytes.Clone(encrypted)
+		damaged[encryptionHeaderSize+sealedSize+7] ^= 1
+		if err := readAll(damaged); err == nil || errors.Is(err, ErrWrongKey) {
+			t.Errorf("error = %v, want a corrupt payload", err)
+		}
+	})
+
+	t.Run("swapped chunks", func(t *testing.T) {
+		damaged := bytes.Clone(encrypted)
+		first := damaged[encryptionHeaderSize : encryptionHeaderSize+sealedSize]
+		second := damaged[encryptionHeaderSize+sealedSize : encryptionHeaderSize+2*sealedSize]
+		tmp := bytes.Clone(first)
+		copy(first, second)
+		copy(second, tmp)
+		if err := readAll(damaged); err == nil {
+			t.Error("swapped chunks accepted")
+		}
+	})
+
+	t.Run("failed chunk is not reused", func(t *testing.T) {
+		damaged := bytes.Clone(encrypted)
+		damaged[encryptionHeaderSize+sealedSize+7] ^= 1
+
+		d, err := NewDecryptReader(bytes.NewReader(damaged), testPassphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, 10)
+		if _, err := d.ReadAt(p, encryptionChunkSize); err == nil {
+			t.Fatal("changed chunk decrypted")
+		}
+		if _, err := d.ReadAt(p, encryptionChunkSize); err == nil {
+			t.Error("changed chunk decrypted once it failed")
+		}
+	})
+}
+
+func TestDecryptMalformedHeader(t *testing.T) {
+	encrypted := encryptTestData(t, []byte("hello"))
+
+	tests := []struct {
+		name  string
+		field int
+		value uint32
+	}{
+		{"no iterations", 8, 0},
+		{"too many iterations", 8, encryptionMaxIterations + 1},
+		{"empty chunks", 12, 0},
+		{"huge chunks", 12, encryptionMaxChunkSize + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := bytes.Clone(encrypted)
+			binary.LittleEndian.PutUint32(damaged[tt.field:], tt.value)
+
+			if _, err := NewDecryptReader(bytes.NewReader(damaged), testPassphrase); err == nil || errors.Is(err, ErrWrongKey) {
+				t.Errorf("error = %v, want a malformed header", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package impl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Extract unpacks an executable built by exwrap into dest without
+// installing it: the payload goes into dest/payload, the scripts into
+// dest/setup.json and dest/launch.json, and the bare stub keeps the
+// name of the executable. No install commands are run.
+func Extract(cmd CommandLine, file string, dest string) {
+	encryptKey := getEncryptionKey(cmd)
+
+	c, err := OpenContainer(file)
+	if err != nil {
+		log.Fatalln("Failed to open executable:", err.Error())
+	}
+	defer c.Close()
+
+	if _, err = os.Stat(dest); err == nil {
+		log.Fatalf("The destination %s already exists.", dest)
+	}
+
+	// a damaged executable is still worth looking into.
+	if err = c.Verify(); err != nil {
+		fmt.Printf("Warning: %s\n", err)
+	}
+
+	if err = os.MkdirAll(dest, 0755); err != nil {
+		log.Fatalln("Failed to create destination:", err.Error())
+	}
+
+	scripts := map[string]string{
+		EmbededSetupScript:  "setup.json",
+		EmbededLaunchScript: "launch.json",
+	}
+	for _, name := range getSortedKeys(scripts) {
+		if r := c.Reader(name); r != nil {
+			out, err := os.Create(filepath.Join(dest, scripts[name]))
+			if err == nil {
+				_, err = io.Copy(out, r)
+				out.Close()
+			}
+			if err != nil {
+				log.Fatalln("Failed to extract script:", err.Error())
+			}
+
+			fmt.Printf("Extracted: %s\n", scripts[name])
+		}
+	}
+
+	stub := filepath.Base(file)
+	if err = RemoveEmbed(file, filepath.Join(dest, stub)); err != nil {
+		log.Fatalln("Failed to extract stub:", err.Error())
+	}
+	fmt.Printf("Extracted: %s (stub)\n", stub)
+
+	r, err := c.Archive()
+	if err != nil {
+		log.Fatalln("Failed to open payload:", err.Error())
+	} else if r == nil {
+		return
+	}
+
+	var archive io.ReaderAt = r
+	size := r.Size()
+
+	if IsEncrypted(r) {
+		if encryptKey == "" {
+			fmt.Println("Payload is encrypted, skipped (See -encrypt-key-file).")
+			return
+		}
+
+		d, err := NewDecryptReader(r, encryptKey)
+		if err != nil {
+			log.Fatalln("Failed to decrypt payload:", err.Error())
+		}
+		archive, size = d, d.Size()
+	}
+
+	payload := filepath.Join(dest, "payload")
+	if err = UnzipReader(archive, size, payload); err != nil {
+		log.Fatalln("Failed to extract payload:", err.Error())
+	}
+
+	// executables get their mode back as they would when installed.
+	var setup SetupScript
+	if r := c.Reader(EmbededSetupScript); r == nil {
+		// nothing to go by.
+	} else if data, err := io.ReadAll(r); err == nil && json.Unmarshal(data, &setup) == nil {
+		for _, name := range setup.Executables {
+			x, err := getPatchTarget(payload, name)
+			if err != nil {
+				fmt.Printf("Skipped executable: %s\n", err)
+				continue
+			}
+
+			// links could point anywhere.
+			if stat, err := os.Lstat(x); err == nil && stat.Mode().IsRegular() {
+				os.Chmod(x, stat.Mode()|0111)
+			}
+		}
+	}
+
+	fmt.Println("Extracted: payload")
+}
@@ -0,0 +1,56 @@
+package impl
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestExtractExecutables(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no executable bit")
+	}
+
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	header := &zip.FileHeader{Name: "bin/tool", Method: zip.Deflate}
+	header.SetMode(0644)
+	if f, err := w.CreateHeader(header); err == nil {
+		f.Write([]byte("#!/bin/sh\n"))
+	}
+	w.Close()
+
+	// the setup script is extracted next to the payload, which is what
+	// the escaping entries point at.
+	setup := `{"executables": ["bin/tool", "../setup.json", "bin/../../setup.json"]}`
+
+	var out bytes.Buffer
+	out.WriteString(testStub)
+	attachments := map[string]io.Reader{
+		EmbededArchiveName: &archive,
+		EmbededSetupScript: bytes.NewReader([]byte(setup)),
+	}
+	if err := writeContainer(&out, int64(len(testStub)), attachments, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app")
+	if err := os.WriteFile(file, out.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "out")
+	Extract(CommandLine{}, file, dest)
+
+	if stat, err := os.Stat(filepath.Join(dest, "payload", "bin", "tool")); err != nil || stat.Mode()&0111 == 0 {
+		t.Errorf("bin/tool not made executable: %v", err)
+	}
+	if stat, err := os.Stat(filepath.Join(dest, "setup.json")); err != nil || stat.Mode()&0111 != 0 {
+		t.Errorf("file outside of the payload made executable: %v", err)
+	}
+}
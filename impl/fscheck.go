@@ -0,0 +1,133 @@
+package impl
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// The longest path (in UTF-16 code units) windows applications can
+// count on, leaving room for the terminating null character.
+const windowsMaxPath = 259
+
+// Device names windows reserves in every directory, with or without an
+// extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// getWindowsInstallDir mirrors GetInstallDir for a windows target
+// without relying on the filepath rules of the build machine.
+func getWindowsInstallDir(config Config) string {
+	dir := strings.ReplaceAll(config.InstallPath, "/", "\\")
+	if strings.HasPrefix(dir, "\\\\") || (len(dir) > 1 && dir[1] == ':') {
+		return dir
+	}
+
+	return "C:\\Program Files\\" + dir
+}
+
+// checkWindowsName returns what makes a single path segment invalid on
+// windows, if anything.
+func checkWindowsName(name string) string {
+	for _, c := range name {
+		if c < 32 || strings.ContainsRune(`<>:"|?*\`, c) {
+			return fmt.Sprintf("invalid character %q", c)
+		}
+	}
+
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return "trailing dot or space"
+	}
+
+	base := strings.ToUpper(strings.TrimRight(strings.SplitN(name, ".", 2)[0], " "))
+	if windowsReservedNames[base] {
+		return fmt.Sprintf("reserved name %s", base)
+	}
+
+	return ""
+}
+
+// getTargetFilesystemProblems returns the paths in the payload that
+// can't be created as they are on the filesystems of windows and
+// darwin, along with the reason. Both are case insensitive by default.
+func getTargetFilesystemProblems(config Config, entries []payloadEntry) []string {
+	problems := make([]string, 0)
+	if config.TargetOs != "windows" && config.TargetOs != "darwin" {
+		return problems
+	}
+
+	report := func(dest string, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("%s (%s)", dest, fmt.Sprintf(format, args...)))
+	}
+
+	// the files and the directories they are in, by their lowercase
+	// path. Directories that only differ by case are merged, which is
+	// harmless unless a file is involved.
+	type seenPath struct {
+		path string
+		file bool
+	}
+	seen := make(map[string]seenPath, 0)
+	installDir := getWindowsInstallDir(config)
+
+	for _, entry := range entries {
+		dest := path.Clean(filepath.ToSlash(entry.Dest))
+
+		for p := dest; p != "." && p != "/"; p = path.Dir(p) {
+			key := strings.ToLower(p)
+			if other, ok := seen[key]; ok {
+				if other.path != p && (other.file || p == dest) {
+					report(dest, "differs from %s only by case", other.path)
+				}
+				break
+			}
+			seen[key] = seenPath{p, p == dest}
+		}
+
+		if config.TargetOs == "darwin" {
+			if strings.Contains(dest, ":") {
+				report(dest, "invalid character ':'")
+			}
+			continue
+		}
+
+		for _, name := range strings.Split(dest, "/") {
+			if problem := checkWindowsName(name); problem != "" {
+				report(dest, "%s", problem)
+				break
+			}
+		}
+
+		full := installDir + "\\" + strings.ReplaceAll(dest, "/", "\\")
+		if n := len(utf16.Encode([]rune(full))); n > windowsMaxPath {
+			report(dest, "%d characters long once installed, the limit is %d", n, windowsMaxPath)
+		}
+	}
+
+	return problems
+}
+
+// checkTargetFilesystem reports the paths in the payload that are
+// invalid on the target, as set by the fs_check_policy.
+func checkTargetFilesystem(config Config, entries []payloadEntry) {
+	if config.FsCheckPolicy == "off" {
+		return
+	}
+
+	problems := getTargetFilesystemProblems(config, entries)
+	for _, problem := range problems {
+		fmt.Printf("Invalid path for %s: %s\n", config.TargetOs, problem)
+	}
+
+	if len(problems) > 0 && config.FsCheckPolicy == "error" {
+		log.Fatalf("Found %d path(s) that are invalid for %s. Set fs_check_policy to \"warn\" to allow them.", len(problems), config.TargetOs)
+	}
+}
@@ -0,0 +1,102 @@
+package impl
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestGetTargetFilesystemProblems(t *testing.T) {
+	// "C:\Program Files\MyApp\" is 23 characters long, and the emoji
+	// takes two UTF-16 code units, four bytes and one rune. Paths of
+	// 259 code units are fine, whatever their length in bytes, and
+	// paths of 260 aren't, whatever their length in runes.
+	emoji := strings.Repeat("\U0001F600", 100)
+	longest := emoji + "/" + strings.Repeat("a", 35)
+	tooLong := emoji + "/" + strings.Repeat("a", 36)
+
+	tests := []struct {
+		name     string
+		targetOs string
+		dests    []string
+		want     []string
+	}{
+		{"valid", "windows", []string{"bin/app.exe", "lib/data.txt", "CONSOLE.txt", "lpt10", "a.b.c"}, nil},
+		{"case only", "windows", []string{"README.md", "readme.md"}, []string{"differs from README.md only by case"}},
+		{"file and directory", "windows", []string{"lib", "Lib/x.py"}, []string{"differs from lib only by case"}},
+		{"directories", "windows", []string{"Lib/a.py", "lib/b.py"}, nil},
+		{"same path", "windows", []string{"a.txt", "./a.txt"}, nil},
+		{"reserved name", "windows", []string{"CON"}, []string{"reserved name CON"}},
+		{"reserved name with an extension", "windows", []string{"docs/aux.txt"}, []string{"reserved name AUX"}},
+		{"reserved name with extensions", "windows", []string{"con.tar.gz"}, []string{"reserved name CON"}},
+		{"reserved directory", "windows", []string{"LPT1/readme"}, []string{"reserved name LPT1"}},
+		{"reserved name and spaces", "windows", []string{"nul .txt"}, []string{"reserved name NUL"}},
+		{"less than", "windows", []string{"a<b.txt"}, []string{"invalid character '<'"}},
+		{"question mark", "windows", []string{"what?/x"}, []string{"invalid character '?'"}},
+		{"colon", "windows", []string{"a:b"}, []string{"invalid character ':'"}},
+		{"backslash", "windows", []string{"a\\b"}, []string{"invalid character '\\\\'"}},
+		{"control character", "windows", []string{"tab\tname"}, []string{"invalid character '\\t'"}},
+		{"trailing dot", "windows", []string{"file."}, []string{"trailing dot or space"}},
+		{"trailing space", "windows", []string{"dir /x"}, []string{"trailing dot or space"}},
+		{"longest path", "windows", []string{longest}, nil},
+		{"path too long", "windows", []string{tooLong}, []string{"260 characters long once installed, the limit is 259"}},
+		{"darwin case only", "darwin", []string{"App.py", "app.py"}, []string{"differs from App.py only by case"}},
+		{"darwin colon", "darwin", []string{"a:b"}, []string{"invalid character ':'"}},
+		{"darwin windows names", "darwin", []string{"CON", "file.", tooLong}, nil},
+		{"linux", "linux", []string{"README.md", "readme.md", "CON", "a:b"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := make([]payloadEntry, 0, len(tt.dests))
+			for _, dest := range tt.dests {
+				entries = append(entries, payloadEntry{Source: dest, Dest: dest})
+			}
+
+			config := Config{TargetOs: tt.targetOs, InstallPath: "MyApp", FsCheckPolicy: "error"}
+			problems := getTargetFilesystemProblems(config, entries)
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems = %q, want %q", problems, tt.want)
+			}
+			for i, problem := range problems {
+				if !strings.Contains(problem, tt.want[i]) {
+					t.Errorf("problem = %q, want %q", problem, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckTargetFilesystemPolicy(t *testing.T) {
+	entries := []payloadEntry{{Source: "aux.py", Dest: "aux.py"}}
+
+	if policy := os.Getenv("EXWRAP_TEST_FS_CHECK"); policy != "" {
+		checkTargetFilesystem(Config{TargetOs: "windows", InstallPath: "MyApp", FsCheckPolicy: policy}, entries)
+		return
+	}
+
+	tests := []struct {
+		policy string
+		fatal  bool
+		output string
+	}{
+		{"error", true, "Found 1 path(s) that are invalid for windows."},
+		{"warn", false, "Invalid path for windows: aux.py (reserved name AUX)"},
+		{"off", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestCheckTargetFilesystemPolicy$")
+			cmd.Env = append(os.Environ(), "EXWRAP_TEST_FS_CHECK="+tt.policy)
+			out, err := cmd.CombinedOutput()
+			if (err != nil) != tt.fatal || !strings.Contains(string(out), tt.output) {
+				t.Errorf("error = %v\n%s", err, out)
+			}
+			if tt.policy == "off" && strings.Contains(string(out), "Invalid path") {
+				t.Errorf("paths checked:\n%s", out)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package impl
 
 import (
 	"archive/zip"
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,76 +15,147 @@ import (
 	"strings"
 )
 
-func makeAttachements(config Config, files []string) map[string]string {
-	attachments := make(map[string]string, 0)
+// makeAttachements maps the files (named as in fsys) to their place in
+// the payload using the rules. Exclusions and mappings see the files as
+// if fsys was found at root.
+func makeAttachements(config Config, rules []mappingRule, fsys fs.FS, root string, files []string) []payloadEntry {
+	entries := make([]payloadEntry, 0)
 
-MainLoop:
-	for _, file := range files {
-		if !hasMatchInList(config.ExcludeFiles, file) && !hasMatchInList(config.ExcludeDirectories, file) {
-			mainKey := trimRoot(file, config.Root)
+	for _, name := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
 
-			if val, ok := config.PathOverrides[file]; ok {
-				if val != "" {
-					attachments[val] = file
-				}
-				continue
-			}
-
-			if val, ok := config.ExtraFiles[file]; ok {
-				if val != "" {
-					attachments[val] = file
-				}
-				continue
+		if !hasMatchInList(config.ExcludeFiles, file) && !hasMatchInList(config.ExcludeDirectories, file) {
+			if dest := mapFile(config, rules, file); dest != "" {
+				entries = append(entries, newFsPayloadEntry(fsys, name, file, dest))
 			}
+		}
+	}
 
-			for base, override := range config.PathOverrides {
-				if strings.HasPrefix(file, base) {
-					attachments[trimRoot(file, base)] = strings.ReplaceAll(file, base, override)
-					continue MainLoop
-				}
-			}
+	return entries
+}
 
-			for dir, targetDir := range config.ExtraDirectories {
-				if strings.HasPrefix(file, dir) {
-					newKey := strings.ReplaceAll(file, dir, targetDir)
-					attachments[newKey] = file
-					continue MainLoop
-				}
-			}
+// getIncludedFiles returns the files (named as in the root filesystem)
+// matched by the include list, or all of them when it is empty.
+func getIncludedFiles(config Config, files []string) []string {
+	if len(config.Include) == 0 {
+		return files
+	}
 
-			if mainKey != "" {
-				attachments[mainKey] = file
+	included := make([]string, 0)
+	for _, file := range files {
+		for _, pattern := range config.Include {
+			if _, ok := matchGlobPath(pattern, file); ok {
+				included = append(included, file)
+				break
 			}
 		}
 	}
 
-	return attachments
+	return included
 }
 
-func generateAttachments(config Config) map[string]string {
-	attachments := make(map[string]string, 0)
+func generateAttachments(config Config, build *payloadBuild) []payloadEntry {
+	rules := getMappingRules(config)
 
-	for k, v := range makeAttachements(config, listFiles(config.Root)) {
-		attachments[v] = k
+	files := getIncludedFiles(config, listFiles(config.FS))
+	entries := makeAttachements(config, rules, config.FS, config.Root, files)
+
+	for _, dir := range getSortedKeys(config.ExtraDirectories) {
+		fsys := os.DirFS(dir)
+		entries = append(entries, makeAttachements(config, rules, fsys, dir, listFiles(fsys))...)
+	}
+	for _, file := range getSortedKeys(config.ExtraFiles) {
+		dir := filepath.Dir(file)
+		entries = append(entries, makeAttachements(config, rules, os.DirFS(dir), dir, []string{filepath.Base(file)})...)
 	}
-	for dir := range config.ExtraDirectories {
-		for k, v := range makeAttachements(config, listFiles(dir)) {
-			attachments[v] = k
+
+	// archive members keep the order of their archive.
+	for _, src := range getSortedKeys(config.ExtraArchives) {
+		if list, err := listArchiveEntries(build, src, config.ExtraArchives[src]); err == nil {
+			entries = append(entries, list...)
+		} else {
+			log.Fatalln("Failed to read archive:", err.Error())
 		}
 	}
-	for file := range config.ExtraFiles {
-		for k, v := range makeAttachements(config, []string{file}) {
-			attachments[v] = k
+
+	entries = resolveCollisions(config, entries)
+
+	if config.Libraries.Bundle {
+		entries = bundleSharedLibraries(config, entries)
+	}
+
+	if notices := collectLicenses(config, entries); len(notices) > 0 {
+		entries = resolveCollisions(config, append(entries, notices...))
+	}
+
+	checkTargetFilesystem(config, entries)
+	scanSecrets(config, entries)
+
+	return entries
+}
+
+// getSigningKey loads the key given with -sign-key (if any), making sure
+// it matches the public key pinned by the config.
+func getSigningKey(config Config, cmd CommandLine) ed25519.PrivateKey {
+	if cmd.SignKey == "" {
+		if config.PublicKey != "" {
+			log.Fatalln("A public key is pinned but no signing key was given (See -sign-key).")
+		}
+
+		return nil
+	}
+
+	key, err := LoadSigningKey(cmd.SignKey)
+	if err != nil {
+		log.Fatalln("Failed to load signing key:", err.Error())
+	}
+
+	public := key.Public().(ed25519.PublicKey)
+	if config.PublicKey != "" {
+		pinned, err := parsePublicKey(config.PublicKey)
+		if err != nil {
+			log.Fatalln("Invalid public key:", err.Error())
+		}
+
+		if !pinned.Equal(public) {
+			log.Fatalln("The signing key does not match the pinned public key.")
 		}
 	}
 
-	return attachments
+	fmt.Printf("Signing with public key %s\n", hex.EncodeToString(public))
+	return key
+}
+
+// getEncryptionKey reads the key given with -encrypt-key-file (if any).
+func getEncryptionKey(cmd CommandLine) string {
+	if cmd.EncryptKeyFile == "" {
+		return ""
+	}
+
+	data, err := os.ReadFile(cmd.EncryptKeyFile)
+	if err != nil {
+		log.Fatalln("Failed to load encryption key:", err.Error())
+	}
+
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		log.Fatalln("The encryption key file is empty.")
+	}
+
+	return key
 }
 
 func Generate(config Config, cmd CommandLine) string {
 	// ensure we're trying to build a supported os/arch combination.
 	failFormat := "Unsupported Os/Arch combination: %s/%s"
-	if combo, ok := BuildCombinations[OSArch{config.TargetOs, config.TargetArch}]; ok {
+	if config.TargetArch == UniversalArch {
+		if config.TargetOs != "linux" && config.TargetOs != "darwin" {
+			log.Fatalf(failFormat, config.TargetOs, config.TargetArch)
+		}
+		if config.Libraries.Bundle {
+			log.Fatalln("Shared libraries cannot be bundled into universal executables.")
+		}
+	} else if combo, ok := BuildCombinations[OSArch{config.TargetOs, config.TargetArch}]; ok {
 
 		// For now, we're only supporting first-class build targets.
 		// TODO: Support non first-class targets
@@ -103,8 +176,13 @@ func Generate(config Config, cmd CommandLine) string {
 }
 
 func GenerateDefault(config Config, cmd CommandLine) string {
+	signKey := getSigningKey(config, cmd)
+	encryptKey := getEncryptionKey(cmd)
+
 	if err := os.MkdirAll(getBuildDir(cmd), os.ModePerm); err == nil {
-		attachments := generateAttachments(config)
+		build := &payloadBuild{}
+		entries := generateAttachments(config, build)
+		defer build.close()
 
 		// create build archive target
 		targetArchive := getTargetBuildArchive(config, cmd)
@@ -119,29 +197,92 @@ func GenerateDefault(config Config, cmd CommandLine) string {
 		archive := zip.NewWriter(zipfile)
 
 		// write files into it.
-		for src, dest := range attachments {
-			fmt.Printf("File discovered: %s => %s\n", src, dest)
+		relocations := make([]string, 0)
+		launchers := make([]string, 0)
+		for _, entry := range entries {
+			fmt.Printf("File discovered: %s => %s\n", entry.Source, entry.Dest)
 
-			if file, err := os.Open(src); err == nil {
-				if zf, err := archive.Create(dest); err == nil {
+			if file, relocatable, err := openPayloadFile(config, build, entry); err == nil {
+				if zf, err := archive.Create(entry.Dest); err == nil {
 					_, err = io.Copy(zf, file)
 				}
 
 				file.Close()
+
+				if relocatable {
+					relocations = append(relocations, filepath.ToSlash(entry.Dest))
+				} else if isPythonVenvLauncher(config, filepath.ToSlash(entry.Dest)) {
+					launchers = append(launchers, filepath.ToSlash(entry.Dest))
+				}
+			} else {
+				log.Fatalln("Failed to add file to archive:", err.Error())
 			}
 		}
 		archive.Close()
 
-		clear(attachments)
+		if len(launchers) > 0 {
+			fmt.Printf("Warning: console scripts not relocated, they will only run where the virtual environment was created: %s\n", strings.Join(launchers, ", "))
+		}
+
+		if config.Strip {
+			fmt.Printf("Stripping saved %d bytes.\n", build.strippedBytes)
+		}
+
+		attachments := make(map[string]string, 0)
 
-		srcWrapper := getPkgExeFromConfig(config)
 		targetBase := getTargetBaseName(cmd, config)
-		err = copyFile(srcWrapper, targetBase)
-		if err != nil {
+		if config.TargetArch == UniversalArch {
+			archs, err := writeUniversalStub(config, targetBase)
+			if err != nil {
+				log.Fatalln("Failed to create universal installer:", err.Error())
+			}
+			fmt.Printf("Universal installer for %s\n", strings.Join(archs, ", "))
+		} else if err = copyFile(getPkgExeFromConfig(config), targetBase); err != nil {
 			log.Fatalln("Failed to copy application wrapper:", err.Error())
 		}
+
+		if signKey != nil && config.PublicKey != "" {
+			if err = pinPublicKey(targetBase, signKey.Public().(ed25519.PublicKey)); err != nil {
+				log.Fatalln("Failed to pin public key:", err.Error())
+			}
+		}
+
 		attachments[EmbededArchiveName] = targetArchive
 
+		if encryptKey != "" {
+			if err = EncryptFile(targetArchive, targetArchive+".enc", encryptKey); err != nil {
+				log.Fatalln("Failed to encrypt application archive:", err.Error())
+			}
+			attachments[EmbededArchiveName] = targetArchive + ".enc"
+			defer os.Remove(targetArchive + ".enc")
+
+			fmt.Println("Payload encrypted.")
+		}
+
+		if config.Sidecar.Enabled {
+			name := config.TargetName + ".dat"
+			manifest, err := writeSidecar(attachments[EmbededArchiveName], getBuildDir(cmd), name, config.Sidecar.VolumeSize<<20)
+			if err != nil {
+				log.Fatalln("Failed to create sidecar:", err.Error())
+			}
+
+			for _, volume := range manifest.Volumes {
+				fmt.Printf("Sidecar volume: %s (%d bytes)\n", volume.Name, volume.Size)
+			}
+
+			data, err := json.Marshal(manifest)
+			if err == nil {
+				err = os.WriteFile(targetArchive+".sidecar", data, fs.ModePerm)
+			}
+			if err != nil {
+				log.Fatalln("Failed to create sidecar:", err.Error())
+			}
+			defer os.Remove(targetArchive + ".sidecar")
+
+			delete(attachments, EmbededArchiveName)
+			attachments[EmbededSidecarName] = targetArchive + ".sidecar"
+		}
+
 		targetExe := getTargetExeName(cmd, config)
 		if FileExists(targetExe) {
 			os.Remove(targetExe)
@@ -154,6 +295,12 @@ func GenerateDefault(config Config, cmd CommandLine) string {
 			ExeName:             config.TargetName,
 			PreInstallCommands:  config.PreInstallCommands,
 			PostInstallCommands: config.PostInstallCommands,
+			Relocations:         relocations,
+		}
+		if encryptKey != "" {
+			setupScript.KeyEnv = config.Encryption.KeyEnv
+			setupScript.KeyFile = config.Encryption.KeyFile
+			setupScript.KeyPrompt = !config.Encryption.NoPrompt
 		}
 		setupName := getBuildSetupScriptName(cmd)
 		if data, err := json.Marshal(setupScript); err == nil {
@@ -179,7 +326,7 @@ func GenerateDefault(config Config, cmd CommandLine) string {
 		}
 		attachments[EmbededLaunchScript] = launchName
 
-		err = Embed(targetBase, targetExe, attachments)
+		err = EmbedSigned(targetBase, targetExe, attachments, signKey)
 		if err != nil {
 			log.Fatalln(err.Error())
 		}
@@ -199,8 +346,20 @@ func GenerateDefault(config Config, cmd CommandLine) string {
 }
 
 func GenerateDarwin(config Config, cmd CommandLine) string {
+	if cmd.SignKey != "" || config.PublicKey != "" {
+		log.Fatalln("App bundles carry no payload to sign, sign them with codesign instead.")
+	}
+	if cmd.EncryptKeyFile != "" {
+		log.Fatalln("App bundles carry no payload to encrypt.")
+	}
+	if config.Sidecar.Enabled {
+		log.Fatalln("App bundles carry no payload to put in a sidecar.")
+	}
+
 	if err := os.MkdirAll(getBuildDir(cmd), os.ModePerm); err == nil {
-		attachments := generateAttachments(config)
+		build := &payloadBuild{}
+		entries := generateAttachments(config, build)
+		defer build.close()
 
 		// create build archive target
 		targetArchive := getTargetBuildArchive(config, cmd)
@@ -215,17 +374,19 @@ func GenerateDarwin(config Config, cmd CommandLine) string {
 		os.MkdirAll(frameworksDir, os.ModePerm)
 
 		// write files into it.
-		for src, dest := range attachments {
-			fmt.Printf("File discovered: %s => %s\n", src, dest)
-			tmpDst := dest
+		relocations := make([]string, 0)
+		for _, entry := range entries {
+			fmt.Printf("File discovered: %s => %s\n", entry.Source, entry.Dest)
+			tmpDst := entry.Dest
 
-			dest = path.Join(resourcesDir, dest)
+			dest := path.Join(resourcesDir, entry.Dest)
 			os.MkdirAll(filepath.Dir(dest), os.ModePerm)
 
-			if file, err := os.Open(src); err == nil {
-				mode := os.ModePerm
-				if stat, err := file.Stat(); err == nil {
-					mode = stat.Mode()
+			if file, relocatable, err := openPayloadFile(config, build, entry); err == nil {
+				mode := entry.Mode
+
+				if relocatable {
+					relocations = append(relocations, filepath.ToSlash(tmpDst))
 				}
 
 				if zf, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode); err == nil {
@@ -238,10 +399,36 @@ func GenerateDarwin(config Config, cmd CommandLine) string {
 				}
 
 				file.Close()
+			} else {
+				log.Fatalln("Failed to add file to application:", err.Error())
 			}
 		}
 
-		clear(attachments)
+		if config.Strip {
+			fmt.Printf("Stripping saved %d bytes.\n", build.strippedBytes)
+		}
+
+		// copy the frameworks, pointing them at each other.
+		for _, src := range config.Darwin.Frameworks {
+			dest := path.Join(frameworksDir, path.Base(src))
+			fmt.Printf("Framework discovered: %s => %s\n", src, dest)
+
+			data, err := os.ReadFile(src)
+			if err != nil {
+				log.Fatalln("Failed to read framework:", err.Error())
+			}
+
+			if isMachO(data) {
+				id := getDarwinFrameworkInstallName(path.Base(src))
+				if data, err = relinkDarwinFrameworks(config, path.Base(src), data, id); err != nil {
+					log.Fatalln(err.Error())
+				}
+			}
+
+			if err = os.WriteFile(dest, data, 0755); err != nil {
+				log.Fatalln("Failed to copy framework:", err.Error())
+			}
+		}
 
 		// Create the launch script
 		launchScript := path.Join(macosDir, getLaunchScriptForDarwinApp(config))
@@ -254,13 +441,31 @@ func GenerateDarwin(config Config, cmd CommandLine) string {
 			log.Fatalln("Failed to create launch script:", err.Error())
 		}
 
+		// files to relocate into the app's final location on first launch.
+		if len(relocations) > 0 {
+			relocationsScript := path.Join(macosDir, getRelocationsForDarwinApp(config))
+
+			if data, err := json.Marshal(relocations); err == nil {
+				if err = os.WriteFile(relocationsScript, data, fs.ModePerm); err != nil {
+					log.Fatalln("Failed to create relocations script:", err.Error())
+				}
+			} else {
+				log.Fatalln("Failed to create relocations script:", err.Error())
+			}
+		}
+
 		// indicate this is a darwin app
 		_ = os.WriteFile(path.Join(macosDir, DarwinAppLockfile), []byte{}, os.ModePerm)
 
-		srcWrapper := getPkgExeFromConfig(config)
 		targetExe := path.Join(macosDir, config.TargetName)
 
-		if err = copyFile(srcWrapper, targetExe); err != nil {
+		if config.TargetArch == UniversalArch {
+			archs, err := writeUniversalDarwinStub(targetExe)
+			if err != nil {
+				log.Fatalln("Failed to create launch file:", err.Error())
+			}
+			fmt.Printf("Universal app for %s\n", strings.Join(archs, ", "))
+		} else if err = copyFile(getPkgExeFromConfig(config), targetExe); err != nil {
 			log.Fatalln("Failed to create launch file:", err.Error())
 		} else {
 			if stat, err := os.Stat(targetExe); err == nil {
@@ -0,0 +1,117 @@
+package impl
+
+import (
+	"io"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestGenerateAttachments(t *testing.T) {
+	extra, err := filepath.Abs(filepath.Join("testdata", "elf", "lib.c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the root only exists in the filesystem given with the config.
+	root := filepath.Join(t.TempDir(), "app")
+	config := Config{
+		Root: root,
+		FS: fstest.MapFS{
+			"main.py":          {Data: []byte("print('hello')\n")},
+			"lib/util.py":      {Data: []byte("x = 1\n"), Mode: 0600},
+			"build/cache.txt":  {Data: []byte("cache\n")},
+			"docs/readme.md":   {Data: []byte("# app\n")},
+			"docs/images/a.md": {Data: []byte("# a\n")},
+		},
+		Mappings: []MappingRule{
+			{From: "docs/**", To: "share/doc/{{ .Rest }}"},
+		},
+		ExcludeDirectories: []string{filepath.Join(root, "build")},
+		ExtraFiles:         map[string]string{extra: "src/lib.c"},
+		CollisionPolicy:    "error",
+		SecretsPolicy:      "off",
+	}
+
+	build := &payloadBuild{}
+	defer build.close()
+	entries := generateAttachments(config, build)
+
+	want := map[string]string{
+		"main.py":               "print('hello')\n",
+		"lib/util.py":           "x = 1\n",
+		"share/doc/readme.md":   "# app\n",
+		"share/doc/images/a.md": "# a\n",
+		"src/lib.c":             string(readFixture(t, "elf/lib.c")),
+	}
+
+	dests := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		dests = append(dests, entry.Dest)
+
+		rc, err := entry.Open()
+		if err != nil {
+			t.Fatalf("%s: %s", entry.Dest, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+
+		if err != nil || string(data) != want[entry.Dest] {
+			t.Errorf("%s = %q, want %q", entry.Dest, data, want[entry.Dest])
+		}
+	}
+
+	slices.Sort(dests)
+	wantDests := make([]string, 0, len(want))
+	for dest := range want {
+		wantDests = append(wantDests, dest)
+	}
+	slices.Sort(wantDests)
+
+	if !slices.Equal(dests, wantDests) {
+		t.Errorf("entries = %q, want %q", dests, wantDests)
+	}
+
+	for _, entry := range entries {
+		if entry.Dest == "lib/util.py" && entry.Mode.Perm() != 0600 {
+			t.Errorf("lib/util.py mode = %v, want 0600", entry.Mode)
+		}
+	}
+}
+
+func TestGetIncludedFiles(t *testing.T) {
+	files := []string{
+		"main.py",
+		"app/__init__.py",
+		"app/core/models.py",
+		"app/core/data.json",
+		"application.txt",
+		"tests/test_app.py",
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		want    []string
+	}{
+		{"everything", nil, files},
+		{"file", []string{"main.py"}, []string{"main.py"}},
+		{"directory", []string{"app"}, []string{"app/__init__.py", "app/core/models.py", "app/core/data.json"}},
+		{"nested directory", []string{"app/core"}, []string{"app/core/models.py", "app/core/data.json"}},
+		{"partial segment", []string{"app/cor", "applic"}, []string{}},
+		{"star within a segment", []string{"app*"}, []string{"app/__init__.py", "app/core/models.py", "app/core/data.json", "application.txt"}},
+		{"star at the top", []string{"*.py"}, []string{"main.py"}},
+		{"double star", []string{"**/*.py"}, []string{"main.py", "app/__init__.py", "app/core/models.py", "tests/test_app.py"}},
+		{"double star inside", []string{"app/**/*.json"}, []string{"app/core/data.json"}},
+		{"several patterns", []string{"main.py", "tests"}, []string{"main.py", "tests/test_app.py"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getIncludedFiles(Config{Include: tt.include}, files); !slices.Equal(got, tt.want) {
+				t.Errorf("included = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
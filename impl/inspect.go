@@ -0,0 +1,227 @@
+package impl
+
+import (
+	"archive/zip"
+	"bytes"
+	"debug/buildinfo"
+	"debug/macho"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var universalStubPattern = regexp.MustCompile(`skip=(\d+); count=(\d+) ;;`)
+
+// describeStub returns the target os/arch of the wrapper stub and the
+// versions it was built with.
+func describeStub(stub io.ReaderAt) string {
+	// universal MacOS stubs are fat Mach-O files of the stubs.
+	if fat, err := macho.NewFatFile(stub); err == nil {
+		stubs := make([]string, 0, len(fat.Arches))
+		for _, arch := range fat.Arches {
+			stubs = append(stubs, describeStub(io.NewSectionReader(stub, int64(arch.Offset), int64(arch.Size))))
+		}
+
+		return fmt.Sprintf("universal Mach-O of %s", strings.Join(stubs, "; "))
+	}
+
+	info, err := buildinfo.Read(stub)
+	if err != nil {
+		return fmt.Sprintf("unknown (%s)", err)
+	}
+
+	settings := make(map[string]string, 0)
+	for _, setting := range info.Settings {
+		settings[setting.Key] = setting.Value
+	}
+
+	return fmt.Sprintf("%s/%s (%s, %s %s)", settings["GOOS"], settings["GOARCH"], info.GoVersion, info.Main.Path, info.Main.Version)
+}
+
+func isUniversalStub(stub io.ReaderAt) bool {
+	head := make([]byte, 2)
+	_, err := stub.ReadAt(head, 0)
+	return err == nil && string(head) == "#!"
+}
+
+// getUniversalLinuxStubs returns the stubs of a universal Linux
+// installer, found with the offsets in its script. They are padded to
+// whole blocks.
+func getUniversalLinuxStubs(stub io.ReaderAt) ([]*io.SectionReader, error) {
+	script := make([]byte, universalBlockSize)
+	if _, err := stub.ReadAt(script, 0); err != nil {
+		return nil, err
+	}
+
+	stubs := make([]*io.SectionReader, 0)
+	for _, m := range universalStubPattern.FindAllSubmatch(script, -1) {
+		skip, _ := strconv.ParseInt(string(m[1]), 10, 64)
+		count, _ := strconv.ParseInt(string(m[2]), 10, 64)
+		stubs = append(stubs, io.NewSectionReader(stub, skip*universalBlockSize, count*universalBlockSize))
+	}
+
+	return stubs, nil
+}
+
+// describeUniversalStub describes the stubs of a universal Linux
+// installer.
+func describeUniversalStub(stub io.ReaderAt) string {
+	sections, err := getUniversalLinuxStubs(stub)
+	if err != nil {
+		return fmt.Sprintf("unknown (%s)", err)
+	}
+
+	stubs := make([]string, 0, len(sections))
+	for _, section := range sections {
+		stubs = append(stubs, describeStub(section))
+	}
+
+	return fmt.Sprintf("universal shell installer of %s", strings.Join(stubs, "; "))
+}
+
+// printJsonAttachment pretty prints a script attachment.
+func printJsonAttachment(title string, r io.Reader) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		log.Fatalln("Failed to read attachment:", err.Error())
+	}
+
+	var pretty bytes.Buffer
+	if err = json.Indent(&pretty, data, "\t", "  "); err != nil {
+		fmt.Printf("\n%s (malformed):\n\t%s\n", title, string(data))
+		return
+	}
+
+	fmt.Printf("\n%s:\n\t%s\n", title, pretty.String())
+}
+
+// printPayloadTree prints the files of the payload archive as a tree.
+func printPayloadTree(r io.ReaderAt, size int64) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		fmt.Printf("\nPayload: unreadable (%s)\n", err)
+		return
+	}
+
+	files := make([]*zip.File, 0)
+	total := uint64(0)
+	for _, f := range archive.File {
+		if !f.FileInfo().IsDir() {
+			files = append(files, f)
+			total += f.UncompressedSize64
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	fmt.Printf("\nPayload (%d files, %d bytes):\n", len(files), total)
+
+	// directories are printed the first time a file is found in them.
+	previous := []string{}
+	for _, f := range files {
+		dirs := strings.Split(path.Dir(path.Clean(f.Name)), "/")
+		if dirs[0] == "." {
+			dirs = []string{}
+		}
+
+		common := 0
+		for common < len(dirs) && common < len(previous) && dirs[common] == previous[common] {
+			common++
+		}
+
+		for i := common; i < len(dirs); i++ {
+			fmt.Printf("\t%s%s/\n", strings.Repeat("  ", i), dirs[i])
+		}
+		fmt.Printf("\t%s%s (%s, %d bytes)\n", strings.Repeat("  ", len(dirs)), path.Base(f.Name), f.Mode(), f.UncompressedSize64)
+
+		previous = dirs
+	}
+}
+
+// Inspect prints what an executable built by exwrap carries: its
+// attachments, scripts and payload, and the stub it is built on. The
+// payload of encrypted executables is only listed given their key
+// (See -encrypt-key-file).
+func Inspect(cmd CommandLine, file string) {
+	encryptKey := getEncryptionKey(cmd)
+
+	c, err := OpenContainer(file)
+	if err != nil {
+		log.Fatalln("Failed to open executable:", err.Error())
+	}
+	defer c.Close()
+
+	fmt.Printf("File: %s\n", file)
+	fmt.Printf("Generator: exwrap %s\n", c.Generator())
+	if isUniversalStub(c.Stub()) {
+		fmt.Printf("Stub: %s, %d bytes\n", describeUniversalStub(c.Stub()), c.PayloadOffset())
+	} else {
+		fmt.Printf("Stub: %s, %d bytes\n", describeStub(c.Stub()), c.PayloadOffset())
+	}
+
+	if pinned, err := readPinnedKey(c.Stub()); err == nil && pinned != "" {
+		fmt.Printf("Pinned public key: %s\n", pinned)
+	}
+
+	if c.Signed() {
+		fmt.Printf("Signed: yes, by %s\n", hex.EncodeToString(c.Signer()))
+	} else {
+		fmt.Println("Signed: no")
+	}
+
+	// damaged executables are the ones worth looking into.
+	if err = c.Verify(); err != nil {
+		fmt.Printf("Checksums: FAILED (%s)\n", err)
+	} else {
+		fmt.Println("Checksums: ok")
+	}
+
+	fmt.Println("\nAttachments:")
+	for _, name := range c.List() {
+		fmt.Printf("\t%-10s %d bytes\n", name, c.Size(name))
+	}
+
+	if r := c.Reader(EmbededSetupScript); r != nil {
+		printJsonAttachment("Setup script", r)
+	}
+	if r := c.Reader(EmbededLaunchScript); r != nil {
+		printJsonAttachment("Launch script", r)
+	}
+
+	if r := c.Reader(EmbededSidecarName); r != nil {
+		if manifest, err := readSidecarManifest(r); err == nil {
+			fmt.Println("\nSidecar volumes:")
+			for _, volume := range manifest.Volumes {
+				fmt.Printf("\t%s (%d bytes)\n", volume.Name, volume.Size)
+			}
+		} else {
+			fmt.Printf("\nSidecar: %s\n", err)
+		}
+	}
+
+	r, err := c.Archive()
+	if err != nil {
+		fmt.Printf("\nPayload: unreadable (%s)\n", err)
+		return
+	} else if r == nil {
+		return
+	}
+
+	if !IsEncrypted(r) {
+		printPayloadTree(r, r.Size())
+	} else if encryptKey == "" {
+		fmt.Println("\nPayload: encrypted (See -encrypt-key-file)")
+	} else if d, err := NewDecryptReader(r, encryptKey); err == nil {
+		printPayloadTree(d, d.Size())
+	} else {
+		fmt.Printf("\nPayload: encrypted (%s)\n", err)
+	}
+}
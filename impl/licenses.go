@@ -0,0 +1,314 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A third-party component of the application found in the payload.
+type licenseComponent struct {
+	Name     string   `json:"name"`
+	Version  string   `json:"version,omitempty"`
+	Licenses []string `json:"licenses"`
+	Path     string   `json:"path"`
+	Files    []string `json:"files,omitempty"`
+
+	texts []string
+}
+
+// Licenses recognized by the opening of their text, for components
+// that don't declare theirs.
+var licenseTextPatterns = []struct {
+	license string
+	pattern *regexp.Regexp
+}{
+	{"AGPL-3.0", regexp.MustCompile(`(?i)GNU AFFERO GENERAL PUBLIC LICENSE\s+Version 3`)},
+	{"LGPL-3.0", regexp.MustCompile(`(?i)GNU LESSER GENERAL PUBLIC LICENSE\s+Version 3`)},
+	{"LGPL-2.1", regexp.MustCompile(`(?i)GNU LESSER GENERAL PUBLIC LICENSE\s+Version 2\.1`)},
+	{"GPL-3.0", regexp.MustCompile(`(?i)GNU GENERAL PUBLIC LICENSE\s+Version 3`)},
+	{"GPL-2.0", regexp.MustCompile(`(?i)GNU GENERAL PUBLIC LICENSE\s+Version 2`)},
+	{"MPL-2.0", regexp.MustCompile(`(?i)Mozilla Public License,? (Version|v\.) 2\.0`)},
+	{"Apache-2.0", regexp.MustCompile(`(?i)Apache License,?\s+Version 2\.0`)},
+	{"MIT", regexp.MustCompile(`(?i)Permission is hereby granted, free of charge`)},
+	{"ISC", regexp.MustCompile(`(?i)Permission to use, copy, modify, and(/or)? distribute this software for any`)},
+	{"BSD-3-Clause", regexp.MustCompile(`(?i)Neither the name of`)},
+	{"BSD-2-Clause", regexp.MustCompile(`(?i)Redistributions in binary form must reproduce`)},
+}
+
+// isLicenseFile reports whether the base name is the one of a license
+// file: LICENSE, COPYING and the like, variants such as LICENSE-MIT or
+// LICENSE_APACHE, with no extension or a plain text one. Versions such
+// as LICENSE-2.0 are not taken for an extension.
+func isLicenseFile(name string) bool {
+	name = strings.ToUpper(name)
+	if ext := path.Ext(name); stringListContains([]string{".TXT", ".MD", ".RST"}, ext) {
+		name = strings.TrimSuffix(name, ext)
+	} else if ext != "" && strings.Trim(ext[1:], "0123456789") != "" {
+		return false
+	}
+
+	for _, x := range []string{"LICENSE", "LICENCE", "COPYING", "NOTICE"} {
+		if name == x || strings.HasPrefix(name, x+"-") || strings.HasPrefix(name, x+"_") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getLicenseComponentDir returns the directory of the component a file
+// belongs to: the closest directory with a package.json or the
+// *.dist-info directory it is in, or else the directory of the file.
+func getLicenseComponentDir(dest string, roots map[string]bool) string {
+	for dir := path.Dir(dest); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if roots[dir] {
+			return dir
+		}
+	}
+
+	return path.Dir(dest)
+}
+
+func readPayloadEntry(entry payloadEntry) ([]byte, error) {
+	file, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// readPythonMetadata fills the component from the headers of the
+// METADATA file of a python distribution.
+func readPythonMetadata(component *licenseComponent, data []byte) {
+	expression := ""
+	declared := make([]string, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// the headers are followed by the description.
+			break
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		if !ok || value == "" {
+			continue
+		}
+
+		switch key {
+		case "Name":
+			component.Name = value
+		case "Version":
+			component.Version = value
+		case "License-Expression":
+			expression = value
+		case "License":
+			// some distributions put their whole license text here.
+			if len(value) <= 64 && strings.ToUpper(value) != "UNKNOWN" {
+				declared = append(declared, value)
+			}
+		case "Classifier":
+			if strings.HasPrefix(value, "License ::") {
+				parts := strings.Split(value, "::")
+				declared = append(declared, strings.TrimSpace(parts[len(parts)-1]))
+			}
+		}
+	}
+
+	if expression != "" {
+		component.Licenses = []string{expression}
+	} else {
+		component.Licenses = declared
+	}
+}
+
+// readPackageJson fills the component from a package.json file.
+func readPackageJson(component *licenseComponent, data []byte) {
+	var pkg struct {
+		Name     string `json:"name"`
+		Version  string `json:"version"`
+		License  any    `json:"license"`
+		Licenses []any  `json:"licenses"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return
+	}
+
+	if pkg.Name != "" {
+		component.Name = pkg.Name
+	}
+	component.Version = pkg.Version
+
+	// licenses used to be objects with a type.
+	for _, x := range append([]any{pkg.License}, pkg.Licenses...) {
+		switch v := x.(type) {
+		case string:
+			component.Licenses = append(component.Licenses, v)
+		case map[string]any:
+			if t, ok := v["type"].(string); ok {
+				component.Licenses = append(component.Licenses, t)
+			}
+		}
+	}
+}
+
+// isDeniedLicense reports whether any license mentioned in the license
+// expression matches one of the glob patterns.
+func isDeniedLicense(deny []string, license string) bool {
+	tokens := strings.FieldsFunc(license, func(c rune) bool {
+		return c == ' ' || c == '(' || c == ')' || c == ',' || c == '/'
+	})
+
+	for _, token := range append(tokens, license) {
+		switch strings.ToUpper(token) {
+		case "OR", "AND", "WITH":
+			continue
+		}
+
+		for _, pattern := range deny {
+			if ok, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(token)); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// collectLicenses gathers the license files and declared licenses of the
+// third-party components in the payload (anything but the files at its
+// top) and returns the entries of the notices file and its JSON summary.
+// The build fails when a component uses a denied license.
+func collectLicenses(config Config, entries []payloadEntry) []payloadEntry {
+	if !config.Licenses.Collect {
+		return nil
+	}
+
+	roots := make(map[string]bool, 0)
+	for _, entry := range entries {
+		dest := path.Clean(filepath.ToSlash(entry.Dest))
+		if path.Base(dest) == "package.json" || strings.HasSuffix(path.Dir(dest), ".dist-info") {
+			roots[path.Dir(dest)] = true
+		}
+	}
+
+	components := make(map[string]*licenseComponent, 0)
+	getComponent := func(dir string) *licenseComponent {
+		if _, ok := components[dir]; !ok {
+			components[dir] = &licenseComponent{Name: path.Base(dir), Path: dir, Licenses: []string{}}
+		}
+		return components[dir]
+	}
+
+	for _, entry := range entries {
+		dest := path.Clean(filepath.ToSlash(entry.Dest))
+		name := path.Base(dest)
+		dir := getLicenseComponentDir(dest, roots)
+
+		isMetadata := name == "METADATA" && strings.HasSuffix(path.Dir(dest), ".dist-info")
+		isPackage := name == "package.json" && roots[path.Dir(dest)]
+		if dir == "." || (!isLicenseFile(name) && !isMetadata && !isPackage) {
+			continue
+		}
+
+		data, err := readPayloadEntry(entry)
+		if err != nil {
+			log.Fatalln("Failed to read license information:", err.Error())
+		}
+
+		component := getComponent(dir)
+		if isMetadata {
+			readPythonMetadata(component, data)
+		} else if isPackage {
+			readPackageJson(component, data)
+		} else {
+			component.Files = append(component.Files, dest)
+			component.texts = append(component.texts, strings.TrimSpace(string(data)))
+		}
+	}
+
+	// the packages without any license information are of no interest.
+	dirs := make([]string, 0)
+	for dir, component := range components {
+		if len(component.Files) > 0 || len(component.Licenses) > 0 {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+
+	var notices bytes.Buffer
+	notices.WriteString("THIRD-PARTY SOFTWARE NOTICES\n\n")
+	notices.WriteString(fmt.Sprintf("%s includes the following third-party components.\n", config.TargetName))
+
+	summary := make([]*licenseComponent, 0)
+	denied := 0
+
+	for _, dir := range dirs {
+		component := components[dir]
+
+		// fall back to the license files for undeclared licenses.
+		if len(component.Licenses) == 0 {
+			for _, text := range component.texts {
+				for _, x := range licenseTextPatterns {
+					if x.pattern.MatchString(text) && !stringListContains(component.Licenses, x.license) {
+						component.Licenses = append(component.Licenses, x.license)
+						break
+					}
+				}
+			}
+		}
+
+		licenses := strings.Join(component.Licenses, ", ")
+		if licenses == "" {
+			licenses = "unknown"
+		}
+
+		for _, license := range component.Licenses {
+			if isDeniedLicense(config.Licenses.Deny, license) {
+				denied++
+				fmt.Printf("Denied license: %s (%s) in %s\n", strings.TrimSpace(component.Name+" "+component.Version), license, component.Path)
+				break
+			}
+		}
+
+		notices.WriteString("\n" + strings.Repeat("=", 80) + "\n")
+		notices.WriteString(strings.TrimSpace(fmt.Sprintf("%s %s", component.Name, component.Version)))
+		notices.WriteString(fmt.Sprintf(" (%s)\n", licenses))
+		notices.WriteString(fmt.Sprintf("Location: %s\n", component.Path))
+		for _, text := range component.texts {
+			notices.WriteString(strings.Repeat("-", 80) + "\n")
+			notices.WriteString(text + "\n")
+		}
+
+		summary = append(summary, component)
+	}
+
+	if denied > 0 {
+		log.Fatalf("Found %d component(s) with a denied license.", denied)
+	}
+
+	data, err := json.MarshalIndent(map[string]any{"components": summary}, "", "  ")
+	if err != nil {
+		log.Fatalln("Failed to create license summary:", err.Error())
+	}
+
+	fmt.Printf("Licenses collected: %d component(s)\n", len(summary))
+
+	return []payloadEntry{
+		newBytesPayloadEntry(config.Licenses.File, notices.Bytes()),
+		newBytesPayloadEntry(config.Licenses.File+".json", data),
+	}
+}
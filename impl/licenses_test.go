@@ -0,0 +1,225 @@
+package impl
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIsLicenseFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"LICENSE", true},
+		{"license", true},
+		{"LICENCE.txt", true},
+		{"COPYING", true},
+		{"NOTICE.md", true},
+		{"License.rst", true},
+		{"LICENSE-MIT", true},
+		{"LICENSE_APACHE.txt", true},
+		{"LICENSE-2.0", true},
+		{"COPYING-LGPL-2.1.md", true},
+		{"license.py", false},
+		{"licenses.go", false},
+		{"license_checker.js", false},
+		{"LICENSE.html", false},
+		{"licensed.txt", false},
+		{"noticeboard.md", false},
+		{"copying.c", false},
+		{"README.md", false},
+	}
+
+	for _, tt := range tests {
+		if got := isLicenseFile(tt.name); got != tt.want {
+			t.Errorf("isLicenseFile(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadPythonMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+		want     []string
+	}{
+		{
+			name:     "license expression",
+			metadata: "Name: pkg\nLicense: MIT License\nLicense-Expression: MIT OR Apache-2.0\nClassifier: License :: OSI Approved :: MIT License\n",
+			want:     []string{"MIT OR Apache-2.0"},
+		},
+		{
+			name:     "license and classifiers",
+			metadata: "Name: pkg\nLicense: BSD\nClassifier: Programming Language :: Python\nClassifier: License :: OSI Approved :: BSD License\n",
+			want:     []string{"BSD", "BSD License"},
+		},
+		{
+			name:     "unknown license",
+			metadata: "Name: pkg\nLicense: UNKNOWN\n",
+			want:     []string{},
+		},
+		{
+			name:     "license text",
+			metadata: "Name: pkg\nLicense: " + strings.Repeat("Permission is hereby granted. ", 4) + "\n",
+			want:     []string{},
+		},
+		{
+			name:     "description",
+			metadata: "Name: pkg\n\nLicense: GPL-3.0\n",
+			want:     []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			component := &licenseComponent{}
+			readPythonMetadata(component, []byte(tt.metadata+"Version: 1.0\n"))
+			if component.Name != "pkg" || !slices.Equal(component.Licenses, tt.want) {
+				t.Errorf("component = %s %q, want pkg %q", component.Name, component.Licenses, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPackageJson(t *testing.T) {
+	tests := []struct {
+		name string
+		pkg  string
+		want []string
+	}{
+		{"license", `{"name": "pkg", "version": "1.0.0", "license": "MIT"}`, []string{"MIT"}},
+		{"license expression", `{"name": "pkg", "version": "1.0.0", "license": "(MIT OR Apache-2.0)"}`, []string{"(MIT OR Apache-2.0)"}},
+		{"license object", `{"name": "pkg", "version": "1.0.0", "license": {"type": "ISC"}}`, []string{"ISC"}},
+		{"license list", `{"name": "pkg", "version": "1.0.0", "licenses": [{"type": "MIT"}, {"type": "GPL-2.0"}]}`, []string{"MIT", "GPL-2.0"}},
+		{"no license", `{"name": "pkg", "version": "1.0.0"}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			component := &licenseComponent{}
+			readPackageJson(component, []byte(tt.pkg))
+			if component.Name != "pkg" || component.Version != "1.0.0" || !slices.Equal(component.Licenses, tt.want) {
+				t.Errorf("component = %s %s %q, want pkg 1.0.0 %q", component.Name, component.Version, component.Licenses, tt.want)
+			}
+		})
+	}
+}
+
+const (
+	testApacheLicense = "Apache License\nVersion 2.0, January 2004"
+	testGplLicense    = "GNU GENERAL PUBLIC LICENSE\nVersion 3, 29 June 2007"
+	testMitLicense    = "Permission is hereby granted, free of charge, to any person"
+)
+
+// licenseEntries returns the entries of a payload with a python
+// distribution, a node package, a vendored library with no declared
+// license and the license of the application itself.
+func licenseEntries() []payloadEntry {
+	return secretEntries(map[string]string{
+		"LICENSE":     "the license of the application",
+		"app/main.py": "print('hello')\n",
+		"site-packages/requests-2.31.0.dist-info/METADATA": "Metadata-Version: 2.1\nName: requests\n" +
+			"Version: 2.31.0\nLicense: Apache 2.0\n\nLicense: the description\n",
+		"site-packages/requests-2.31.0.dist-info/LICENSE": testApacheLicense + "\n",
+		"node_modules/left-pad/package.json":              `{"name": "left-pad", "version": "1.3.0", "license": "WTFPL"}`,
+		"node_modules/left-pad/lib/index.js":              "module.exports = leftPad\n",
+		"node_modules/left-pad/LICENSE":                   testMitLicense,
+		"node_modules/empty/package.json":                 `{"name": "empty"}`,
+		"vendor/foo/COPYING":                              testGplLicense,
+	})
+}
+
+func TestCollectLicenses(t *testing.T) {
+	config := Config{
+		TargetName: "myapp",
+		Licenses:   LicensesConfig{Collect: true, File: "THIRD_PARTY_NOTICES", Deny: []string{"AGPL-*"}},
+	}
+
+	entries := collectLicenses(config, licenseEntries())
+	if len(entries) != 2 || entries[0].Dest != "THIRD_PARTY_NOTICES" || entries[1].Dest != "THIRD_PARTY_NOTICES.json" {
+		t.Fatalf("entries = %q", entrySources(entries))
+	}
+
+	line := strings.Repeat("=", 80)
+	rule := strings.Repeat("-", 80)
+	want := "THIRD-PARTY SOFTWARE NOTICES\n\n" +
+		"myapp includes the following third-party components.\n" +
+		"\n" + line + "\nleft-pad 1.3.0 (WTFPL)\nLocation: node_modules/left-pad\n" +
+		rule + "\n" + testMitLicense + "\n" +
+		"\n" + line + "\nrequests 2.31.0 (Apache 2.0)\nLocation: site-packages/requests-2.31.0.dist-info\n" +
+		rule + "\n" + testApacheLicense + "\n" +
+		"\n" + line + "\nfoo (GPL-3.0)\nLocation: vendor/foo\n" +
+		rule + "\n" + testGplLicense + "\n"
+
+	if got, _ := readPayloadEntry(entries[0]); string(got) != want {
+		t.Errorf("notices = %q, want %q", got, want)
+	}
+
+	var summary struct {
+		Components []licenseComponent `json:"components"`
+	}
+	data, _ := readPayloadEntry(entries[1])
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0)
+	for _, component := range summary.Components {
+		names = append(names, component.Name+":"+strings.Join(component.Licenses, ","))
+	}
+	if want := []string{"left-pad:WTFPL", "requests:Apache 2.0", "foo:GPL-3.0"}; !slices.Equal(names, want) {
+		t.Errorf("summary = %q, want %q", names, want)
+	}
+
+	if collectLicenses(Config{}, licenseEntries()) != nil {
+		t.Error("licenses collected while turned off")
+	}
+}
+
+func TestCollectLicensesDenied(t *testing.T) {
+	if os.Getenv("EXWRAP_TEST_LICENSES") == "1" {
+		config := Config{Licenses: LicensesConfig{Collect: true, File: "NOTICES", Deny: []string{"GPL-*", "WTFPL"}}}
+		collectLicenses(config, licenseEntries())
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCollectLicensesDenied$")
+	cmd.Env = append(os.Environ(), "EXWRAP_TEST_LICENSES=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "Found 2 component(s) with a denied license.") {
+		t.Errorf("denied license not fatal: %v\n%s", err, out)
+	}
+	for _, denied := range []string{"left-pad 1.3.0 (WTFPL) in node_modules/left-pad", "foo (GPL-3.0) in vendor/foo"} {
+		if !strings.Contains(string(out), "Denied license: "+denied) {
+			t.Errorf("%s not reported:\n%s", denied, out)
+		}
+	}
+}
+
+func TestIsDeniedLicense(t *testing.T) {
+	deny := []string{"GPL-*", "agpl-3.0"}
+
+	tests := []struct {
+		license string
+		want    bool
+	}{
+		{"MIT", false},
+		{"GPL-3.0", true},
+		{"gpl-2.0-only", true},
+		{"AGPL-3.0", true},
+		{"LGPL-2.1", false},
+		{"MIT OR GPL-3.0", true},
+		{"(Apache-2.0 AND MIT)", false},
+		{"Apache-2.0 WITH LLVM-exception", false},
+	}
+
+	for _, tt := range tests {
+		if got := isDeniedLicense(deny, tt.license); got != tt.want {
+			t.Errorf("isDeniedLicense(%q) = %v, want %v", tt.license, got, tt.want)
+		}
+	}
+}
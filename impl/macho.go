@@ -0,0 +1,291 @@
+package impl
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+)
+
+// load commands missing from debug/macho.
+const (
+	machoIdDylibCommand         macho.LoadCmd = 0xd        // LC_ID_DYLIB
+	machoCodeSignatureCommand   macho.LoadCmd = 0x1d       // LC_CODE_SIGNATURE
+	machoLazyLoadDylibCommand   macho.LoadCmd = 0x20       // LC_LAZY_LOAD_DYLIB
+	machoLoadWeakDylibCommand   macho.LoadCmd = 0x80000018 // LC_LOAD_WEAK_DYLIB
+	machoReexportDylibCommand   macho.LoadCmd = 0x8000001f // LC_REEXPORT_DYLIB
+	machoLoadUpwardDylibCommand macho.LoadCmd = 0x80000023 // LC_LOAD_UPWARD_DYLIB
+)
+
+// load commands that reference a dylib by its install name.
+var machoDylibCommands = map[macho.LoadCmd]bool{
+	macho.LoadCmdDylib:          true,
+	machoIdDylibCommand:         true,
+	machoLazyLoadDylibCommand:   true,
+	machoLoadWeakDylibCommand:   true,
+	machoReexportDylibCommand:   true,
+	machoLoadUpwardDylibCommand: true,
+}
+
+// A single architecture of a fat (universal) Mach-O file.
+type fatSlice struct {
+	Cpu    macho.Cpu
+	SubCpu uint32
+	Align  uint32
+	Data   []byte
+}
+
+// buildFatMachO lays the slices out as a fat Mach-O file, each one
+// aligned to its own alignment (a power of 2).
+func buildFatMachO(slices []fatSlice) []byte {
+	out := make([]byte, 8+20*len(slices))
+	binary.BigEndian.PutUint32(out, macho.MagicFat)
+	binary.BigEndian.PutUint32(out[4:], uint32(len(slices)))
+
+	for i, s := range slices {
+		offset := alignUp(uint64(len(out)), uint64(1)<<s.Align)
+		out = append(out, make([]byte, offset-uint64(len(out)))...)
+		out = append(out, s.Data...)
+
+		entry := out[8+20*i:]
+		binary.BigEndian.PutUint32(entry, uint32(s.Cpu))
+		binary.BigEndian.PutUint32(entry[4:], s.SubCpu)
+		binary.BigEndian.PutUint32(entry[8:], uint32(offset))
+		binary.BigEndian.PutUint32(entry[12:], uint32(len(s.Data)))
+		binary.BigEndian.PutUint32(entry[16:], s.Align)
+	}
+
+	return out
+}
+
+// mapMachOSlices returns the Mach-O file (thin or fat) in data with
+// each thin file replaced by what fn returns for a copy of it.
+func mapMachOSlices(data []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	if binary.BigEndian.Uint32(data) != macho.MagicFat {
+		return fn(data)
+	}
+
+	fat, err := macho.NewFatFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer fat.Close()
+
+	slices := make([]fatSlice, 0, len(fat.Arches))
+	for _, arch := range fat.Arches {
+		if uint64(arch.Offset)+uint64(arch.Size) > uint64(len(data)) {
+			return nil, errors.New("truncated Mach-O file")
+		}
+
+		slice, err := fn(bytes.Clone(data[arch.Offset : arch.Offset+arch.Size]))
+		if err != nil {
+			return nil, err
+		}
+
+		slices = append(slices, fatSlice{
+			Cpu:    arch.Cpu,
+			SubCpu: arch.SubCpu,
+			Align:  arch.Align,
+			Data:   slice,
+		})
+	}
+
+	return buildFatMachO(slices), nil
+}
+
+func isMachO(head []byte) bool {
+	if len(head) < 8 {
+		return false
+	}
+
+	switch binary.BigEndian.Uint32(head) {
+	case macho.Magic32, macho.Magic64:
+		return true
+	case macho.MagicFat:
+		// java class files share the magic of fat binaries, but have
+		// their version where the number of architectures goes.
+		return binary.BigEndian.Uint32(head[4:]) < 32
+	}
+
+	switch binary.LittleEndian.Uint32(head) {
+	case macho.Magic32, macho.Magic64:
+		return true
+	}
+
+	return false
+}
+
+// relinkMachO gives the Mach-O file (thin or fat) in data the install
+// name id (unless empty) and changes its dylib dependencies to whatever
+// rewrite returns for them (or leaves them be when it returns ""). Much
+// like install_name_tool, the load commands may only grow into the
+// padding that follows them. The returned boolean reports whether the
+// file was code signed, as its signature is no longer valid.
+func relinkMachO(data []byte, id string, rewrite func(string) string) ([]byte, bool, error) {
+	if binary.BigEndian.Uint32(data) != macho.MagicFat {
+		return relinkMachOSlice(data, 0, uint64(len(data)), id, rewrite)
+	}
+
+	fat, err := macho.NewFatFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+	defer fat.Close()
+
+	signed := false
+	for _, arch := range fat.Arches {
+		_, s, err := relinkMachOSlice(data, uint64(arch.Offset), uint64(arch.Size), id, rewrite)
+		if err != nil {
+			return nil, false, err
+		}
+		signed = signed || s
+	}
+
+	return data, signed, nil
+}
+
+func relinkMachOSlice(data []byte, offset uint64, size uint64, id string, rewrite func(string) string) ([]byte, bool, error) {
+	if offset+size > uint64(len(data)) {
+		return nil, false, errors.New("truncated Mach-O file")
+	}
+	slice := data[offset : offset+size]
+
+	f, err := macho.NewFile(bytes.NewReader(slice))
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	headerSize := uint64(28)
+	pad := 4
+	if f.Magic == macho.Magic64 {
+		headerSize = 32
+		pad = 8
+	}
+
+	// the load commands can't run into the content of the first section.
+	limit := uint64(len(slice))
+	for _, s := range f.Sections {
+		zerofill := s.Flags&0xff == 0x1 || s.Flags&0xff == 0xc || s.Flags&0xff == 0x12
+		if s.Offset != 0 && !zerofill && uint64(s.Offset) < limit {
+			limit = uint64(s.Offset)
+		}
+	}
+
+	signed := false
+	cmds := make([]byte, 0, f.Cmdsz)
+
+	for _, load := range f.Loads {
+		raw := load.Raw()
+		cmd := macho.LoadCmd(f.ByteOrder.Uint32(raw))
+
+		if cmd == machoCodeSignatureCommand {
+			signed = true
+		}
+
+		if !machoDylibCommands[cmd] || len(raw) < 24 {
+			cmds = append(cmds, raw...)
+			continue
+		}
+
+		nameOffset := f.ByteOrder.Uint32(raw[8:])
+		if nameOffset < 24 || uint64(nameOffset) > uint64(len(raw)) {
+			return nil, false, errors.New("malformed dylib load command")
+		}
+
+		name := raw[nameOffset:]
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+
+		newName := rewrite(string(name))
+		if cmd == machoIdDylibCommand {
+			newName = id
+		}
+		if newName == "" {
+			cmds = append(cmds, raw...)
+			continue
+		}
+
+		cmdsize := alignUp(uint64(24+len(newName)+1), uint64(pad))
+		newCmd := make([]byte, cmdsize)
+		copy(newCmd, raw[:24])
+		f.ByteOrder.PutUint32(newCmd[4:], uint32(cmdsize))
+		f.ByteOrder.PutUint32(newCmd[8:], 24)
+		copy(newCmd[24:], newName)
+
+		cmds = append(cmds, newCmd...)
+	}
+
+	if headerSize+uint64(len(cmds)) > limit {
+		return nil, false, fmt.Errorf(
+			"not enough room for the new load commands (link with -headerpad_max_install_names)",
+		)
+	}
+
+	end := headerSize + uint64(f.Cmdsz)
+	if uint64(len(cmds)) > uint64(f.Cmdsz) {
+		end = headerSize + uint64(len(cmds))
+	}
+
+	copy(slice[headerSize:], cmds)
+	clear(slice[headerSize+uint64(len(cmds)) : end])
+	f.ByteOrder.PutUint32(slice[20:], uint32(len(cmds)))
+
+	return data, signed, nil
+}
+
+func getDarwinFrameworkNames(config Config) map[string]bool {
+	names := make(map[string]bool, 0)
+	for _, x := range config.Darwin.Frameworks {
+		names[path.Base(x)] = true
+	}
+
+	return names
+}
+
+// getDarwinFrameworkInstallName returns the install name of a framework
+// copied into Contents/Frameworks, relative to the main executable of
+// the process. That's the app itself or an entry point at the root of
+// Contents/Resources.
+func getDarwinFrameworkInstallName(name string) string {
+	return fmt.Sprintf("@executable_path/../Frameworks/%s", name)
+}
+
+// relinkDarwinFrameworks points the references a Mach-O file has to any
+// of the frameworks at their copy in Contents/Frameworks.
+func relinkDarwinFrameworks(config Config, name string, data []byte, id string) ([]byte, error) {
+	frameworks := getDarwinFrameworkNames(config)
+
+	patched, signed, err := relinkMachO(data, id, func(dep string) string {
+		if frameworks[path.Base(dep)] {
+			return getDarwinFrameworkInstallName(path.Base(dep))
+		}
+
+		return ""
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update install names of %s: %s", name, err.Error())
+	}
+
+	fmt.Printf("Install names updated: %s\n", name)
+	if signed {
+		fmt.Printf("Code signature invalidated: %s must be signed again\n", name)
+	}
+
+	return patched, nil
+}
+
+func matchRelinkFile(config Config, dest string, head []byte) bool {
+	return config.TargetOs == "darwin" &&
+		config.Darwin.CreateApp &&
+		len(config.Darwin.Frameworks) > 0 &&
+		hasGlobMatchInList(config.Darwin.Relink, dest) &&
+		isMachO(head)
+}
+
+func applyRelink(config Config, build *payloadBuild, dest string, data []byte) ([]byte, error) {
+	return relinkDarwinFrameworks(config, dest, data, "")
+}
@@ -0,0 +1,224 @@
+package impl
+
+import (
+	"bytes"
+	"debug/macho"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// machoDylibId returns the install name in the LC_ID_DYLIB of f.
+func machoDylibId(f *macho.File) string {
+	for _, load := range f.Loads {
+		raw := load.Raw()
+		if macho.LoadCmd(f.ByteOrder.Uint32(raw)) == machoIdDylibCommand {
+			name := raw[f.ByteOrder.Uint32(raw[8:]):]
+			return string(name[:bytes.IndexByte(name, 0)])
+		}
+	}
+
+	return ""
+}
+
+// machoSlices returns the thin files in the Mach-O file in data.
+func machoSlices(t *testing.T, data []byte) []*macho.File {
+	t.Helper()
+
+	if fat, err := macho.NewFatFile(bytes.NewReader(data)); err == nil {
+		files := make([]*macho.File, 0, len(fat.Arches))
+		for _, arch := range fat.Arches {
+			files = append(files, arch.File)
+		}
+		return files
+	}
+
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("not a Mach-O file: %s", err)
+	}
+
+	return []*macho.File{f}
+}
+
+func TestRelinkMachO(t *testing.T) {
+	const (
+		oldId  = "/opt/homebrew/opt/foo/lib/libfoo.1.dylib"
+		dep    = "/opt/homebrew/opt/bar/lib/libbar.2.dylib"
+		system = "/usr/lib/libSystem.B.dylib"
+	)
+
+	frameworks := func(dep string) string {
+		if strings.HasPrefix(dep, "/opt/homebrew/") {
+			return getDarwinFrameworkInstallName(path.Base(dep))
+		}
+		return ""
+	}
+
+	tests := []struct {
+		name    string
+		fixture string
+		id      string
+		rewrite func(string) string
+		wantId  string
+		wantDep string
+		signed  bool
+		wantErr bool
+	}{
+		{
+			name:    "thin",
+			fixture: "macho/lib.dylib",
+			id:      "@executable_path/../Frameworks/libfoo.1.dylib",
+			rewrite: frameworks,
+			wantId:  "@executable_path/../Frameworks/libfoo.1.dylib",
+			wantDep: "@executable_path/../Frameworks/libbar.2.dylib",
+		},
+		{
+			name:    "thin keeping its id",
+			fixture: "macho/lib.dylib",
+			rewrite: frameworks,
+			wantId:  oldId,
+			wantDep: "@executable_path/../Frameworks/libbar.2.dylib",
+		},
+		{
+			name:    "thin with nothing to rewrite",
+			fixture: "macho/lib.dylib",
+			rewrite: func(string) string { return "" },
+			wantId:  oldId,
+			wantDep: dep,
+		},
+		{
+			name:    "fat",
+			fixture: "macho/fat.dylib",
+			id:      "@executable_path/../Frameworks/libfoo.1.dylib",
+			rewrite: frameworks,
+			wantId:  "@executable_path/../Frameworks/libfoo.1.dylib",
+			wantDep: "@executable_path/../Frameworks/libbar.2.dylib",
+		},
+		{
+			name:    "signed",
+			fixture: "macho/signed.dylib",
+			rewrite: frameworks,
+			wantId:  oldId,
+			wantDep: "@executable_path/../Frameworks/libbar.2.dylib",
+			signed:  true,
+		},
+		{
+			name:    "shorter names without padding",
+			fixture: "macho/tight.dylib",
+			id:      "@rpath/libfoo.dylib",
+			rewrite: func(dep string) string {
+				if strings.HasPrefix(dep, "/opt/homebrew/") {
+					return "@rpath/libbar.dylib"
+				}
+				return ""
+			},
+			wantId:  "@rpath/libfoo.dylib",
+			wantDep: "@rpath/libbar.dylib",
+		},
+		{
+			name:    "longer names without padding",
+			fixture: "macho/tight.dylib",
+			id:      getDarwinFrameworkInstallName("libfoo.with.a.much.longer.name.1.dylib"),
+			rewrite: frameworks,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := readFixture(t, tt.fixture)
+			before := machoSlices(t, data)
+
+			out, signed, err := relinkMachO(bytes.Clone(data), tt.id, tt.rewrite)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("load commands grown past the first section")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if signed != tt.signed {
+				t.Errorf("signed = %v, want %v", signed, tt.signed)
+			}
+			if len(out) != len(data) {
+				t.Errorf("file size changed from %d to %d", len(data), len(out))
+			}
+
+			after := machoSlices(t, out)
+			if len(after) != len(before) {
+				t.Fatalf("%d slices, want %d", len(after), len(before))
+			}
+
+			for i, f := range after {
+				if got := machoDylibId(f); got != tt.wantId {
+					t.Errorf("slice %d: id = %q, want %q", i, got, tt.wantId)
+				}
+
+				libs, _ := f.ImportedLibraries()
+				if want := []string{tt.wantDep, system}; !slices.Equal(libs, want) {
+					t.Errorf("slice %d: dependencies = %q, want %q", i, libs, want)
+				}
+
+				if len(f.Loads) != len(before[i].Loads) {
+					t.Errorf("slice %d: %d load commands, want %d", i, len(f.Loads), len(before[i].Loads))
+				}
+
+				// the sections must be left where they are.
+				got, _ := f.Sections[0].Data()
+				want, _ := before[i].Sections[0].Data()
+				if f.Sections[0].Offset != before[i].Sections[0].Offset || !bytes.Equal(got, want) {
+					t.Errorf("slice %d: __text moved or changed", i)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildFatMachO(t *testing.T) {
+	thin := readFixture(t, "macho/lib.dylib")
+	arm64 := machoFatArches(t, readFixture(t, "macho/fat.dylib"))[1]
+
+	slices := []fatSlice{
+		{Cpu: macho.CpuAmd64, SubCpu: 3, Align: 12, Data: thin},
+		{Cpu: macho.CpuArm64, Align: 14, Data: arm64},
+	}
+	data := buildFatMachO(slices)
+
+	fat, err := macho.NewFatFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("not a fat file: %s", err)
+	}
+	if len(fat.Arches) != len(slices) {
+		t.Fatalf("%d slices, want %d", len(fat.Arches), len(slices))
+	}
+
+	end := uint32(8 + 20*len(slices))
+	for i, arch := range fat.Arches {
+		want := slices[i]
+		if arch.Cpu != want.Cpu || arch.SubCpu != want.SubCpu || arch.Align != want.Align {
+			t.Errorf("slice %d: cpu %v/%d align %d, want %v/%d align %d", i, arch.Cpu, arch.SubCpu, arch.Align, want.Cpu, want.SubCpu, want.Align)
+		}
+		if arch.Offset%(1<<want.Align) != 0 {
+			t.Errorf("slice %d: offset %#x not aligned to %#x", i, arch.Offset, 1<<want.Align)
+		}
+		if arch.Offset < end {
+			t.Errorf("slice %d: offset %#x overlaps what comes before it (%#x)", i, arch.Offset, end)
+		}
+		if arch.Size != uint32(len(want.Data)) || !bytes.Equal(data[arch.Offset:arch.Offset+arch.Size], want.Data) {
+			t.Errorf("slice %d: content differs", i)
+		}
+		if arch.File.Cpu != want.Cpu {
+			t.Errorf("slice %d: holds a %v file", i, arch.File.Cpu)
+		}
+		end = arch.Offset + arch.Size
+	}
+
+	if int(end) != len(data) {
+		t.Errorf("%d bytes after the last slice", len(data)-int(end))
+	}
+}
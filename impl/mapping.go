@@ -0,0 +1,153 @@
+package impl
+
+import (
+	"bytes"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+type mappingRule struct {
+	from    string
+	to      *template.Template
+	exclude bool
+}
+
+// escapeGlob quotes the characters of name that path.Match treats
+// specially.
+func escapeGlob(name string) string {
+	var out strings.Builder
+	for _, c := range name {
+		if strings.ContainsRune(`*?[\`, c) {
+			out.WriteRune('\\')
+		}
+		out.WriteRune(c)
+	}
+
+	return out.String()
+}
+
+func escapeTemplate(text string) string {
+	return strings.ReplaceAll(text, "{{", "{{`{{`}}")
+}
+
+// getMappingPath returns the path mapping rules are matched against:
+// the slash separated path of the file relative to the root, or its
+// absolute path for files outside of it.
+func getMappingPath(config Config, file string) string {
+	if rel, err := filepath.Rel(config.Root, file); err == nil && filepath.IsLocal(rel) {
+		return filepath.ToSlash(rel)
+	}
+
+	return filepath.ToSlash(file)
+}
+
+func newMappingRule(from string, to string, exclude bool) mappingRule {
+	if from == "" {
+		log.Fatalln("Mappings require a from pattern.")
+	}
+
+	if to == "" {
+		to = "{{ .Path }}"
+	}
+
+	tmpl, err := template.New(from).Option("missingkey=error").Parse(to)
+	if err != nil {
+		log.Fatalln("Invalid mapping target:", err.Error())
+	}
+
+	return mappingRule{path.Clean(filepath.ToSlash(from)), tmpl, exclude}
+}
+
+// getMappingRules returns the mapping rules in the order they are tried
+// in. Rules from mappings come first, followed by the ones equivalent
+// to path_overrides, extra_files and extra_dirs with the longest
+// paths first.
+func getMappingRules(config Config) []mappingRule {
+	rules := make([]mappingRule, 0)
+	for _, x := range config.Mappings {
+		rules = append(rules, newMappingRule(x.From, x.To, x.Exclude))
+	}
+
+	type legacyRule struct {
+		src  string
+		from string
+		to   string
+	}
+
+	legacy := make([]legacyRule, 0)
+	for _, list := range []map[string]string{config.PathOverrides, config.ExtraFiles, config.ExtraDirectories} {
+		for src, dest := range list {
+			legacy = append(legacy, legacyRule{src, getMappingPath(config, src), dest})
+		}
+	}
+
+	sort.SliceStable(legacy, func(i, j int) bool {
+		return len(legacy[i].from) > len(legacy[j].from)
+	})
+
+	for _, x := range legacy {
+		to := escapeTemplate(filepath.ToSlash(x.to))
+		exclude := x.to == ""
+
+		// directories take the files in them along.
+		if isDirectory(config, x.src) {
+			to = path.Join(to, "{{ .Rest }}")
+			exclude = false
+		}
+
+		rules = append(rules, newMappingRule(escapeGlob(x.from), to, exclude))
+	}
+
+	return rules
+}
+
+// isDirectory reports whether the path is a directory, looking into the
+// root filesystem for paths inside the root.
+func isDirectory(config Config, file string) bool {
+	var stat fs.FileInfo
+	var err error
+
+	if rel, e := filepath.Rel(config.Root, file); e == nil && filepath.IsLocal(rel) {
+		stat, err = fs.Stat(config.FS, filepath.ToSlash(rel))
+	} else {
+		stat, err = os.Stat(file)
+	}
+
+	return err == nil && stat.IsDir()
+}
+
+// mapFile returns the path of file in the final executable, as decided
+// by the first rule matching it. An empty path means the file is left
+// out.
+func mapFile(config Config, rules []mappingRule, file string) string {
+	name := getMappingPath(config, file)
+
+	for _, rule := range rules {
+		if rest, ok := matchGlobPath(rule.from, name); ok {
+			if rule.exclude {
+				return ""
+			}
+
+			data := getTemplateData(config)
+			data["Path"] = name
+			data["Base"] = path.Base(name)
+			data["Dir"] = path.Dir(name)
+			data["Rest"] = rest
+
+			var out bytes.Buffer
+			if err := rule.to.Execute(&out, data); err != nil {
+				log.Fatalln("Failed to map file:", err.Error())
+			}
+
+			return strings.TrimLeft(path.Clean("/"+out.String()), "/")
+		}
+	}
+
+	return trimRoot(file, config.Root)
+}
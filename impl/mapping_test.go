@@ -0,0 +1,159 @@
+package impl
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestMapFile(t *testing.T) {
+	root := fstest.MapFS{
+		"src/main.py":             {},
+		"src/lib/util.py":         {},
+		"data/small.txt":          {},
+		"data/big/blob.bin":       {},
+		"data/big/special.bin":    {},
+		"[x].txt":                 {},
+		"assets/logo.png":         {},
+		"tests/test/a.py":         {},
+		"tests/testing/a.py":      {},
+		"docs/index.md":           {},
+		"docs/guide/intro/one.md": {},
+	}
+
+	tests := []struct {
+		name     string
+		mappings []MappingRule
+		override map[string]string
+		files    map[string]string
+		file     string
+		want     string
+	}{
+		{
+			name: "first match wins",
+			mappings: []MappingRule{
+				{From: "src/*.py", To: "py/{{ .Base }}"},
+				{From: "src", To: "all/{{ .Rest }}"},
+			},
+			file: "/app/src/main.py",
+			want: "py/main.py",
+		},
+		{
+			name: "later rule when the first doesn't match",
+			mappings: []MappingRule{
+				{From: "src/*.py", To: "py/{{ .Base }}"},
+				{From: "src", To: "all/{{ .Rest }}"},
+			},
+			file: "/app/src/lib/util.py",
+			want: "all/lib/util.py",
+		},
+		{
+			name: "exclude",
+			mappings: []MappingRule{
+				{From: "src/lib", Exclude: true},
+				{From: "src", To: "all/{{ .Rest }}"},
+			},
+			file: "/app/src/lib/util.py",
+			want: "",
+		},
+		{
+			name:     "mappings before path overrides",
+			mappings: []MappingRule{{From: "assets", To: "res/{{ .Rest }}"}},
+			override: map[string]string{"/app/assets": "static"},
+			file:     "/app/assets/logo.png",
+			want:     "res/logo.png",
+		},
+		{
+			name:     "overlapping prefixes, inner file",
+			override: map[string]string{"/app/data": "d", "/app/data/big": "big"},
+			files:    map[string]string{"/app/data/big/special.bin": "special.bin"},
+			file:     "/app/data/big/special.bin",
+			want:     "special.bin",
+		},
+		{
+			name:     "overlapping prefixes, inner directory",
+			override: map[string]string{"/app/data": "d", "/app/data/big": "big"},
+			files:    map[string]string{"/app/data/big/special.bin": "special.bin"},
+			file:     "/app/data/big/blob.bin",
+			want:     "big/blob.bin",
+		},
+		{
+			name:     "overlapping prefixes, outer directory",
+			override: map[string]string{"/app/data": "d", "/app/data/big": "big"},
+			file:     "/app/data/small.txt",
+			want:     "d/small.txt",
+		},
+		{
+			name:     "empty destination",
+			override: map[string]string{"/app/data/small.txt": ""},
+			file:     "/app/data/small.txt",
+			want:     "",
+		},
+		{
+			name:     "legacy sources are not globs",
+			override: map[string]string{"/app/[x].txt": "x.txt", "/app/*": "all"},
+			file:     "/app/[x].txt",
+			want:     "x.txt",
+		},
+		{
+			name:     "legacy destinations are not templates",
+			override: map[string]string{"/app/src/main.py": "{{ .Base }}"},
+			file:     "/app/src/main.py",
+			want:     "{{ .Base }}",
+		},
+		{
+			name:  "file outside of the root",
+			files: map[string]string{"/opt/tool": "bin/tool"},
+			file:  "/opt/tool",
+			want:  "bin/tool",
+		},
+		{
+			name:     "double star matches whole segments",
+			mappings: []MappingRule{{From: "**/test", Exclude: true}},
+			file:     "/app/tests/testing/a.py",
+			want:     "tests/testing/a.py",
+		},
+		{
+			name:     "double star matches any depth",
+			mappings: []MappingRule{{From: "**/test", Exclude: true}},
+			file:     "/app/tests/test/a.py",
+			want:     "",
+		},
+		{
+			name:     "double star matches no segment",
+			mappings: []MappingRule{{From: "docs/**/*.md", To: "help/{{ .Rest }}"}},
+			file:     "/app/docs/index.md",
+			want:     "help/index.md",
+		},
+		{
+			name:     "double star matches several segments",
+			mappings: []MappingRule{{From: "docs/**/*.md", To: "help/{{ .Path }}"}},
+			file:     "/app/docs/guide/intro/one.md",
+			want:     "help/docs/guide/intro/one.md",
+		},
+		{
+			name:     "no rule",
+			mappings: []MappingRule{{From: "doc", Exclude: true}},
+			file:     "/app/docs/index.md",
+			want:     "docs/index.md",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Root:          "/app",
+				FS:            root,
+				Mappings:      tt.mappings,
+				PathOverrides: tt.override,
+				ExtraFiles:    tt.files,
+			}
+
+			// the legacy rules come out of maps, in any order.
+			for range 10 {
+				if got := mapFile(config, getMappingRules(config), tt.file); got != tt.want {
+					t.Fatalf("mapFile(%s) = %q, want %q", tt.file, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,500 @@
+package impl
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A patch updates an installed application from one release to the
+// next. It is an executable like any other built by exwrap, but with a
+// patch attachment in place of the archive: a zip archive holding
+// manifest.json and the content of the files (whole, or as deltas
+// against the installed ones) under files/.
+const (
+	patchManifestName = "manifest.json"
+	patchFilesDir     = "files/"
+	patchStagingDir   = ".exwrappatch"
+	patchBackupDir    = ".exwrapbackup"
+
+	// files larger than this are sent whole rather than as deltas.
+	patchMaxDeltaSize = 256 << 20
+)
+
+type PatchFile struct {
+	Path string `json:"path"`
+
+	// One of add, change or remove.
+	Action string `json:"action"`
+
+	// The hash of the installed file, checked before it is changed or
+	// removed. Files relocated when installed have none.
+	OldSHA256 string `json:"old_sha256,omitempty"`
+
+	// The hash of the file once patched.
+	NewSHA256 string `json:"new_sha256,omitempty"`
+
+	// When true, the content is a delta against the installed file.
+	Delta bool `json:"delta,omitempty"`
+}
+
+type PatchManifest struct {
+	// The version of exwrap that generated the patch.
+	Generator string      `json:"generator"`
+	Files     []PatchFile `json:"files"`
+}
+
+// payloadRelease is what diff-pack needs to know about an executable.
+type payloadRelease struct {
+	container *Container
+	setup     SetupScript
+	launch    []byte
+	files     map[string]*zip.File
+	encrypted bool
+}
+
+func openPayloadRelease(file string, encryptKey string) payloadRelease {
+	c, err := OpenContainer(file)
+	if err != nil {
+		log.Fatalf("Failed to open executable %s: %s", file, err)
+	}
+
+	if err = c.Verify(); err != nil {
+		log.Fatalf("Damaged executable %s: %s", file, err)
+	}
+
+	release := payloadRelease{container: c, files: make(map[string]*zip.File, 0)}
+
+	if r := c.Reader(EmbededSetupScript); r != nil {
+		if data, err := io.ReadAll(r); err != nil || json.Unmarshal(data, &release.setup) != nil {
+			log.Fatalf("Malformed setup script in %s.", file)
+		}
+	}
+	if r := c.Reader(EmbededLaunchScript); r != nil {
+		if release.launch, err = io.ReadAll(r); err != nil {
+			log.Fatalf("Failed to read launch script of %s: %s", file, err)
+		}
+	}
+
+	r, err := c.Archive()
+	if err != nil {
+		log.Fatalf("Failed to open the payload of %s: %s", file, err)
+	} else if r == nil {
+		log.Fatalf("The executable %s has no payload.", file)
+	}
+
+	var archive io.ReaderAt = r
+	size := r.Size()
+	if release.encrypted = IsEncrypted(r); release.encrypted {
+		if encryptKey == "" {
+			log.Fatalf("The payload of %s is encrypted (See -encrypt-key-file).", file)
+		}
+
+		d, err := NewDecryptReader(r, encryptKey)
+		if err != nil {
+			log.Fatalf("Failed to decrypt the payload of %s: %s", file, err)
+		}
+		archive, size = d, d.Size()
+	}
+
+	reader, err := zip.NewReader(archive, size)
+	if err != nil {
+		log.Fatalf("Failed to read the payload of %s: %s", file, err)
+	}
+
+	for _, f := range reader.File {
+		if !f.FileInfo().IsDir() {
+			release.files[path.Clean(f.Name)] = f
+		}
+	}
+
+	return release
+}
+
+func getSha256(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// writePatchDelta writes the delta from the old file to the new one,
+// filling in the hashes of the entry.
+func writePatchDelta(w io.Writer, entry *PatchFile, oldFile *zip.File, newFile *zip.File) error {
+	oldData, err := readZipFile(oldFile)
+	if err != nil {
+		return err
+	}
+	newData, err := readZipFile(newFile)
+	if err != nil {
+		return err
+	}
+
+	entry.OldSHA256 = getSha256(oldData)
+	entry.NewSHA256 = getSha256(newData)
+	return makeDelta(w, oldData, newData)
+}
+
+// writePatchArchive writes the patch from one release to the next to
+// out, returning its manifest.
+func writePatchArchive(out io.Writer, from payloadRelease, to payloadRelease) (PatchManifest, error) {
+	manifest := PatchManifest{Generator: Version, Files: make([]PatchFile, 0)}
+	archive := zip.NewWriter(out)
+
+	names := make([]string, 0)
+	for name := range from.files {
+		names = append(names, name)
+	}
+	for name := range to.files {
+		if _, ok := from.files[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		oldFile, newFile := from.files[name], to.files[name]
+
+		// relocated files differ from the payload once installed.
+		relocated := stringListContains(from.setup.Relocations, name)
+		entry := PatchFile{Path: name}
+
+		switch {
+		case newFile == nil:
+			entry.Action = "remove"
+		case oldFile == nil:
+			entry.Action = "add"
+		case oldFile.CRC32 == newFile.CRC32 && oldFile.UncompressedSize64 == newFile.UncompressedSize64:
+			// unchanged, as far as the zip headers tell.
+			continue
+		default:
+			entry.Action = "change"
+			entry.Delta = !relocated && oldFile.UncompressedSize64 <= patchMaxDeltaSize && newFile.UncompressedSize64 <= patchMaxDeltaSize
+		}
+
+		// only deltas need whole files, the rest is streamed.
+		var err error
+		if oldFile != nil && !relocated && !entry.Delta {
+			if entry.OldSHA256, err = hashZipFile(oldFile, nil); err != nil {
+				return manifest, err
+			}
+		}
+
+		if entry.Action == "remove" {
+			manifest.Files = append(manifest.Files, entry)
+			continue
+		}
+
+		w, err := archive.Create(patchFilesDir + name)
+		if err != nil {
+			return manifest, err
+		}
+
+		if entry.Delta {
+			err = writePatchDelta(w, &entry, oldFile, newFile)
+		} else {
+			entry.NewSHA256, err = hashZipFile(newFile, w)
+		}
+		if err != nil {
+			return manifest, err
+		}
+
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+
+	w, err := archive.Create(patchManifestName)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+
+	return manifest, err
+}
+
+// DiffPack writes a patch from the executable at oldFile to the one at
+// newFile to output. The patch is itself an executable that applies
+// the changes to an existing installation (See ApplyPatch), built on the
+// stub of the new release and encrypted with the same key.
+func DiffPack(cmd CommandLine, oldFile string, newFile string, output string) {
+	encryptKey := getEncryptionKey(cmd)
+
+	from := openPayloadRelease(oldFile, encryptKey)
+	defer from.container.Close()
+	to := openPayloadRelease(newFile, encryptKey)
+	defer to.container.Close()
+
+	signKey := getContainerSigningKey(to.container, cmd)
+
+	patchFile := output + ".patch"
+	out, err := os.Create(patchFile)
+	if err != nil {
+		log.Fatalln("Failed to create patch:", err.Error())
+	}
+	defer os.Remove(patchFile)
+
+	manifest, err := writePatchArchive(out, from, to)
+	if c := out.Close(); err == nil {
+		err = c
+	}
+	if err != nil {
+		log.Fatalln("Failed to create patch:", err.Error())
+	}
+
+	counts := make(map[string]int, 0)
+	deltas := 0
+	for _, f := range manifest.Files {
+		counts[f.Action]++
+		if f.Delta {
+			deltas++
+		}
+	}
+	fmt.Printf("Patch: %d added, %d changed (%d as deltas), %d removed\n", counts["add"], counts["change"], deltas, counts["remove"])
+
+	if to.encrypted {
+		if err = EncryptFile(patchFile, patchFile+".enc", encryptKey); err != nil {
+			log.Fatalln("Failed to encrypt patch:", err.Error())
+		}
+		defer os.Remove(patchFile + ".enc")
+		patchFile += ".enc"
+	}
+
+	patch, err := os.Open(patchFile)
+	if err != nil {
+		log.Fatalln("Failed to open patch:", err.Error())
+	}
+	defer patch.Close()
+
+	setup, err := json.Marshal(to.setup)
+	if err != nil {
+		log.Fatalln("Failed to create setup script.")
+	}
+
+	attachments := map[string]io.Reader{
+		EmbededPatchName:    patch,
+		EmbededSetupScript:  bytes.NewReader(setup),
+		EmbededLaunchScript: bytes.NewReader(to.launch),
+	}
+
+	if FileExists(output) {
+		os.Remove(output)
+	}
+	if err = embedReaders(newFile, output, attachments, signKey); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	fmt.Printf("Patch created: %s\n", output)
+}
+
+// getPatchTarget returns where a file of the patch goes in root,
+// refusing anything outside of it.
+func getPatchTarget(root string, name string) (string, error) {
+	target := filepath.Join(root, filepath.FromSlash(name))
+	if !strings.HasPrefix(target, filepath.Clean(root)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal file path: %s", name)
+	}
+
+	return target, nil
+}
+
+func getFileSha256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// stagePatchFile writes the patched version of a file into staged,
+// checking it against the hash of the manifest.
+func stagePatchFile(root string, entry PatchFile, content *zip.File, staged string) error {
+	r, err := content.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	os.MkdirAll(filepath.Dir(staged), 0755)
+	out, err := os.Create(staged)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	w := io.MultiWriter(out, hash)
+
+	if entry.Delta {
+		target, _ := getPatchTarget(root, entry.Path)
+		old, err := os.Open(target)
+		if err != nil {
+			return err
+		}
+		defer old.Close()
+
+		err = applyDelta(w, old, r)
+		if err != nil {
+			return fmt.Errorf("%s: %s", entry.Path, err)
+		}
+	} else if _, err = io.Copy(w, r); err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != entry.NewSHA256 {
+		return fmt.Errorf("%s does not match the patch once patched (checksum mismatch)", entry.Path)
+	}
+
+	return out.Close()
+}
+
+// ApplyPatch applies the patch archive (of size bytes read from r) to
+// the installation at root. The installed files are checked against
+// the release the patch was made from, and the patched ones against the
+// new release, before anything is changed. The files to relocate are
+// relocated once patched.
+func ApplyPatch(r io.ReaderAt, size int64, root string, relocations []string) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	contents := make(map[string]*zip.File, 0)
+	var manifest PatchManifest
+	for _, f := range archive.File {
+		if f.Name == patchManifestName {
+			data, err := readZipFile(f)
+			if err == nil {
+				err = json.Unmarshal(data, &manifest)
+			}
+			if err != nil {
+				return fmt.Errorf("malformed patch manifest: %s", err)
+			}
+		} else if strings.HasPrefix(f.Name, patchFilesDir) {
+			contents[strings.TrimPrefix(f.Name, patchFilesDir)] = f
+		}
+	}
+
+	// make sure the installation is the one the patch was made for.
+	for _, entry := range manifest.Files {
+		target, err := getPatchTarget(root, entry.Path)
+		if err != nil {
+			return err
+		}
+
+		if entry.Action != "add" && entry.OldSHA256 != "" {
+			if hash, err := getFileSha256(target); err != nil {
+				return err
+			} else if hash != entry.OldSHA256 {
+				return fmt.Errorf("%s does not match the release the patch was made for (checksum mismatch)", entry.Path)
+			}
+		}
+	}
+
+	staging := filepath.Join(root, patchStagingDir)
+	_ = os.RemoveAll(staging)
+	defer os.RemoveAll(staging)
+
+	for _, entry := range manifest.Files {
+		if entry.Action == "remove" {
+			continue
+		}
+
+		content, ok := contents[entry.Path]
+		if !ok {
+			return fmt.Errorf("the patch has no content for %s", entry.Path)
+		}
+
+		if err = stagePatchFile(root, entry, content, filepath.Join(staging, filepath.FromSlash(entry.Path))); err != nil {
+			return err
+		}
+	}
+
+	// everything checks out, the installation can be changed. The files
+	// replaced or removed are kept aside until the whole patch is in, so
+	// that the installation can be put back as it was on failure.
+	backups := filepath.Join(root, patchBackupDir)
+	_ = os.RemoveAll(backups)
+	defer os.RemoveAll(backups)
+
+	type patchedFile struct {
+		target string
+		backup string
+	}
+
+	done := make([]patchedFile, 0)
+	rollback := func(err error) error {
+		for i := len(done) - 1; i >= 0; i-- {
+			if done[i].backup == "" {
+				os.Remove(done[i].target)
+			} else {
+				os.Rename(done[i].backup, done[i].target)
+			}
+		}
+		return err
+	}
+
+	patched := make([]string, 0)
+	for _, entry := range manifest.Files {
+		target, _ := getPatchTarget(root, entry.Path)
+		staged := filepath.Join(staging, filepath.FromSlash(entry.Path))
+
+		if stat, err := os.Stat(target); err == nil && stat.IsDir() {
+			return rollback(fmt.Errorf("%s is a directory", entry.Path))
+		} else if err == nil {
+			if entry.Action != "remove" {
+				os.Chmod(staged, stat.Mode())
+			}
+
+			backup := filepath.Join(backups, filepath.FromSlash(entry.Path))
+			os.MkdirAll(filepath.Dir(backup), 0755)
+			if err = os.Rename(target, backup); err != nil {
+				return rollback(err)
+			}
+			done = append(done, patchedFile{target, backup})
+		} else if !os.IsNotExist(err) {
+			return rollback(err)
+		} else if entry.Action != "remove" {
+			done = append(done, patchedFile{target, ""})
+		}
+
+		if entry.Action == "remove" {
+			continue
+		}
+
+		os.MkdirAll(filepath.Dir(target), 0755)
+		if err = os.Rename(staged, target); err != nil {
+			return rollback(err)
+		}
+
+		if stringListContains(relocations, entry.Path) {
+			patched = append(patched, entry.Path)
+		}
+	}
+
+	if err = Relocate(root, patched); err != nil {
+		return rollback(err)
+	}
+
+	return nil
+}
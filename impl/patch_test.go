@@ -0,0 +1,358 @@
+package impl
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mutateDeltaInput returns a new version of old with some bytes changed,
+// inserted, removed and moved around.
+func mutateDeltaInput(rng *rand.Rand, old []byte) []byte {
+	out := bytes.Clone(old)
+
+	for i := rng.Intn(20); i > 0 && len(out) > 0; i-- {
+		pos := rng.Intn(len(out))
+		n := rng.Intn(min(len(out)-pos, 4096) + 1)
+
+		switch rng.Intn(4) {
+		case 0:
+			for k := pos; k < pos+n; k++ {
+				out[k] ^= byte(rng.Intn(255) + 1)
+			}
+		case 1:
+			extra := make([]byte, n)
+			rng.Read(extra)
+			out = append(out[:pos], append(extra, out[pos:]...)...)
+		case 2:
+			out = append(out[:pos], out[pos+n:]...)
+		default:
+			block := bytes.Clone(out[pos : pos+n])
+			out = append(out, block...)
+		}
+	}
+
+	return out
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 200; i++ {
+		old := make([]byte, rng.Intn(64*1024))
+		rng.Read(old)
+
+		// some inputs are text-like, with repeated content.
+		if i%3 == 0 {
+			for k := range old {
+				old[k] = "ab\n"[old[k]%3]
+			}
+		}
+
+		var new []byte
+		switch i % 5 {
+		case 0:
+			new = make([]byte, rng.Intn(1024))
+			rng.Read(new)
+		case 1:
+			new = nil
+		default:
+			new = mutateDeltaInput(rng, old)
+		}
+
+		var delta bytes.Buffer
+		if err := makeDelta(&delta, old, new); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if err := applyDelta(&out, bytes.NewReader(old), bytes.NewReader(delta.Bytes())); err != nil {
+			t.Fatalf("input %d: %s", i, err)
+		}
+		if !bytes.Equal(out.Bytes(), new) {
+			t.Fatalf("input %d: the delta does not rebuild the new version", i)
+		}
+	}
+}
+
+func TestApplyDeltaMalformed(t *testing.T) {
+	old := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	new := append(bytes.Clone(old[:500]), old[600:]...)
+
+	var delta bytes.Buffer
+	if err := makeDelta(&delta, old, new); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cut := range []int{0, 8, 20, delta.Len() - 1} {
+		var out bytes.Buffer
+		if err := applyDelta(&out, bytes.NewReader(old), bytes.NewReader(delta.Bytes()[:cut])); err == nil {
+			t.Errorf("delta cut at %d accepted", cut)
+		}
+	}
+}
+
+// writeTestPatch writes a patch archive with the manifest and contents.
+func writeTestPatch(t *testing.T, files []PatchFile, contents map[string]string) *bytes.Reader {
+	t.Helper()
+
+	var out bytes.Buffer
+	archive := zip.NewWriter(&out)
+
+	for name, content := range contents {
+		w, err := archive.Create(patchFilesDir + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+
+	data, _ := json.Marshal(PatchManifest{Generator: Version, Files: files})
+	w, err := archive.Create(patchManifestName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.NewReader(out.Bytes())
+}
+
+// writeTestInstallation writes the files into a new installation.
+func writeTestInstallation(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(file), 0755)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// checkTestInstallation checks that the installation holds exactly the
+// files given.
+func checkTestInstallation(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+
+	found := 0
+	filepath.WalkDir(root, func(file string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		name, _ := filepath.Rel(root, file)
+		name = filepath.ToSlash(name)
+		data, _ := os.ReadFile(file)
+		if want, ok := files[name]; !ok {
+			t.Errorf("unexpected file %s", name)
+		} else if string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+		found++
+		return nil
+	})
+
+	if found != len(files) {
+		t.Errorf("%d files installed, want %d", found, len(files))
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	before := map[string]string{"a.txt": "old a", "b.txt": "old b", "keep.txt": "keep"}
+	root := writeTestInstallation(t, before)
+
+	patch := writeTestPatch(t, []PatchFile{
+		{Path: "a.txt", Action: "change", OldSHA256: getSha256([]byte("old a")), NewSHA256: getSha256([]byte("new a"))},
+		{Path: "b.txt", Action: "remove", OldSHA256: getSha256([]byte("old b"))},
+		{Path: "lib/c.txt", Action: "add", NewSHA256: getSha256([]byte("c"))},
+	}, map[string]string{"a.txt": "new a", "lib/c.txt": "c"})
+
+	if err := ApplyPatch(patch, patch.Size(), root, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestInstallation(t, root, map[string]string{"a.txt": "new a", "keep.txt": "keep", "lib/c.txt": "c"})
+}
+
+func TestApplyPatchRejected(t *testing.T) {
+	before := map[string]string{"a.txt": "old a", "b.txt": "old b", "dir/x.txt": "x"}
+	oldA := getSha256([]byte("old a"))
+	newA := getSha256([]byte("new a"))
+
+	tests := []struct {
+		name     string
+		files    []PatchFile
+		contents map[string]string
+		err      string
+	}{
+		{
+			name: "mismatched old hash",
+			files: []PatchFile{
+				{Path: "a.txt", Action: "change", OldSHA256: getSha256([]byte("other a")), NewSHA256: newA},
+			},
+			contents: map[string]string{"a.txt": "new a"},
+			err:      "does not match the release",
+		},
+		{
+			name: "mismatched new hash",
+			files: []PatchFile{
+				{Path: "a.txt", Action: "change", OldSHA256: oldA, NewSHA256: getSha256([]byte("other a"))},
+			},
+			contents: map[string]string{"a.txt": "new a"},
+			err:      "checksum mismatch",
+		},
+		{
+			name: "path outside of the installation",
+			files: []PatchFile{
+				{Path: "../evil.txt", Action: "add", NewSHA256: getSha256([]byte("evil"))},
+			},
+			contents: map[string]string{"../evil.txt": "evil"},
+			err:      "illegal file path",
+		},
+		{
+			name: "missing content",
+			files: []PatchFile{
+				{Path: "a.txt", Action: "change", OldSHA256: oldA, NewSHA256: newA},
+			},
+			err: "no content",
+		},
+		{
+			// the first files are in by the time the last one fails,
+			// so they must be put back.
+			name: "failing half way",
+			files: []PatchFile{
+				{Path: "a.txt", Action: "change", OldSHA256: oldA, NewSHA256: newA},
+				{Path: "b.txt", Action: "remove", OldSHA256: getSha256([]byte("old b"))},
+				{Path: "c.txt", Action: "add", NewSHA256: getSha256([]byte("c"))},
+				{Path: "dir", Action: "add", NewSHA256: getSha256([]byte("d"))},
+			},
+			contents: map[string]string{"a.txt": "new a", "c.txt": "c", "dir": "d"},
+			err:      "is a directory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			root := filepath.Join(parent, "app")
+			os.Rename(writeTestInstallation(t, before), root)
+
+			patch := writeTestPatch(t, tt.files, tt.contents)
+			err := ApplyPatch(patch, patch.Size(), root, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error = %v, want %q", err, tt.err)
+			}
+
+			checkTestInstallation(t, root, before)
+			if _, err := os.Stat(filepath.Join(parent, "evil.txt")); err == nil {
+				t.Error("file written outside of the installation")
+			}
+		})
+	}
+}
+
+// testPayloadRelease returns a release with a payload of the files.
+func testPayloadRelease(t *testing.T, files map[string]string, relocations ...string) payloadRelease {
+	t.Helper()
+
+	var out bytes.Buffer
+	archive := zip.NewWriter(&out)
+	for _, name := range getSortedKeys(files) {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[name]))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := payloadRelease{setup: SetupScript{Relocations: relocations}, files: make(map[string]*zip.File, 0)}
+	for _, f := range r.File {
+		release.files[f.Name] = f
+	}
+
+	return release
+}
+
+func TestWritePatchArchive(t *testing.T) {
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(3)).Read(data)
+	big := string(data)
+
+	before := map[string]string{
+		"same.txt":      "same",
+		"changed.bin":   big,
+		"relocated.cfg": "root=" + InstallDirPlaceholder,
+		"removed.txt":   "removed",
+	}
+	after := map[string]string{
+		"same.txt":      "same",
+		"changed.bin":   big[:1000] + "changed" + big[1000:],
+		"relocated.cfg": "root=" + InstallDirPlaceholder + "\nmore=1",
+		"added.txt":     "added",
+	}
+
+	var out bytes.Buffer
+	manifest, err := writePatchArchive(&out, testPayloadRelease(t, before, "relocated.cfg"), testPayloadRelease(t, after))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []PatchFile{
+		{Path: "added.txt", Action: "add", NewSHA256: getSha256([]byte(after["added.txt"]))},
+		{Path: "changed.bin", Action: "change", OldSHA256: getSha256([]byte(before["changed.bin"])), NewSHA256: getSha256([]byte(after["changed.bin"])), Delta: true},
+		{Path: "relocated.cfg", Action: "change", NewSHA256: getSha256([]byte(after["relocated.cfg"]))},
+		{Path: "removed.txt", Action: "remove", OldSHA256: getSha256([]byte(before["removed.txt"]))},
+	}
+	if len(manifest.Files) != len(want) {
+		t.Fatalf("manifest = %+v, want %+v", manifest.Files, want)
+	}
+	for i := range want {
+		if manifest.Files[i] != want[i] {
+			t.Errorf("manifest entry = %+v, want %+v", manifest.Files[i], want[i])
+		}
+	}
+
+	// the delta is mostly zeros, so it compresses to next to nothing.
+	r, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		if f.Name == patchFilesDir+"changed.bin" && f.CompressedSize64 >= uint64(len(big))/10 {
+			t.Errorf("delta of %d bytes for a %d bytes file", f.CompressedSize64, len(big))
+		}
+	}
+
+	// and the patch turns the old release into the new one, the
+	// relocated file as installed.
+	installed := maps.Clone(before)
+	installed["relocated.cfg"] = "root=/opt/app"
+	root := writeTestInstallation(t, installed)
+
+	if err := ApplyPatch(bytes.NewReader(out.Bytes()), int64(out.Len()), root, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTestInstallation(t, root, after)
+}
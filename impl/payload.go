@@ -0,0 +1,161 @@
+package impl
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// The number of leading bytes of a file handed to transforms so they
+// can decide whether they are interested in it.
+const payloadHeadSize = 512
+
+// A payloadEntry is a single file on its way into the payload.
+type payloadEntry struct {
+	// Where the file comes from. For files from archives, this is the
+	// path of the archive followed by the name of the file in it.
+	Source string
+
+	// The path of the file inside the payload.
+	Dest string
+
+	// The permissions of the file.
+	Mode fs.FileMode
+
+	// Opens the content of the file.
+	Open func() (io.ReadCloser, error)
+}
+
+// newFsPayloadEntry returns an entry for the file name in fsys, where
+// src is the path of the file as reported to the user.
+func newFsPayloadEntry(fsys fs.FS, name string, src string, dest string) payloadEntry {
+	mode := fs.ModePerm
+	if stat, err := fs.Stat(fsys, name); err == nil {
+		mode = stat.Mode()
+	}
+
+	// not every filesystem keeps permissions.
+	if mode.Perm() == 0 {
+		mode |= 0644
+	}
+
+	return payloadEntry{
+		Source: src,
+		Dest:   dest,
+		Mode:   mode,
+		Open: func() (io.ReadCloser, error) {
+			return fsys.Open(name)
+		},
+	}
+}
+
+func newFilePayloadEntry(src string, dest string) payloadEntry {
+	return newFsPayloadEntry(os.DirFS(filepath.Dir(src)), filepath.Base(src), src, dest)
+}
+
+// newBytesPayloadEntry returns an entry for a file generated by exwrap.
+func newBytesPayloadEntry(dest string, data []byte) payloadEntry {
+	return payloadEntry{
+		Source: "(generated)",
+		Dest:   dest,
+		Mode:   0644,
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+}
+
+// A payloadTransform rewrites the content of a file on its way into the
+// payload. The dest given to both functions is the slash separated path
+// of the file inside the payload.
+type payloadTransform struct {
+	// Reports whether the transform wants to process the file.
+	match func(config Config, dest string, head []byte) bool
+
+	// Returns the new content of the file.
+	apply func(config Config, build *payloadBuild, dest string, data []byte) ([]byte, error)
+}
+
+// A payloadBuild holds what a single build keeps track of while it
+// writes the payload.
+type payloadBuild struct {
+	// The number of bytes saved by stripping.
+	strippedBytes int64
+
+	// The archives the payload entries are read from.
+	archives []io.Closer
+}
+
+// close closes the archives opened for the build.
+func (b *payloadBuild) close() {
+	for _, x := range b.archives {
+		x.Close()
+	}
+	b.archives = nil
+}
+
+var payloadTransforms = []payloadTransform{
+	{match: matchTemplateFile, apply: renderTemplateFile},
+	{match: matchPythonVenvFile, apply: relocatePythonVenvFile},
+	{match: matchStripFile, apply: applyStrip},
+	{match: matchRunPathFile, apply: applyRunPath},
+	{match: matchRelinkFile, apply: applyRelink},
+}
+
+// openPayloadFile opens the entry for writing into the payload after
+// running it through all interested transforms. The returned boolean
+// reports whether the content references InstallDirPlaceholder and must
+// be relocated once the install directory is known.
+func openPayloadFile(config Config, build *payloadBuild, entry payloadEntry) (io.ReadCloser, bool, error) {
+	file, err := entry.Open()
+	if err != nil {
+		return nil, false, err
+	}
+
+	dest := filepath.ToSlash(entry.Dest)
+
+	head := make([]byte, payloadHeadSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		file.Close()
+		return nil, false, err
+	}
+	head = head[:n]
+
+	transforms := make([]payloadTransform, 0)
+	for _, t := range payloadTransforms {
+		if t.match(config, dest, head) {
+			transforms = append(transforms, t)
+		}
+	}
+
+	if len(transforms) == 0 {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), file), file}, false, nil
+	}
+
+	defer file.Close()
+
+	rest, err := io.ReadAll(file)
+	if err != nil {
+		return nil, false, err
+	}
+	data := append(head, rest...)
+
+	// files that already carry the placeholder (E.g. exwrap's own
+	// binaries) are not ours to relocate.
+	hasPlaceholder := bytes.Contains(data, []byte(InstallDirPlaceholder))
+
+	for _, t := range transforms {
+		if data, err = t.apply(config, build, dest, data); err != nil {
+			return nil, false, err
+		}
+	}
+
+	relocatable := !hasPlaceholder && bytes.Contains(data, []byte(InstallDirPlaceholder))
+	return io.NopCloser(bytes.NewReader(data)), relocatable, nil
+}
@@ -0,0 +1,118 @@
+package impl
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Console scripts generated into a virtual environment point at the
+// interpreter with an absolute shebang. This replaces it with a /bin/sh
+// trampoline (the same trick pip uses for overlong shebangs) that runs
+// the interpreter sitting next to the script, wherever it is installed.
+const pythonRelocatableShebang = "#!/bin/sh\n'''exec' \"$(dirname -- \"$0\")/%s\" \"$0\" \"$@\"\n' '''\n"
+
+func getPythonVenvBinDir(config Config) string {
+	if config.TargetOs == "windows" {
+		return path.Join(config.Python.Venv, "Scripts")
+	}
+
+	return path.Join(config.Python.Venv, "bin")
+}
+
+func getPythonVenvSourceDir(config Config) string {
+	return path.Join(config.Root, config.Python.Venv)
+}
+
+func getPythonVenvInstallDir(config Config) string {
+	return path.Join(InstallDirPlaceholder, config.Python.Venv)
+}
+
+func matchPythonVenvFile(config Config, dest string, head []byte) bool {
+	if config.Python.Venv == "" {
+		return false
+	}
+
+	if dest == path.Join(config.Python.Venv, "pyvenv.cfg") {
+		return true
+	}
+
+	if path.Dir(dest) != getPythonVenvBinDir(config) {
+		return false
+	}
+
+	if isPythonVenvLauncher(config, dest) {
+		return false
+	}
+
+	// only text files in the scripts directory are of interest.
+	return !bytes.ContainsRune(head, 0)
+}
+
+// isPythonVenvLauncher reports whether dest is a windows console script.
+// Those are launcher executables with the interpreter path (and the
+// script) appended, which can't be rewritten in place.
+func isPythonVenvLauncher(config Config, dest string) bool {
+	return config.Python.Venv != "" &&
+		config.TargetOs == "windows" &&
+		path.Dir(dest) == getPythonVenvBinDir(config) &&
+		strings.EqualFold(path.Ext(dest), ".exe") &&
+		!isPythonInterpreter(dest)
+}
+
+func isPythonInterpreter(dest string) bool {
+	name := strings.ToLower(path.Base(dest))
+	return name == "python.exe" || name == "pythonw.exe"
+}
+
+func relocatePythonVenvFile(config Config, build *payloadBuild, dest string, data []byte) ([]byte, error) {
+	if path.Base(dest) == "pyvenv.cfg" {
+		return relocatePythonVenvConfig(config, data), nil
+	}
+
+	if bytes.HasPrefix(data, []byte("#!")) {
+		line, rest, _ := bytes.Cut(data, []byte("\n"))
+		fields := strings.Fields(strings.TrimPrefix(string(line), "#!"))
+
+		if len(fields) > 0 && strings.Contains(path.Base(fields[0]), "python") {
+			shebang := fmt.Sprintf(pythonRelocatableShebang, path.Base(fields[0]))
+			data = append([]byte(shebang), rest...)
+		}
+	}
+
+	// activation scripts carry the absolute path of the environment.
+	return bytes.ReplaceAll(
+		data,
+		[]byte(getPythonVenvSourceDir(config)),
+		[]byte(getPythonVenvInstallDir(config)),
+	), nil
+}
+
+func relocatePythonVenvConfig(config Config, data []byte) []byte {
+	binDir := path.Join(InstallDirPlaceholder, getPythonVenvBinDir(config))
+	lines := strings.Split(string(data), "\n")
+
+	for i, line := range lines {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "home":
+			value = binDir
+		case "executable":
+			value = path.Join(binDir, path.Base(value))
+		default:
+			value = strings.ReplaceAll(value, getPythonVenvSourceDir(config), getPythonVenvInstallDir(config))
+		}
+
+		lines[i] = fmt.Sprintf("%s = %s", key, value)
+	}
+
+	return []byte(strings.Join(lines, "\n"))
+}
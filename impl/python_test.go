@@ -0,0 +1,164 @@
+package impl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testPythonConfig(targetOs string) Config {
+	return Config{
+		Root:     "/home/dev/app",
+		TargetOs: targetOs,
+		Python:   PythonConfig{Venv: ".venv"},
+	}
+}
+
+func TestMatchPythonVenvFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		targetOs string
+		dest     string
+		head     string
+		want     bool
+	}{
+		{"script", "linux", ".venv/bin/tool", "#!/home/dev/app/.venv/bin/python3\n", true},
+		{"activation script", "linux", ".venv/bin/activate", "# source this\n", true},
+		{"pyvenv.cfg", "linux", ".venv/pyvenv.cfg", "home = /usr/bin\n", true},
+		{"binary", "linux", ".venv/bin/python3", "\x7fELF\x02\x01\x01\x00", false},
+		{"outside of bin", "linux", ".venv/lib/site.py", "import os\n", false},
+		{"outside of the venv", "linux", "bin/tool", "#!/usr/bin/python3\n", false},
+		{"windows launcher", "windows", ".venv/Scripts/tool.exe", "#!python\n", false},
+		{"windows script", "windows", ".venv/Scripts/activate.bat", "@echo off\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchPythonVenvFile(testPythonConfig(tt.targetOs), tt.dest, []byte(tt.head)); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if !isPythonVenvLauncher(testPythonConfig("windows"), ".venv/Scripts/tool.exe") {
+		t.Error("windows launcher not reported")
+	}
+	if isPythonVenvLauncher(testPythonConfig("windows"), ".venv/Scripts/python.exe") {
+		t.Error("windows interpreter reported as a launcher")
+	}
+}
+
+func TestRelocatePythonVenvScript(t *testing.T) {
+	config := testPythonConfig("linux")
+
+	script := "#!/home/dev/app/.venv/bin/python3.12 -I\nimport sys\nprint(sys.argv)\n"
+	out, err := relocatePythonVenvFile(config, &payloadBuild{}, ".venv/bin/tool", []byte(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf(pythonRelocatableShebang, "python3.12") + "import sys\nprint(sys.argv)\n"
+	if string(out) != want {
+		t.Errorf("script = %q, want %q", out, want)
+	}
+
+	// other shebangs are kept, and absolute paths rewritten.
+	activate := "#!/bin/bash\nVIRTUAL_ENV=/home/dev/app/.venv\n"
+	out, _ = relocatePythonVenvFile(config, &payloadBuild{}, ".venv/bin/activate", []byte(activate))
+	if want := "#!/bin/bash\nVIRTUAL_ENV=" + InstallDirPlaceholder + "/.venv\n"; string(out) != want {
+		t.Errorf("activate = %q, want %q", out, want)
+	}
+}
+
+func TestRelocatePythonVenvConfig(t *testing.T) {
+	cfg := "home = /usr/bin\n" +
+		"include-system-site-packages = false\n" +
+		"executable = /usr/bin/python3.12\n" +
+		"command = /usr/bin/python3 -m venv /home/dev/app/.venv\n"
+
+	out, err := relocatePythonVenvFile(testPythonConfig("linux"), &payloadBuild{}, ".venv/pyvenv.cfg", []byte(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin := InstallDirPlaceholder + "/.venv/bin"
+	want := "home = " + bin + "\n" +
+		"include-system-site-packages = false\n" +
+		"executable = " + bin + "/python3.12\n" +
+		"command = /usr/bin/python3 -m venv " + InstallDirPlaceholder + "/.venv\n"
+	if string(out) != want {
+		t.Errorf("pyvenv.cfg = %q, want %q", out, want)
+	}
+}
+
+func TestRelocatePythonVenv(t *testing.T) {
+	config := testPythonConfig("linux")
+
+	script := "#!/home/dev/app/.venv/bin/python3\nVENV = '/home/dev/app/.venv'\n"
+	// the interpreter happens to mention the placeholder, but it is a
+	// binary and must come out as it went in.
+	binary := "\x7fELF\x00\x00" + InstallDirPlaceholder + "\x00"
+
+	files := map[string]string{".venv/bin/tool": script, ".venv/bin/python3": binary}
+	root := t.TempDir()
+	relocations := make([]string, 0)
+
+	for dest, content := range files {
+		entry := payloadEntry{
+			Source: filepath.Join(config.Root, dest),
+			Dest:   dest,
+			Mode:   0755,
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader(content)), nil
+			},
+		}
+
+		file, relocatable, err := openPayloadFile(config, &payloadBuild{}, entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(file)
+		file.Close()
+
+		if relocatable {
+			relocations = append(relocations, dest)
+		}
+
+		name := filepath.Join(root, filepath.FromSlash(dest))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := os.WriteFile(name, data, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(relocations) != 1 || relocations[0] != ".venv/bin/tool" {
+		t.Fatalf("relocations = %q, want [.venv/bin/tool]", relocations)
+	}
+
+	if err := Relocate(root, relocations); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(root, ".venv", "bin", "tool"))
+	if !bytes.HasPrefix(data, []byte("#!/bin/sh\n")) || !bytes.HasSuffix(data, []byte("VENV = '"+filepath.Clean(root)+"/.venv'\n")) {
+		t.Errorf("tool = %q", data)
+	}
+
+	data, _ = os.ReadFile(filepath.Join(root, ".venv", "bin", "python3"))
+	if string(data) != binary {
+		t.Errorf("python3 changed to %q", data)
+	}
+
+	// the placeholder is replaced with the installation directory.
+	os.WriteFile(filepath.Join(root, "paths.txt"), []byte("lib="+InstallDirPlaceholder+"/lib\n"), 0644)
+	if err := Relocate(root, []string{"paths.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "paths.txt")); string(data) != "lib="+filepath.Clean(root)+"/lib\n" {
+		t.Errorf("paths.txt = %q", data)
+	}
+}
@@ -0,0 +1,34 @@
+package impl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+// Relocate replaces InstallDirPlaceholder in the given files (relative
+// to root) with root itself.
+func Relocate(root string, files []string) error {
+	root = filepath.Clean(root)
+
+	for _, file := range files {
+		file = filepath.Join(root, filepath.FromSlash(file))
+
+		stat, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		data = bytes.ReplaceAll(data, []byte(InstallDirPlaceholder), []byte(root))
+		if err = os.WriteFile(file, data, stat.Mode()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// parseRepackList reads the value of a list setting, either a JSON
+// array or a single item.
+func parseRepackList(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return []string{}, nil
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		list := make([]string, 0)
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+
+	return []string{value}, nil
+}
+
+// applyRepackSetting changes the scripts as told by a key=value
+// setting. Keys are named as in the config.
+func applyRepackSetting(setup *SetupScript, launch *LaunchScript, setting string) error {
+	key, value, ok := strings.Cut(setting, "=")
+	if !ok {
+		return fmt.Errorf("%q is not of the form key=value", setting)
+	}
+
+	var err error
+	switch key {
+	case "install_path":
+		setup.InstallDirectory = value
+	case "target_name":
+		setup.ExeName = value
+	case "entry_point":
+		launch.EntryPoint, err = parseRepackList(value)
+	case "executables":
+		setup.Executables, err = parseRepackList(value)
+	case "pre_install_cmds":
+		setup.PreInstallCommands, err = parseRepackList(value)
+	case "post_install_cmds":
+		setup.PostInstallCommands, err = parseRepackList(value)
+	default:
+		return fmt.Errorf("%q cannot be changed (only install_path, target_name, entry_point, executables, pre_install_cmds and post_install_cmds can)", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %s", key, err)
+	}
+
+	return nil
+}
+
+// getContainerSigningKey loads the key given with -sign-key (if any),
+// making sure it matches the public key pinned into the stub.
+func getContainerSigningKey(c *Container, cmd CommandLine) ed25519.PrivateKey {
+	pinned, err := readPinnedKey(c.Stub())
+	if err != nil {
+		log.Fatalln("Failed to read stub:", err.Error())
+	}
+
+	if cmd.SignKey == "" {
+		if pinned != "" {
+			log.Fatalln("The stub has a pinned public key but no signing key was given (See -sign-key).")
+		} else if c.Signed() {
+			fmt.Println("Warning: the executable was signed but will not be (See -sign-key).")
+		}
+
+		return nil
+	}
+
+	key, err := LoadSigningKey(cmd.SignKey)
+	if err != nil {
+		log.Fatalln("Failed to load signing key:", err.Error())
+	}
+
+	public := hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	if pinned != "" && pinned != public {
+		log.Fatalln("The signing key does not match the public key pinned into the stub.")
+	}
+
+	fmt.Printf("Signing with public key %s\n", public)
+	return key
+}
+
+// Repack rewrites the setup and launch scripts of an executable built
+// by exwrap with the settings (key=value), keeping its stub and archive
+// as they are. The result is written to output, which may be the
+// executable itself.
+func Repack(cmd CommandLine, file string, output string, settings []string) {
+	c, err := OpenContainer(file)
+	if err != nil {
+		log.Fatalln("Failed to open executable:", err.Error())
+	}
+	defer c.Close()
+
+	if err = c.Verify(); err != nil {
+		log.Fatalln("Damaged executable:", err.Error())
+	}
+
+	var setup SetupScript
+	var launch LaunchScript
+	for name, v := range map[string]any{EmbededSetupScript: &setup, EmbededLaunchScript: &launch} {
+		r := c.Reader(name)
+		if r == nil {
+			log.Fatalf("The executable has no %s script.", name)
+		}
+
+		if data, err := io.ReadAll(r); err != nil {
+			log.Fatalln("Failed to read script:", err.Error())
+		} else if err = json.Unmarshal(data, v); err != nil {
+			log.Fatalf("Malformed %s script: %s", name, err)
+		}
+	}
+
+	for _, setting := range settings {
+		if err = applyRepackSetting(&setup, &launch, setting); err != nil {
+			log.Fatalln(err.Error())
+		}
+	}
+
+	key := getContainerSigningKey(c, cmd)
+
+	attachments := make(map[string]io.Reader, 0)
+	for _, name := range c.List() {
+		attachments[name] = c.Reader(name)
+	}
+
+	for name, v := range map[string]any{EmbededSetupScript: setup, EmbededLaunchScript: launch} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			log.Fatalf("Failed to create %s script.", name)
+		}
+		attachments[name] = bytes.NewReader(data)
+	}
+
+	// the executable is only replaced once the new one is complete.
+	temp := output + ".repack"
+	_ = os.Remove(temp)
+
+	if err = embedReaders(file, temp, attachments, key); err != nil {
+		log.Fatalln(err.Error())
+	}
+	c.Close()
+
+	if err = os.Rename(temp, output); err != nil {
+		_ = os.Remove(temp)
+		log.Fatalln("Failed to write executable:", err.Error())
+	}
+
+	fmt.Printf("Repacked: %s\n", output)
+}
@@ -0,0 +1,231 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestApplyRepackSetting(t *testing.T) {
+	tests := []struct {
+		setting string
+		setup   SetupScript
+		launch  LaunchScript
+		err     string
+	}{
+		{setting: "install_path=/opt/app", setup: SetupScript{InstallDirectory: "/opt/app"}},
+		{setting: "target_name=app", setup: SetupScript{ExeName: "app"}},
+		{setting: `entry_point=["bin/app", "--verbose"]`, launch: LaunchScript{EntryPoint: []string{"bin/app", "--verbose"}}},
+		{setting: "entry_point=bin/app --verbose", launch: LaunchScript{EntryPoint: []string{"bin/app --verbose"}}},
+		{setting: "entry_point=", launch: LaunchScript{EntryPoint: []string{}}},
+		{setting: `executables=["bin/app", "bin/tool"]`, setup: SetupScript{Executables: []string{"bin/app", "bin/tool"}}},
+		{setting: `pre_install_cmds=["mkdir data"]`, setup: SetupScript{PreInstallCommands: []string{"mkdir data"}}},
+		{setting: `post_install_cmds=["bin/app --init", "bin/app --check"]`, setup: SetupScript{PostInstallCommands: []string{"bin/app --init", "bin/app --check"}}},
+		{setting: "post_install_cmds=bin/app --init=yes", setup: SetupScript{PostInstallCommands: []string{"bin/app --init=yes"}}},
+		{setting: `entry_point=["bin/app"`, err: "invalid value for entry_point"},
+		{setting: "entry_point", err: "is not of the form key=value"},
+		{setting: "relocations=[]", err: `"relocations" cannot be changed`},
+		{setting: "key_env=KEY", err: `"key_env" cannot be changed`},
+		{setting: "InstallDirectory=/opt/app", err: `"InstallDirectory" cannot be changed`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.setting, func(t *testing.T) {
+			var setup SetupScript
+			var launch LaunchScript
+
+			err := applyRepackSetting(&setup, &launch, tt.setting)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotSetup, _ := json.Marshal(setup)
+			wantSetup, _ := json.Marshal(tt.setup)
+			if !bytes.Equal(gotSetup, wantSetup) {
+				t.Errorf("setup = %s, want %s", gotSetup, wantSetup)
+			}
+			if !slices.Equal(launch.EntryPoint, tt.launch.EntryPoint) || (launch.EntryPoint == nil) != (tt.launch.EntryPoint == nil) {
+				t.Errorf("entry point = %q, want %q", launch.EntryPoint, tt.launch.EntryPoint)
+			}
+		})
+	}
+}
+
+// writeRepackTestExecutable writes an executable with the stub, an
+// archive and the scripts, and returns its path and archive.
+func writeRepackTestExecutable(t *testing.T, stub string) (string, []byte) {
+	t.Helper()
+
+	archive := make([]byte, 100<<10)
+	rand.New(rand.NewSource(1)).Read(archive)
+
+	setup, _ := json.Marshal(SetupScript{InstallDirectory: "MyApp", ExeName: "app", PostInstallCommands: []string{"bin/app --init"}})
+	launch, _ := json.Marshal(LaunchScript{EntryPoint: []string{"bin/app"}})
+
+	var out bytes.Buffer
+	out.WriteString(stub)
+	attachments := map[string]io.Reader{
+		EmbededArchiveName:  bytes.NewReader(archive),
+		EmbededSetupScript:  bytes.NewReader(setup),
+		EmbededLaunchScript: bytes.NewReader(launch),
+	}
+	if err := writeContainer(&out, int64(len(stub)), attachments, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "app")
+	if err := os.WriteFile(file, out.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return file, archive
+}
+
+// readRepackTestScripts opens the executable and reads its scripts.
+func readRepackTestScripts(t *testing.T, file string) (*Container, SetupScript, LaunchScript) {
+	t.Helper()
+
+	c, err := OpenContainer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	var setup SetupScript
+	var launch LaunchScript
+	for name, v := range map[string]any{EmbededSetupScript: &setup, EmbededLaunchScript: &launch} {
+		data, _ := io.ReadAll(c.Reader(name))
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return c, setup, launch
+}
+
+func TestRepack(t *testing.T) {
+	file, archive := writeRepackTestExecutable(t, testStub)
+
+	for _, output := range []string{file + ".new", file} {
+		Repack(CommandLine{}, file, output, []string{
+			"install_path=/opt/app",
+			`entry_point=["bin/app", "--verbose"]`,
+			"post_install_cmds=bin/app --setup",
+		})
+
+		c, setup, launch := readRepackTestScripts(t, output)
+		defer c.Close()
+
+		if data, _ := io.ReadAll(c.Reader(EmbededArchiveName)); !bytes.Equal(data, archive) {
+			t.Errorf("%s: archive changed", output)
+		}
+		if stub, _ := io.ReadAll(c.Stub()); string(stub) != testStub {
+			t.Errorf("%s: stub = %q, want %q", output, stub, testStub)
+		}
+
+		if setup.InstallDirectory != "/opt/app" || setup.ExeName != "app" || !slices.Equal(setup.PostInstallCommands, []string{"bin/app --setup"}) {
+			t.Errorf("%s: setup = %+v", output, setup)
+		}
+		if !slices.Equal(launch.EntryPoint, []string{"bin/app", "--verbose"}) {
+			t.Errorf("%s: entry point = %q", output, launch.EntryPoint)
+		}
+	}
+
+	if _, err := os.Stat(file + ".repack"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+// writeRepackTestKey writes a new signing key and returns its file and
+// public key.
+func writeRepackTestKey(t *testing.T) (string, ed25519.PublicKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file, public
+}
+
+func TestRepackPinnedKey(t *testing.T) {
+	if dir := os.Getenv("EXWRAP_TEST_REPACK"); dir != "" {
+		file := filepath.Join(dir, "app")
+		Repack(CommandLine{SignKey: os.Getenv("EXWRAP_TEST_REPACK_KEY")}, file, file, []string{"install_path=/opt/app"})
+		return
+	}
+
+	key, public := writeRepackTestKey(t)
+	otherKey, _ := writeRepackTestKey(t)
+	stub := testStub + pinnedKeyMarker + hex.EncodeToString(public) + "\n"
+
+	tests := []struct {
+		name   string
+		key    string
+		output string
+	}{
+		{"no signing key", "", "The stub has a pinned public key but no signing key was given"},
+		{"another signing key", otherKey, "The signing key does not match the public key pinned into the stub."},
+		{"pinned signing key", key, "Repacked:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, _ := writeRepackTestExecutable(t, stub)
+			before, _ := os.ReadFile(file)
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestRepackPinnedKey$")
+			cmd.Env = append(os.Environ(), "EXWRAP_TEST_REPACK="+filepath.Dir(file), "EXWRAP_TEST_REPACK_KEY="+tt.key)
+			out, err := cmd.CombinedOutput()
+			if !strings.Contains(string(out), tt.output) || (err == nil) != (tt.key == key) {
+				t.Fatalf("error = %v\n%s", err, out)
+			}
+
+			c, setup, _ := readRepackTestScripts(t, file)
+			defer c.Close()
+
+			if tt.key != key {
+				if after, _ := os.ReadFile(file); !bytes.Equal(after, before) {
+					t.Error("executable changed")
+				}
+				return
+			}
+
+			if setup.InstallDirectory != "/opt/app" {
+				t.Errorf("install directory = %q, want /opt/app", setup.InstallDirectory)
+			}
+			if err := c.VerifySignature([]ed25519.PublicKey{public}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -6,6 +6,10 @@ type SetupScript struct {
 	Executables         []string `json:"executables"`
 	PreInstallCommands  []string `json:"pre_install_cmds"`
 	PostInstallCommands []string `json:"post_install_cmds"`
+	Relocations         []string `json:"relocations,omitempty"`
+	KeyEnv              string   `json:"key_env,omitempty"`
+	KeyFile             string   `json:"key_file,omitempty"`
+	KeyPrompt           bool     `json:"key_prompt,omitempty"`
 }
 
 type LaunchScript struct {
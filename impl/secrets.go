@@ -0,0 +1,165 @@
+package impl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Only the start of a file is looked into for secrets, and only when
+// there is no NUL byte in its first few KB (i.e. it is not binary).
+const (
+	secretScanSize  = 1 << 20
+	secretSniffSize = 8 << 10
+)
+
+// File names (matched against the base name) that usually hold secrets.
+var secretFileNames = []struct {
+	pattern string
+	reason  string
+}{
+	{".env", "environment file"},
+	{".env.*", "environment file"},
+	{"id_rsa", "SSH private key"},
+	{"id_dsa", "SSH private key"},
+	{"id_ecdsa", "SSH private key"},
+	{"id_ed25519", "SSH private key"},
+	{"*.pem", "PEM file"},
+	{"*.key", "private key"},
+	{"*.p12", "PKCS #12 file"},
+	{"*.pfx", "PKCS #12 file"},
+	{".netrc", "netrc file"},
+	{".pgpass", "PostgreSQL password file"},
+	{".git-credentials", "Git credentials"},
+}
+
+// Environment files that only document the variables.
+var secretFileNameExceptions = []string{".env.example", ".env.sample", ".env.template", ".env.dist"}
+
+var secretPatterns = []struct {
+	reason  string
+	pattern *regexp.Regexp
+}{
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA|AGPA|AIDA|AROA)[A-Z0-9]{16}\b`)},
+	{"private key", regexp.MustCompile(`-----BEGIN ([A-Z]+ )?PRIVATE KEY-----`)},
+	{"Django SECRET_KEY", regexp.MustCompile(`\bSECRET_KEY\s*=\s*[rb]?['"][^'"\n]{16,}['"]`)},
+}
+
+// getSecretFileReason returns why the file at dest is likely a secret
+// judging by its name, if it is.
+func getSecretFileReason(dest string) string {
+	name := path.Base(dest)
+	if stringListContains(secretFileNameExceptions, name) {
+		return ""
+	}
+
+	for _, x := range secretFileNames {
+		if ok, _ := path.Match(x.pattern, name); ok {
+			return x.reason
+		}
+	}
+
+	return ""
+}
+
+// getSecretContentReason returns why the content of the entry likely
+// holds a secret, if it does. Binary files are not looked into.
+func getSecretContentReason(entry payloadEntry) (string, error) {
+	file, err := entry.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// only the head is read to tell binary files apart.
+	head := make([]byte, secretSniffSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if bytes.IndexByte(head[:n], 0) >= 0 {
+		return "", nil
+	}
+
+	rest, err := io.ReadAll(io.LimitReader(file, secretScanSize-int64(n)))
+	if err != nil {
+		return "", err
+	}
+	data := append(head[:n], rest...)
+
+	for _, x := range secretPatterns {
+		if x.pattern.Match(data) {
+			return x.reason, nil
+		}
+	}
+
+	return "", nil
+}
+
+// getSecrets returns the entries that likely hold secrets along with
+// the reason. Entries matching secrets_allow are skipped.
+func getSecrets(config Config, entries []payloadEntry) []string {
+	secrets := make([]string, 0)
+	gitDirs := make(map[string]bool, 0)
+
+	for _, entry := range entries {
+		dest := path.Clean(filepath.ToSlash(entry.Dest))
+
+		allowed := false
+		for _, pattern := range config.SecretsAllow {
+			if _, ok := matchGlobPath(pattern, dest); ok {
+				allowed = true
+				break
+			}
+		}
+		if allowed {
+			continue
+		}
+
+		// repositories are reported once rather than file by file.
+		if i := strings.Index("/"+dest+"/", "/.git/"); i >= 0 {
+			dir := path.Join(dest[:i], ".git")
+			if !gitDirs[dir] {
+				gitDirs[dir] = true
+				secrets = append(secrets, fmt.Sprintf("%s (Git repository)", dir))
+			}
+			continue
+		}
+
+		reason := getSecretFileReason(dest)
+		if reason == "" {
+			var err error
+			if reason, err = getSecretContentReason(entry); err != nil {
+				log.Fatalln("Failed to scan file for secrets:", err.Error())
+			}
+		}
+
+		if reason != "" {
+			secrets = append(secrets, fmt.Sprintf("%s => %s (%s)", entry.Source, dest, reason))
+		}
+	}
+
+	return secrets
+}
+
+// scanSecrets reports the entries that likely hold secrets, failing the
+// build if the secrets policy says so.
+func scanSecrets(config Config, entries []payloadEntry) {
+	if config.SecretsPolicy == "off" {
+		return
+	}
+
+	secrets := getSecrets(config, entries)
+	for _, secret := range secrets {
+		fmt.Printf("Possible secret: %s\n", secret)
+	}
+
+	if len(secrets) > 0 && config.SecretsPolicy == "error" {
+		log.Fatalf("Found %d possible secret(s). Add them to secrets_allow if they are meant to be shipped.", len(secrets))
+	}
+}
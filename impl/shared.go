@@ -10,38 +10,9 @@ import (
 	"runtime"
 )
 
-var cachedInstallExtractDir string = ""
 var cachedInstallDir string = ""
 var cachedLaunchCommand []string = []string{}
 
-func GetInstallExtractDir() string {
-	if cachedInstallExtractDir == "" {
-		if dir, err := os.Getwd(); err == nil {
-			if runtime.GOOS == "windows" {
-				cachedInstallExtractDir = path.Join(dir, WinTmpExtractDir)
-			} else {
-				cachedInstallExtractDir = path.Join(dir, TmpExtractDir)
-			}
-		} else {
-			cachedInstallExtractDir = WinTmpExtractDir
-		}
-	}
-
-	return cachedInstallExtractDir
-}
-
-func GetSelfInstallExtractFile() string {
-	if exe, err := os.Executable(); err == nil {
-		return path.Join(GetInstallExtractDir(), path.Base(exe))
-	}
-
-	return ""
-}
-
-func GetInstallExtractFile() string {
-	return path.Join(GetInstallExtractDir(), ExtractDstFile)
-}
-
 func GetInstallDir(installPath string) string {
 	if cachedInstallDir == "" {
 		if filepath.IsAbs(installPath) {
@@ -98,6 +69,10 @@ func GetLaunchScript(installPath string) string {
 	return path.Join(GetInstallDir(installPath), fmt.Sprintf("%s.launch", GetAppName()))
 }
 
+func GetRelocationsScript(installPath string) string {
+	return path.Join(GetInstallDir(installPath), fmt.Sprintf("%s.relocate", GetAppName()))
+}
+
 func GetLaunchCommand(installPath string) []string {
 	if len(cachedLaunchCommand) == 0 {
 		launchFile := GetLaunchScript(installPath)
@@ -0,0 +1,182 @@
+package impl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A sidecar holds the archive of an executable in files next to it
+// rather than in it, split into volumes when it is too large. The
+// executable carries the list of volumes with their hashes (which are
+// signed along with the other attachments).
+type SidecarVolume struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type SidecarManifest struct {
+	Volumes []SidecarVolume `json:"volumes"`
+}
+
+// Sidecar reads the volumes of a sidecar as one.
+type Sidecar struct {
+	files   []*os.File
+	offsets []int64
+	size    int64
+}
+
+// writeSidecar copies the file at src into volumes of at most
+// volumeSize bytes (or a single one when zero) named after name in dir.
+func writeSidecar(src string, dir string, name string, volumeSize int64) (SidecarManifest, error) {
+	manifest := SidecarManifest{Volumes: make([]SidecarVolume, 0)}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return manifest, err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return manifest, err
+	}
+
+	if volumeSize <= 0 || stat.Size() <= volumeSize {
+		volumeSize = max(stat.Size(), 1)
+	}
+
+	count := (stat.Size() + volumeSize - 1) / volumeSize
+	for i := int64(0); i == 0 || i < count; i++ {
+		volume := SidecarVolume{Name: name}
+		if count > 1 {
+			volume.Name = fmt.Sprintf("%s.%03d", name, i+1)
+		}
+
+		out, err := os.Create(filepath.Join(dir, volume.Name))
+		if err != nil {
+			return manifest, err
+		}
+
+		hash := sha256.New()
+		volume.Size, err = io.CopyN(io.MultiWriter(out, hash), in, volumeSize)
+		if c := out.Close(); err == nil || err == io.EOF {
+			err = c
+		}
+		if err != nil {
+			return manifest, err
+		}
+
+		volume.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		manifest.Volumes = append(manifest.Volumes, volume)
+	}
+
+	return manifest, nil
+}
+
+// readSidecarManifest reads the list of volumes from the sidecar
+// attachment.
+func readSidecarManifest(r io.Reader) (SidecarManifest, error) {
+	var manifest SidecarManifest
+
+	data, err := io.ReadAll(r)
+	if err == nil {
+		err = json.Unmarshal(data, &manifest)
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("malformed sidecar manifest: %s", err)
+	}
+
+	if len(manifest.Volumes) == 0 {
+		return manifest, errors.New("malformed sidecar manifest: no volumes")
+	}
+
+	return manifest, nil
+}
+
+// openSidecar opens the volumes of the sidecar found in dir, checking
+// them against their size and hash.
+func openSidecar(manifest SidecarManifest, dir string) (*Sidecar, error) {
+	s := &Sidecar{}
+
+	for _, volume := range manifest.Volumes {
+		if filepath.Base(volume.Name) != volume.Name {
+			s.Close()
+			return nil, fmt.Errorf("illegal sidecar volume name: %s", volume.Name)
+		}
+
+		file, err := os.Open(filepath.Join(dir, volume.Name))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("missing sidecar volume %s (it must be next to the executable)", volume.Name)
+		}
+		s.files = append(s.files, file)
+
+		hash := sha256.New()
+		size, err := io.Copy(hash, file)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		if size != volume.Size || hex.EncodeToString(hash.Sum(nil)) != volume.SHA256 {
+			s.Close()
+			return nil, fmt.Errorf("sidecar volume %s is corrupt (checksum mismatch)", volume.Name)
+		}
+
+		s.offsets = append(s.offsets, s.size)
+		s.size += size
+	}
+
+	return s, nil
+}
+
+// Size returns the size of the sidecar, all of its volumes together.
+func (s *Sidecar) Size() int64 {
+	return s.size
+}
+
+func (s *Sidecar) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= s.size {
+			return n, io.EOF
+		}
+
+		// the volume holding pos.
+		i := sort.Search(len(s.offsets), func(i int) bool {
+			return s.offsets[i] > pos
+		}) - 1
+
+		end := s.size
+		if i+1 < len(s.offsets) {
+			end = s.offsets[i+1]
+		}
+
+		m, err := s.files[i].ReadAt(p[n:min(len(p), n+int(end-pos))], pos-s.offsets[i])
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		} else if m == 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+
+	return n, nil
+}
+
+func (s *Sidecar) Close() error {
+	for _, file := range s.files {
+		file.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package impl
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestSidecar writes 10000 random bytes as a sidecar of 4096 byte
+// volumes, and returns its directory, manifest and data.
+func writeTestSidecar(t *testing.T) (string, SidecarManifest, []byte) {
+	t.Helper()
+
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	src := filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	manifest, err := writeSidecar(src, dir, "app.data", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, manifest, data
+}
+
+func TestSidecar(t *testing.T) {
+	dir, manifest, data := writeTestSidecar(t)
+
+	names := make([]string, 0)
+	for _, volume := range manifest.Volumes {
+		names = append(names, volume.Name)
+	}
+	if got := strings.Join(names, " "); got != "app.data.001 app.data.002 app.data.003" {
+		t.Fatalf("volumes = %s", got)
+	}
+
+	// the manifest goes through the attachment.
+	encoded, _ := json.Marshal(manifest)
+	manifest, err := readSidecarManifest(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSidecar(manifest, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Size() != int64(len(data)) {
+		t.Errorf("size = %d, want %d", s.Size(), len(data))
+	}
+
+	tests := []struct {
+		name string
+		off  int64
+		size int
+	}{
+		{"first volume", 10, 100},
+		{"volume boundary", 4000, 200},
+		{"two volume boundaries", 4000, 5000},
+		{"last volume", 8192, 1808},
+		{"everything", 0, len(data)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]byte, tt.size)
+			if n, err := s.ReadAt(got, tt.off); n != tt.size || err != nil {
+				t.Fatalf("ReadAt = %d, %v", n, err)
+			}
+			if !bytes.Equal(got, data[tt.off:tt.off+int64(tt.size)]) {
+				t.Error("data mismatch")
+			}
+		})
+	}
+
+	// reading past the end returns what there is.
+	got := make([]byte, 100)
+	if n, err := s.ReadAt(got, int64(len(data))-50); n != 50 || err != io.EOF || !bytes.Equal(got[:n], data[len(data)-50:]) {
+		t.Errorf("ReadAt past the end = %d, %v", n, err)
+	}
+
+	// small archives take a single volume, named after the archive.
+	single, err := writeSidecar(filepath.Join(dir, "app.data.003"), t.TempDir(), "app.data", 0)
+	if err != nil || len(single.Volumes) != 1 || single.Volumes[0].Name != "app.data" || single.Volumes[0].Size != 1808 {
+		t.Errorf("single volume = %+v, %v", single, err)
+	}
+}
+
+func TestOpenSidecarRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(dir string, manifest *SidecarManifest)
+		err    string
+	}{
+		{
+			name: "corrupt volume",
+			change: func(dir string, manifest *SidecarManifest) {
+				file := filepath.Join(dir, "app.data.002")
+				data, _ := os.ReadFile(file)
+				data[100] ^= 1
+				os.WriteFile(file, data, 0644)
+			},
+			err: "sidecar volume app.data.002 is corrupt",
+		},
+		{
+			name: "truncated volume",
+			change: func(dir string, manifest *SidecarManifest) {
+				os.Truncate(filepath.Join(dir, "app.data.003"), 1000)
+			},
+			err: "sidecar volume app.data.003 is corrupt",
+		},
+		{
+			name: "missing volume",
+			change: func(dir string, manifest *SidecarManifest) {
+				os.Remove(filepath.Join(dir, "app.data.002"))
+			},
+			err: "missing sidecar volume app.data.002",
+		},
+		{
+			name: "parent directory",
+			change: func(dir string, manifest *SidecarManifest) {
+				manifest.Volumes[1].Name = "../app.data.002"
+			},
+			err: "illegal sidecar volume name: ../app.data.002",
+		},
+		{
+			name: "subdirectory",
+			change: func(dir string, manifest *SidecarManifest) {
+				os.Mkdir(filepath.Join(dir, "sub"), 0755)
+				os.Rename(filepath.Join(dir, "app.data.003"), filepath.Join(dir, "sub", "app.data.003"))
+				manifest.Volumes[2].Name = "sub/app.data.003"
+			},
+			err: "illegal sidecar volume name: sub/app.data.003",
+		},
+		{
+			name: "absolute path",
+			change: func(dir string, manifest *SidecarManifest) {
+				manifest.Volumes[0].Name = filepath.Join(dir, "app.data.001")
+			},
+			err: "illegal sidecar volume name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, manifest, _ := writeTestSidecar(t)
+			tt.change(dir, &manifest)
+
+			s, err := openSidecar(manifest, dir)
+			if err == nil {
+				s.Close()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The hex encoded Ed25519 public key wrapper stubs trust, compiled in
+// with -ldflags "-X github.com/mcfriend99/exwrap/impl.PublicKey=<hex>".
+var PublicKey = ""
+
+// Room in the stub for the public_key of the config, filled in when the
+// stub is copied into a build. It has to stay a single literal for it
+// to be found in the stub. Anyone able to change the payload can change
+// the key as well, so it only guards against tampering when the stub is
+// code signed by the OS (Authenticode, codesign).
+const pinnedKeyMarker = "exwrap-pinned-key:"
+
+var pinnedPublicKey = "exwrap-pinned-key:0000000000000000000000000000000000000000000000000000000000000000"
+
+// Signatures are made over the table of contents of the container
+// (which holds the hash of every attachment) prefixed with this.
+const signatureContext = "exwrap-signature-v1\x00"
+
+// The signature block follows the table of contents when the container
+// is signed. It holds the public key of the signer followed by the
+// signature.
+const signatureBlockSize = ed25519.PublicKeySize + ed25519.SignatureSize
+
+func parsePublicKey(text string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("public keys must be 32 bytes in hexadecimal")
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// LoadSigningKey reads a PEM encoded (PKCS #8) Ed25519 private key, as
+// created by "openssl genpkey -algorithm ed25519".
+func LoadSigningKey(file string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", file)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("%s is not an Ed25519 private key", file)
+}
+
+// GetTrustedKeys returns the public keys the stub accepts signatures
+// from: the one compiled in and the one pinned by the build.
+func GetTrustedKeys() ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, 0)
+
+	if PublicKey != "" {
+		key, err := parsePublicKey(PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	pinned := pinnedPublicKey[len(pinnedKeyMarker):]
+	if strings.Trim(pinned, "0") != "" {
+		key, err := parsePublicKey(pinned)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// pinPublicKey writes the public key into the key slot of the stub.
+// This makes the stub reject payloads signed with other keys, which is
+// no protection against tampering unless the stub is then code signed.
+// MacOS stubs with an ad-hoc signature are signed again, those signed
+// with an identity can't be pinned.
+func pinPublicKey(stub string, key ed25519.PublicKey) error {
+	data, err := os.ReadFile(stub)
+	if err != nil {
+		return err
+	}
+
+	slot := []byte(pinnedKeyMarker + strings.Repeat("0", 2*ed25519.PublicKeySize))
+	if !bytes.Contains(data, slot) {
+		return errors.New("the wrapper stub has no room for a pinned public key")
+	}
+
+	// universal stubs hold a slot for each architecture.
+	data = bytes.ReplaceAll(data, slot, []byte(pinnedKeyMarker+hex.EncodeToString(key)))
+
+	if isMachO(data) {
+		if data, err = resignMachO(data); err != nil {
+			return fmt.Errorf("the code signature of the wrapper stub can't be renewed: %s", err)
+		}
+	}
+
+	return os.WriteFile(stub, data, 0755)
+}
+
+// readPinnedKey returns the public key pinned into the stub, or an
+// empty string if there is none.
+func readPinnedKey(stub io.Reader) (string, error) {
+	data, err := io.ReadAll(stub)
+	if err != nil {
+		return "", err
+	}
+
+	// the marker may also be found on its own (E.g. as a constant).
+	for i := bytes.Index(data, []byte(pinnedKeyMarker)); i >= 0; {
+		start := i + len(pinnedKeyMarker)
+		if start+2*ed25519.PublicKeySize <= len(data) {
+			pinned := string(data[start : start+2*ed25519.PublicKeySize])
+			if _, err := parsePublicKey(pinned); err == nil {
+				if strings.Trim(pinned, "0") == "" {
+					return "", nil
+				}
+				return pinned, nil
+			}
+		}
+
+		next := bytes.Index(data[start:], []byte(pinnedKeyMarker))
+		if next < 0 {
+			break
+		}
+		i = start + next
+	}
+
+	return "", nil
+}
+
+func signContainer(key ed25519.PrivateKey, tocData []byte) []byte {
+	block := make([]byte, 0, signatureBlockSize)
+	block = append(block, key.Public().(ed25519.PublicKey)...)
+	return append(block, ed25519.Sign(key, append([]byte(signatureContext), tocData...))...)
+}
+
+// Signed reports whether the container carries a signature.
+func (c *Container) Signed() bool {
+	return c.trailer.Flags&containerFlagSigned != 0
+}
+
+// Signer returns the public key the container claims to be signed
+// with. It must not be trusted on its own.
+func (c *Container) Signer() ed25519.PublicKey {
+	if !c.Signed() {
+		return nil
+	}
+
+	return ed25519.PublicKey(c.signature[:ed25519.PublicKeySize])
+}
+
+// VerifySignature checks that the table of contents of the container
+// was signed by one of the keys.
+func (c *Container) VerifySignature(keys []ed25519.PublicKey) error {
+	if !c.Signed() {
+		return errors.New("the executable is not signed")
+	}
+
+	message := append([]byte(signatureContext), c.tocData...)
+	for _, key := range keys {
+		if ed25519.Verify(key, message, c.signature[ed25519.PublicKeySize:]) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the executable is not signed by a trusted key (signed by %s)", hex.EncodeToString(c.Signer()))
+}
@@ -0,0 +1,229 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"debug/macho"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a program with an empty key slot, like the wrapper stubs.
+const pinnedKeyProgram = `package main
+
+var slot = "exwrap-pinned-key:0000000000000000000000000000000000000000000000000000000000000000"
+
+func main() { println(slot) }
+`
+
+func TestPinPublicKey(t *testing.T) {
+	arm64 := buildDarwinProgram(t, "arm64", pinnedKeyProgram)
+	amd64 := buildDarwinProgram(t, "amd64", pinnedKeyProgram)
+
+	key, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := []byte(pinnedKeyMarker + hex.EncodeToString(key))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"signed arm64", arm64},
+		{"unsigned amd64", amd64},
+		{"universal", buildFatMachO([]fatSlice{
+			{Cpu: macho.CpuAmd64, SubCpu: 3, Align: 12, Data: amd64},
+			{Cpu: macho.CpuArm64, Align: 14, Data: arm64},
+		})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := filepath.Join(t.TempDir(), "stub")
+			if err := os.WriteFile(stub, tt.data, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := pinPublicKey(stub, key); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(stub)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, err := readPinnedKey(bytes.NewReader(data)); err != nil || got != hex.EncodeToString(key) {
+				t.Errorf("pinned key = %q (%v), want %x", got, err, key)
+			}
+
+			before, after := machoFatArches(t, tt.data), machoFatArches(t, data)
+			for i, slice := range after {
+				if !bytes.Contains(slice, pinned) {
+					t.Errorf("slice %d: key not pinned", i)
+				}
+
+				f, err := macho.NewFile(bytes.NewReader(slice))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				signature, err := readMachOSignature(slice, f.ByteOrder)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				old, _ := macho.NewFile(bytes.NewReader(before[i]))
+				if wasSigned, _ := readMachOSignature(before[i], old.ByteOrder); (signature != nil) != (wasSigned != nil) {
+					t.Errorf("slice %d: signed = %v, want %v", i, signature != nil, wasSigned != nil)
+				}
+
+				// the signature must match the pinned content.
+				if signature != nil {
+					signed, err := signMachOAdHoc(bytes.Clone(slice), signature)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(signed, slice) {
+						t.Errorf("slice %d: the signature does not match the pinned stub", i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPinPublicKeyIdentitySigned(t *testing.T) {
+	data := buildDarwinProgram(t, "arm64", pinnedKeyProgram)
+
+	// turn the ad-hoc signature into one made with an identity.
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := machoLoadCommands(data, f.ByteOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := findMachOLoadCommand(cmds, f.ByteOrder, machoCodeSignatureCommand)
+	blob := data[f.ByteOrder.Uint32(cmd[8:]):]
+	cd := blob[binary.BigEndian.Uint32(blob[16:]):]
+	binary.BigEndian.PutUint32(cd[12:], binary.BigEndian.Uint32(cd[12:])&^csAdHoc)
+
+	stub := filepath.Join(t.TempDir(), "stub")
+	if err := os.WriteFile(stub, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	key, _, _ := ed25519.GenerateKey(nil)
+	if err := pinPublicKey(stub, key); err == nil || !strings.Contains(err.Error(), "identity") {
+		t.Errorf("error = %v, want the identity signature refused", err)
+	}
+
+	if after, _ := os.ReadFile(stub); !bytes.Equal(after, data) {
+		t.Error("stub changed")
+	}
+}
+
+// writeSignedContainer writes a container signed with the key (or not
+// signed for a nil key) and returns its content.
+func writeSignedContainer(t *testing.T, key ed25519.PrivateKey) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	out.WriteString(testStub)
+
+	attachments := map[string]io.Reader{"a": bytes.NewReader([]byte("hello"))}
+	if err := writeContainer(&out, int64(len(testStub)), attachments, key); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()
+}
+
+func TestVerifySignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, otherPrivate, _ := ed25519.GenerateKey(nil)
+
+	// the keys the stub trusts.
+	defer func(old string) { PublicKey = old }(PublicKey)
+	PublicKey = hex.EncodeToString(public)
+	trusted, err := GetTrustedKeys()
+	if err != nil || len(trusted) != 1 || !trusted[0].Equal(public) {
+		t.Fatalf("trusted keys = %x (%v), want %x", trusted, err, public)
+	}
+
+	signed := writeSignedContainer(t, private)
+	tampered := bytes.Clone(signed)
+	i := bytes.Index(tampered, []byte(`"generator":"`)) + len(`"generator":"`)
+	tampered[i] ^= 0x01
+
+	tests := []struct {
+		name   string
+		data   []byte
+		signer ed25519.PublicKey
+		err    string
+	}{
+		{"signed with the right key", signed, public, ""},
+		{"signed with another key", writeSignedContainer(t, otherPrivate), otherPublic, "not signed by a trusted key"},
+		{"changed after signing", tampered, public, "not signed by a trusted key"},
+		{"not signed", writeSignedContainer(t, nil), nil, "not signed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "container")
+			if err := os.WriteFile(file, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := OpenContainer(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if !c.Signer().Equal(tt.signer) {
+				t.Errorf("signer = %x, want %x", c.Signer(), tt.signer)
+			}
+			if c.Signed() != (tt.signer != nil) {
+				t.Errorf("signed = %v", c.Signed())
+			}
+
+			err = c.VerifySignature(trusted)
+			if tt.err == "" && err != nil {
+				t.Errorf("signature rejected: %s", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSignContainer(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	toc := []byte(`{"generator":"dev","attachments":[]}`)
+
+	block := signContainer(private, toc)
+	if len(block) != signatureBlockSize || !bytes.Equal(block[:ed25519.PublicKeySize], public) {
+		t.Fatalf("signature block = %x", block)
+	}
+
+	// the signature is bound to the context, not just the contents.
+	signature := block[ed25519.PublicKeySize:]
+	if !ed25519.Verify(public, append([]byte(signatureContext), toc...), signature) {
+		t.Error("signature does not verify")
+	}
+	if ed25519.Verify(public, toc, signature) {
+		t.Error("signature verifies without its context")
+	}
+}
@@ -0,0 +1,689 @@
+package impl
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func isElf(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(elf.ELFMAG))
+}
+
+func isPE(head []byte) bool {
+	if len(head) < 0x40 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+
+	offset := binary.LittleEndian.Uint32(head[0x3c:])
+	return uint64(offset)+4 <= uint64(len(head)) && bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+func isDebugSectionName(name string) bool {
+	name = strings.TrimPrefix(name, "__")
+	return strings.HasPrefix(name, ".debug") ||
+		strings.HasPrefix(name, ".zdebug") ||
+		strings.HasPrefix(name, "debug_") ||
+		strings.HasPrefix(name, "zdebug_")
+}
+
+func matchStripFile(config Config, dest string, head []byte) bool {
+	return config.Strip && (isElf(head) || isMachO(head) || isPE(head))
+}
+
+func applyStrip(config Config, build *payloadBuild, dest string, data []byte) ([]byte, error) {
+	var stripped []byte
+	var err error
+
+	switch {
+	case isElf(data):
+		stripped, err = stripElf(data)
+	case isMachO(data):
+		stripped, err = stripMachO(data)
+	default:
+		stripped, err = stripPE(data)
+	}
+
+	// stripping is only an optimization, so the file goes in as is
+	// when it can't be done.
+	if err != nil {
+		fmt.Printf("Could not strip %s: %s\n", dest, err.Error())
+		return data, nil
+	}
+
+	if saved := len(data) - len(stripped); saved > 0 {
+		fmt.Printf("Stripped: %s (%d bytes saved)\n", dest, saved)
+		build.strippedBytes += int64(saved)
+	}
+
+	return stripped, nil
+}
+
+// stripElf removes the debug sections and symbol tables of ELF
+// executables and shared libraries. Whatever the program headers cover
+// is left untouched; the remaining unloaded sections are moved down to
+// fill the gaps and a new section header table is written after them.
+func stripElf(data []byte) ([]byte, error) {
+	e, err := newElfImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	fileType := elf.Type(e.get(16, 2))
+	if fileType != elf.ET_EXEC && fileType != elf.ET_DYN {
+		return data, nil
+	}
+
+	shnum := e.shnum()
+	shstrndx := e.shstrndx()
+	if shnum == 0 || shstrndx >= shnum {
+		return data, nil
+	}
+
+	sections := make([]elfSection, shnum)
+	for i := range sections {
+		sections[i] = e.section(i)
+	}
+
+	names := sections[shstrndx]
+	sectionName := func(s elfSection) string {
+		off := names.Off + uint64(s.Name)
+		if off >= uint64(len(data)) {
+			return ""
+		}
+
+		name := data[off:]
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+		return string(name)
+	}
+
+	// data appended to the file (E.g. a self extracting payload) must
+	// not be lost, so such files are left alone.
+	end := e.shoff() + uint64(shnum*e.shentsize())
+	for i := 0; i < e.phnum(); i++ {
+		if p := e.prog(i); p.Off+p.Filesz > end {
+			end = p.Off + p.Filesz
+		}
+	}
+	for _, s := range sections {
+		if s.Type != elf.SHT_NOBITS && s.Off+s.Size > end {
+			end = s.Off + s.Size
+		}
+	}
+	if end < uint64(len(data)) {
+		return nil, errors.New("unknown data at the end of the file")
+	} else if end > uint64(len(data)) {
+		return nil, errors.New("truncated ELF file")
+	}
+
+	remove := make([]bool, shnum)
+	removed := false
+	for i, s := range sections {
+		if i == 0 || i == shstrndx || s.Flags&uint64(elf.SHF_ALLOC) != 0 {
+			continue
+		}
+
+		if s.Type == elf.SHT_SYMTAB || isDebugSectionName(sectionName(s)) {
+			remove[i] = true
+			removed = true
+		}
+	}
+
+	if !removed {
+		return data, nil
+	}
+
+	// relocations of removed sections and the string tables nothing
+	// else refers to go as well.
+	for i, s := range sections {
+		if s.Flags&uint64(elf.SHF_ALLOC) == 0 && (s.Type == elf.SHT_REL || s.Type == elf.SHT_RELA) &&
+			int(s.Info) < shnum && remove[s.Info] {
+			remove[i] = true
+		}
+	}
+	for i, s := range sections {
+		if remove[i] || i == shstrndx || s.Type != elf.SHT_STRTAB || s.Flags&uint64(elf.SHF_ALLOC) != 0 {
+			continue
+		}
+
+		usedByRemoved, usedByKept := false, false
+		for j, x := range sections {
+			if int(x.Link) == i {
+				if remove[j] {
+					usedByRemoved = true
+				} else {
+					usedByKept = true
+				}
+			}
+		}
+
+		if usedByRemoved && !usedByKept {
+			remove[i] = true
+		}
+	}
+
+	// everything up to the end of the last segment stays in place.
+	keepEnd := uint64(e.phoff()) + uint64(e.phnum()*e.phentsize())
+	for i := 0; i < e.phnum(); i++ {
+		if p := e.prog(i); p.Off+p.Filesz > keepEnd {
+			keepEnd = p.Off + p.Filesz
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for i, s := range sections {
+			if !remove[i] && s.Type != elf.SHT_NOBITS && s.Off < keepEnd && s.Off+s.Size > keepEnd {
+				keepEnd = s.Off + s.Size
+				changed = true
+			}
+		}
+	}
+
+	out := make([]byte, keepEnd, len(data))
+	copy(out, data[:keepEnd])
+
+	newIndex := make([]uint32, shnum)
+	kept := make([]elfSection, 0, shnum)
+
+	for i, s := range sections {
+		if remove[i] {
+			continue
+		}
+
+		newIndex[i] = uint32(len(kept))
+
+		if i > 0 && s.Type != elf.SHT_NOBITS && s.Off >= keepEnd {
+			align := s.Addralign
+			if align == 0 {
+				align = 1
+			}
+
+			offset := alignUp(uint64(len(out)), align)
+			out = append(out, make([]byte, offset-uint64(len(out)))...)
+			out = append(out, data[s.Off:s.Off+s.Size]...)
+			s.Off = offset
+		}
+
+		kept = append(kept, s)
+	}
+
+	for i := range kept {
+		if kept[i].Link != 0 {
+			if int(kept[i].Link) >= shnum {
+				return nil, fmt.Errorf("section link to missing section %d", kept[i].Link)
+			}
+			kept[i].Link = newIndex[kept[i].Link]
+		}
+
+		if kept[i].Type == elf.SHT_REL || kept[i].Type == elf.SHT_RELA || kept[i].Flags&uint64(elf.SHF_INFO_LINK) != 0 {
+			if int(kept[i].Info) >= shnum {
+				return nil, fmt.Errorf("section info link to missing section %d", kept[i].Info)
+			}
+			kept[i].Info = newIndex[kept[i].Info]
+		}
+	}
+
+	shoff := alignUp(uint64(len(out)), uint64(e.wordSize()))
+	out = append(out, make([]byte, shoff-uint64(len(out))+uint64(len(kept)*e.shentsize()))...)
+
+	stripped := &elfImage{data: out, order: e.order, is64: e.is64}
+	stripped.setHeaderField(0x20, 0x28, e.wordSize(), shoff)
+	stripped.setHeaderField(0x30, 0x3c, 2, uint64(len(kept)))
+	stripped.setHeaderField(0x32, 0x3e, 2, uint64(newIndex[shstrndx]))
+
+	for i, s := range kept {
+		stripped.setSection(i, s)
+	}
+
+	return stripped.data, nil
+}
+
+// stripMachO removes the __DWARF segment and the local symbols of
+// Mach-O files (thin or fat). Files with an ad-hoc signature (which the
+// linker gives everything built for Apple Silicon) are signed again, but
+// files signed with an identity are left alone.
+func stripMachO(data []byte) ([]byte, error) {
+	return mapMachOSlices(data, stripMachOSlice)
+}
+
+func stripMachOSlice(data []byte) ([]byte, error) {
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	signature, err := readMachOSignature(data, f.ByteOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	linkedit := f.Segment("__LINKEDIT")
+	if linkedit == nil || linkedit.Offset+linkedit.Filesz < uint64(len(data)) {
+		return nil, errors.New("unknown data at the end of the file")
+	}
+
+	stripped, err := stripMachODwarf(data)
+	if err != nil {
+		return nil, err
+	}
+	if stripped, err = stripMachOSymbols(stripped); err != nil {
+		return nil, err
+	}
+
+	if len(stripped) == len(data) {
+		return data, nil
+	}
+	if signature != nil {
+		return signMachOAdHoc(stripped, signature)
+	}
+
+	return stripped, nil
+}
+
+// stripMachODwarf removes the __DWARF segment by moving __LINKEDIT (the
+// only thing that may follow it) down in its place.
+func stripMachODwarf(data []byte) ([]byte, error) {
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dwarf, linkedit := f.Segment("__DWARF"), f.Segment("__LINKEDIT")
+	if dwarf == nil || dwarf.Filesz == 0 {
+		return data, nil
+	}
+	if linkedit == nil || linkedit.Offset < dwarf.Offset+dwarf.Filesz {
+		return nil, errors.New("unsupported segment layout")
+	}
+
+	for _, load := range f.Loads {
+		if seg, ok := load.(*macho.Segment); ok && seg != dwarf && seg != linkedit &&
+			seg.Filesz > 0 && seg.Offset >= dwarf.Offset {
+			return nil, errors.New("unsupported segment layout")
+		}
+	}
+
+	// segments must stay page aligned in the file.
+	page := uint64(0x1000)
+	if f.Cpu == macho.CpuArm64 {
+		page = 0x4000
+	}
+
+	newOffset := alignUp(dwarf.Offset, page)
+	if newOffset >= linkedit.Offset {
+		return data, nil
+	}
+	shift := linkedit.Offset - newOffset
+
+	headerSize := uint64(28)
+	if f.Magic == macho.Magic64 {
+		headerSize = 32
+	}
+
+	cmds := make([]byte, 0, f.Cmdsz)
+	ncmds := uint32(0)
+
+	for _, load := range f.Loads {
+		if load == dwarf {
+			continue
+		}
+
+		raw := append([]byte{}, load.Raw()...)
+		shiftMachOLinkeditOffsets(f.ByteOrder, raw, linkedit.Offset, shift)
+
+		if load == linkedit {
+			if f.Magic == macho.Magic64 {
+				f.ByteOrder.PutUint64(raw[40:], newOffset)
+			} else {
+				f.ByteOrder.PutUint32(raw[32:], uint32(newOffset))
+			}
+		}
+
+		cmds = append(cmds, raw...)
+		ncmds++
+	}
+
+	out := make([]byte, 0, uint64(len(data))-shift)
+	out = append(out, data[:newOffset]...)
+	out = append(out, data[linkedit.Offset:]...)
+
+	clear(out[dwarf.Offset:newOffset])
+	copy(out[headerSize:], cmds)
+	clear(out[headerSize+uint64(len(cmds)) : headerSize+uint64(f.Cmdsz)])
+	f.ByteOrder.PutUint32(out[16:], ncmds)
+	f.ByteOrder.PutUint32(out[20:], uint32(len(cmds)))
+
+	return out, nil
+}
+
+// stripMachOSymbols removes the local symbols (debugging symbols
+// included) of 64-bit Mach-O files, much like `strip -x` does. Local
+// symbols come first in the symbol table, so the ones left only move
+// down and the indirect symbol table is updated to match. The string
+// table is rebuilt with the names still in use.
+func stripMachOSymbols(data []byte) ([]byte, error) {
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if f.Magic != macho.Magic64 || f.Symtab == nil || f.Dysymtab == nil || f.Dysymtab.Nlocalsym == 0 {
+		return data, nil
+	}
+
+	// debug/macho leaves the symtab command itself empty.
+	order := f.ByteOrder
+	raw := f.Symtab.Raw()
+	symtab := macho.SymtabCmd{
+		Symoff:  order.Uint32(raw[8:]),
+		Nsyms:   order.Uint32(raw[12:]),
+		Stroff:  order.Uint32(raw[16:]),
+		Strsize: order.Uint32(raw[20:]),
+	}
+	dysymtab := f.Dysymtab.DysymtabCmd
+
+	// these refer to symbols by their index too.
+	if dysymtab.Ilocalsym != 0 || dysymtab.Ntoc != 0 || dysymtab.Nmodtab != 0 ||
+		dysymtab.Nextrefsyms != 0 || dysymtab.Nextrel != 0 {
+		return nil, errors.New("unsupported symbol table layout")
+	}
+
+	const nlistSize = 16
+	symoff, nsyms := uint64(symtab.Symoff), uint64(symtab.Nsyms)
+	stroff, strsize := uint64(symtab.Stroff), uint64(symtab.Strsize)
+	nlocal := uint64(dysymtab.Nlocalsym)
+	indirect, nindirect := uint64(dysymtab.Indirectsymoff), uint64(dysymtab.Nindirectsyms)
+
+	if nlocal > nsyms || symoff+nsyms*nlistSize > uint64(len(data)) || stroff+strsize > uint64(len(data)) ||
+		indirect+nindirect*4 > uint64(len(data)) {
+		return nil, errors.New("truncated symbol table")
+	}
+
+	out := bytes.Clone(data)
+
+	for x := indirect; x < indirect+nindirect*4; x += 4 {
+		// INDIRECT_SYMBOL_LOCAL and INDIRECT_SYMBOL_ABS
+		v := uint64(order.Uint32(out[x:]))
+		if v&0xc0000000 != 0 {
+			continue
+		}
+		if v < nlocal {
+			return nil, errors.New("indirect symbols refer to local symbols")
+		}
+		order.PutUint32(out[x:], uint32(v-nlocal))
+	}
+
+	strtab := data[stroff : stroff+strsize]
+	newStrtab := []byte(" \x00")
+	names := make(map[string]uint32, 0)
+	symbols := bytes.Clone(data[symoff+nlocal*nlistSize : symoff+nsyms*nlistSize])
+
+	for x := 0; x < len(symbols); x += nlistSize {
+		strx := uint64(order.Uint32(symbols[x:]))
+		if strx == 0 {
+			continue
+		}
+		if strx >= strsize {
+			return nil, errors.New("symbol name outside of the string table")
+		}
+
+		name := strtab[strx:]
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+
+		index, ok := names[string(name)]
+		if !ok {
+			index = uint32(len(newStrtab))
+			names[string(name)] = index
+			newStrtab = append(append(newStrtab, name...), 0)
+		}
+		order.PutUint32(symbols[x:], index)
+	}
+
+	// the linker may share the tails of names, so the new table isn't
+	// necessarily smaller. The old one is kept then.
+	if uint64(len(newStrtab)) >= strsize {
+		symbols = data[symoff+nlocal*nlistSize : symoff+nsyms*nlistSize]
+		newStrtab = strtab
+	}
+
+	copy(out[symoff:], symbols)
+	copy(out[stroff:], newStrtab)
+
+	// the cuts keep whatever follows 16 byte aligned.
+	strCut := (strsize - uint64(len(newStrtab))) &^ 15
+	clear(out[stroff+uint64(len(newStrtab)) : stroff+strsize-strCut])
+
+	cmds, err := machoLoadCommands(out, order)
+	if err != nil {
+		return nil, err
+	}
+
+	symtabCmd := findMachOLoadCommand(cmds, order, macho.LoadCmdSymtab)
+	order.PutUint32(symtabCmd[12:], uint32(nsyms-nlocal))
+	order.PutUint32(symtabCmd[20:], uint32(strsize-strCut))
+
+	dysymtabCmd := findMachOLoadCommand(cmds, order, macho.LoadCmdDysymtab)
+	order.PutUint32(dysymtabCmd[12:], 0)
+	for _, field := range []int{16, 24} {
+		if v := uint64(order.Uint32(dysymtabCmd[field:])); v >= nlocal {
+			order.PutUint32(dysymtabCmd[field:], uint32(v-nlocal))
+		}
+	}
+
+	cuts := [][2]uint64{
+		{stroff + strsize - strCut, stroff + strsize},
+		{symoff + (nsyms-nlocal)*nlistSize, symoff + nsyms*nlistSize},
+	}
+	if symoff > stroff {
+		cuts[0], cuts[1] = cuts[1], cuts[0]
+	}
+
+	for _, cut := range cuts {
+		if out, err = cutMachOLinkedit(out, order, cut[0], cut[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// shiftMachOLinkeditOffsets moves the file offsets held by a load
+// command that point into __LINKEDIT down by shift bytes.
+func shiftMachOLinkeditOffsets(order binary.ByteOrder, raw []byte, linkedit uint64, shift uint64) {
+	var fields []int
+
+	switch cmd := order.Uint32(raw); cmd {
+	case 0x2: // LC_SYMTAB
+		fields = []int{8, 16}
+	case 0xb: // LC_DYSYMTAB
+		fields = []int{32, 40, 48, 56, 64, 72}
+	case 0x22, 0x80000022: // LC_DYLD_INFO(_ONLY)
+		fields = []int{8, 16, 24, 32, 40}
+	case 0x1d, 0x1e, 0x26, 0x29, 0x2b, 0x2e, 0x80000033, 0x80000034:
+		// linkedit_data_command based commands
+		fields = []int{8}
+	}
+
+	for _, field := range fields {
+		if field+4 > len(raw) {
+			continue
+		}
+
+		if v := uint64(order.Uint32(raw[field:])); v >= linkedit {
+			order.PutUint32(raw[field:], uint32(v-shift))
+		}
+	}
+}
+
+// stripPE drops the raw data of the debug sections and the COFF symbol
+// table of PE files, moving the sections that follow down. The virtual
+// layout of the image doesn't change. Signed files are left alone.
+func stripPE(data []byte) ([]byte, error) {
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	peOffset := uint64(binary.LittleEndian.Uint32(data[0x3c:]))
+	coffOffset := peOffset + 4
+	optionalOffset := coffOffset + 20
+	sectionsOffset := optionalOffset + uint64(f.FileHeader.SizeOfOptionalHeader)
+
+	var fileAlignment uint32
+	var dirs []pe.DataDirectory
+	var checksumOffset uint64
+
+	switch h := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		fileAlignment = h.FileAlignment
+		dirs = h.DataDirectory[:h.NumberOfRvaAndSizes]
+		checksumOffset = optionalOffset + 64
+	case *pe.OptionalHeader64:
+		fileAlignment = h.FileAlignment
+		dirs = h.DataDirectory[:h.NumberOfRvaAndSizes]
+		checksumOffset = optionalOffset + 64
+	default:
+		return nil, errors.New("missing optional header")
+	}
+
+	if len(dirs) > pe.IMAGE_DIRECTORY_ENTRY_SECURITY && dirs[pe.IMAGE_DIRECTORY_ENTRY_SECURITY].Size > 0 {
+		return nil, errors.New("the file is signed")
+	}
+	if fileAlignment == 0 {
+		fileAlignment = 0x200
+	}
+
+	symbols := uint64(f.FileHeader.PointerToSymbolTable)
+	symbolsEnd := symbols
+	if symbols > 0 {
+		symbolsEnd = symbols + uint64(f.FileHeader.NumberOfSymbols)*pe.COFFSymbolSize + 4 + uint64(len(f.StringTable))
+	}
+
+	end := symbolsEnd
+	for _, s := range f.Sections {
+		if x := uint64(s.Offset) + uint64(s.Size); x > end {
+			end = x
+		}
+	}
+	if end < uint64(len(data)) {
+		return nil, errors.New("unknown data at the end of the file")
+	}
+
+	type peSection struct {
+		index  int
+		offset uint64
+		size   uint64
+		strip  bool
+	}
+
+	sections := make([]peSection, 0, len(f.Sections))
+	for i, s := range f.Sections {
+		if s.Size == 0 {
+			continue
+		}
+
+		// go places its symbol table in a section of its own.
+		strip := isDebugSectionName(s.Name) ||
+			(symbols > 0 && symbols >= uint64(s.Offset) && symbols < uint64(s.Offset)+uint64(s.Size))
+
+		sections = append(sections, peSection{i, uint64(s.Offset), uint64(s.Size), strip})
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].offset < sections[j].offset })
+
+	if len(sections) == 0 {
+		return data, nil
+	}
+
+	out := append([]byte{}, data[:sections[0].offset]...)
+	moved := make(map[int]uint64, 0)
+
+	for _, s := range sections {
+		header := sectionsOffset + uint64(s.index)*40
+
+		if s.strip {
+			// PointerToRawData and SizeOfRawData
+			binary.LittleEndian.PutUint32(out[header+20:], 0)
+			binary.LittleEndian.PutUint32(out[header+16:], 0)
+			continue
+		}
+
+		offset := alignUp(uint64(len(out)), uint64(fileAlignment))
+		out = append(out, make([]byte, offset-uint64(len(out)))...)
+		out = append(out, data[s.offset:s.offset+s.size]...)
+
+		binary.LittleEndian.PutUint32(out[header+20:], uint32(offset))
+		moved[s.index] = offset
+	}
+
+	// debug directory entries point at their data by file offset.
+	if len(dirs) > pe.IMAGE_DIRECTORY_ENTRY_DEBUG && dirs[pe.IMAGE_DIRECTORY_ENTRY_DEBUG].Size > 0 {
+		dir := dirs[pe.IMAGE_DIRECTORY_ENTRY_DEBUG]
+
+		for i, s := range f.Sections {
+			if newOffset, ok := moved[i]; ok && dir.VirtualAddress >= s.VirtualAddress &&
+				dir.VirtualAddress+dir.Size <= s.VirtualAddress+s.Size {
+				entries := newOffset + uint64(dir.VirtualAddress-s.VirtualAddress)
+
+				for x := entries; x+28 <= entries+uint64(dir.Size); x += 28 {
+					pointer := uint64(binary.LittleEndian.Uint32(out[x+24:]))
+					for j, t := range f.Sections {
+						if to, ok := moved[j]; ok && pointer >= uint64(t.Offset) && pointer < uint64(t.Offset)+uint64(t.Size) {
+							binary.LittleEndian.PutUint32(out[x+24:], uint32(pointer-uint64(t.Offset)+to))
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// long section names live in the string table, so it's kept
+	// without the symbols in front of it.
+	symbolsHeader := coffOffset + 8
+	binary.LittleEndian.PutUint32(out[symbolsHeader+4:], 0)
+
+	if symbols > 0 {
+		binary.LittleEndian.PutUint32(out[symbolsHeader:], uint32(len(out)))
+		out = append(out, data[symbolsEnd-4-uint64(len(f.StringTable)):symbolsEnd]...)
+	}
+
+	if binary.LittleEndian.Uint32(out[checksumOffset:]) != 0 {
+		binary.LittleEndian.PutUint32(out[checksumOffset:], peChecksum(out, checksumOffset))
+	}
+
+	return out, nil
+}
+
+func peChecksum(data []byte, checksumOffset uint64) uint32 {
+	sum := uint64(0)
+
+	for i := uint64(0); i < uint64(len(data)); i += 2 {
+		if i == checksumOffset || i == checksumOffset+2 {
+			continue
+		}
+
+		word := uint64(data[i])
+		if i+1 < uint64(len(data)) {
+			word |= uint64(data[i+1]) << 8
+		}
+
+		sum += word
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+
+	sum = (sum & 0xffff) + (sum >> 16)
+	return uint32(sum) + uint32(len(data))
+}
@@ -0,0 +1,272 @@
+package impl
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// buildDarwinBinary builds a small Go program for darwin/arch, which
+// the linker signs ad-hoc on arm64.
+func buildDarwinBinary(t *testing.T, arch string) []byte {
+	t.Helper()
+
+	return buildDarwinProgram(t, arch, "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(\"hello\") }\n")
+}
+
+// buildDarwinProgram builds the Go program in source for darwin/arch.
+func buildDarwinProgram(t *testing.T, arch string, source string) []byte {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("builds a Go program")
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":  "module hello\n\ngo 1.22\n",
+		"main.go": source,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("go", "build", "-o", "hello", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOOS=darwin", "GOARCH="+arch, "CGO_ENABLED=0", "GOFLAGS=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %s\n%s", err, out)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestSignMachOAdHoc(t *testing.T) {
+	data := buildDarwinBinary(t, "arm64")
+
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := readMachOSignature(data, f.ByteOrder)
+	if err != nil || signature == nil {
+		t.Fatalf("no ad-hoc signature found: %v", err)
+	}
+
+	// signing the file again must give exactly what the linker wrote.
+	out, err := signMachOAdHoc(bytes.Clone(data), signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("the new signature differs from the one of the linker")
+	}
+}
+
+// machoIndirectNames returns the names of the symbols the indirect
+// symbol table refers to.
+func machoIndirectNames(f *macho.File) []string {
+	names := make([]string, 0, len(f.Dysymtab.IndirectSyms))
+	for _, i := range f.Dysymtab.IndirectSyms {
+		if i&0xc0000000 != 0 || int(i) >= len(f.Symtab.Syms) {
+			names = append(names, "")
+		} else {
+			names = append(names, f.Symtab.Syms[i].Name)
+		}
+	}
+
+	return names
+}
+
+func TestStripMachO(t *testing.T) {
+	arm64 := buildDarwinBinary(t, "arm64")
+	amd64 := buildDarwinBinary(t, "amd64")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"signed arm64", arm64},
+		{"unsigned amd64", amd64},
+		{"fat", buildFatMachO([]fatSlice{
+			{Cpu: macho.CpuAmd64, SubCpu: 3, Align: 12, Data: amd64},
+			{Cpu: macho.CpuArm64, Align: 14, Data: arm64},
+		})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := stripMachO(bytes.Clone(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) >= len(tt.data) {
+				t.Fatalf("nothing stripped (%d bytes)", len(out))
+			}
+
+			before, after := machoSlices(t, tt.data), machoSlices(t, out)
+			if len(after) != len(before) {
+				t.Fatalf("%d slices, want %d", len(after), len(before))
+			}
+
+			for i, f := range after {
+				if f.Segment("__DWARF") != nil {
+					t.Errorf("slice %d: __DWARF left", i)
+				}
+				if f.Dysymtab.Nlocalsym != 0 {
+					t.Errorf("slice %d: %d local symbols left", i, f.Dysymtab.Nlocalsym)
+				}
+
+				if want := len(before[i].Symtab.Syms) - int(before[i].Dysymtab.Nlocalsym); len(f.Symtab.Syms) != want {
+					t.Errorf("slice %d: %d symbols, want %d", i, len(f.Symtab.Syms), want)
+				}
+
+				got, _ := f.ImportedSymbols()
+				want, _ := before[i].ImportedSymbols()
+				if !slices.Equal(got, want) {
+					t.Errorf("slice %d: imported symbols changed", i)
+				}
+				if !slices.Equal(machoIndirectNames(f), machoIndirectNames(before[i])) {
+					t.Errorf("slice %d: indirect symbols changed", i)
+				}
+
+				for j, s := range f.Sections {
+					old := before[i].Sections[j]
+					if s.Offset == 0 {
+						continue
+					}
+					got, _ := s.Data()
+					want, _ := old.Data()
+					if s.Seg != old.Seg || s.Name != old.Name || !bytes.Equal(got, want) {
+						t.Errorf("slice %d: section %s,%s changed", i, s.Seg, s.Name)
+					}
+				}
+			}
+
+			// the signature must match the stripped content.
+			for _, arch := range machoFatArches(t, out) {
+				f, err := macho.NewFile(bytes.NewReader(arch))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				signature, err := readMachOSignature(arch, f.ByteOrder)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if signature == nil {
+					continue
+				}
+
+				signed, err := signMachOAdHoc(bytes.Clone(arch), signature)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(signed, arch) {
+					t.Error("the signature does not match the stripped file")
+				}
+			}
+		})
+	}
+}
+
+// machoFatArches returns the bytes of each slice of a Mach-O file.
+func machoFatArches(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+
+	fat, err := macho.NewFatFile(bytes.NewReader(data))
+	if err != nil {
+		return [][]byte{data}
+	}
+
+	arches := make([][]byte, 0, len(fat.Arches))
+	for _, arch := range fat.Arches {
+		arches = append(arches, data[arch.Offset:arch.Offset+arch.Size])
+	}
+
+	return arches
+}
+
+func TestStripElf(t *testing.T) {
+	data := readFixture(t, "elf/debug.elf")
+
+	out, err := stripElf(bytes.Clone(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) >= len(data) {
+		t.Fatalf("nothing stripped (%d bytes)", len(out))
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("stripped file does not parse: %s", err)
+	}
+
+	for _, s := range f.Sections {
+		if s.Type == elf.SHT_SYMTAB || strings.HasPrefix(s.Name, ".debug") {
+			t.Errorf("section %s left", s.Name)
+		}
+	}
+
+	symbols, err := f.DynamicSymbols()
+	if err != nil || !slices.ContainsFunc(symbols, func(s elf.Symbol) bool { return s.Name == "answer" }) {
+		t.Errorf("dynamic symbols lost: %v", err)
+	}
+}
+
+func TestStripElfMalformed(t *testing.T) {
+	e, err := newElfImage(readFixture(t, "elf/debug.elf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// point the dynamic symbols at a section that doesn't exist.
+	for i := 0; i < e.shnum(); i++ {
+		if s := e.section(i); s.Type == elf.SHT_DYNSYM {
+			s.Link = 0xfff
+			e.setSection(i, s)
+		}
+	}
+
+	if _, err := stripElf(bytes.Clone(e.data)); err == nil {
+		t.Error("malformed section links accepted")
+	}
+
+	// the file goes into the payload as it is.
+	build := &payloadBuild{}
+	out, err := applyStrip(Config{Strip: true}, build, "lib.so", bytes.Clone(e.data))
+	if err != nil || !bytes.Equal(out, e.data) || build.strippedBytes != 0 {
+		t.Error("malformed file not kept as it is")
+	}
+}
+
+func TestApplyStripCountsSavedBytes(t *testing.T) {
+	data := readFixture(t, "elf/debug.elf")
+
+	build := &payloadBuild{}
+	for range 2 {
+		if _, err := applyStrip(Config{Strip: true}, build, "lib.so", bytes.Clone(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, _ := stripElf(bytes.Clone(data))
+	if want := 2 * int64(len(data)-len(out)); build.strippedBytes != want {
+		t.Errorf("%d bytes saved, want %d", build.strippedBytes, want)
+	}
+}
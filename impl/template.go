@@ -0,0 +1,42 @@
+package impl
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+func getTemplateData(config Config) map[string]any {
+	data := make(map[string]any, 0)
+	for k, v := range config.Variables {
+		data[k] = v
+	}
+
+	data["Version"] = config.Version
+	data["TargetName"] = config.TargetName
+	data["TargetOs"] = config.TargetOs
+	data["TargetArch"] = config.TargetArch
+	data["InstallPath"] = config.InstallPath
+	data["BuildTime"] = config.BuildTime
+
+	return data
+}
+
+func matchTemplateFile(config Config, dest string, head []byte) bool {
+	return hasGlobMatchInList(config.Templates, dest)
+}
+
+func renderTemplateFile(config Config, build *payloadBuild, dest string, data []byte) ([]byte, error) {
+	tmpl, err := template.New(dest).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %s", dest, err.Error())
+	}
+
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, getTemplateData(config)); err != nil {
+		return nil, fmt.Errorf("failed to render template %s: %s", dest, err.Error())
+	}
+
+	fmt.Printf("Template rendered: %s\n", dest)
+	return out.Bytes(), nil
+}
@@ -0,0 +1,100 @@
+package impl
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderTemplateFile(t *testing.T) {
+	config := Config{
+		Version:    "1.2.3",
+		TargetName: "myapp",
+		TargetOs:   "linux",
+		TargetArch: "amd64",
+		BuildTime:  "2024-01-02T03:04:05Z",
+		Templates:  []string{"**/*.ini"},
+		Variables:  map[string]string{"Channel": "beta", "Version": "overridden"},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"vars", "channel={{ .Channel }}", "channel=beta"},
+		{"version", "version={{ .Version }}", "version=1.2.3"},
+		{"build time", "built={{ .BuildTime }}", "built=2024-01-02T03:04:05Z"},
+		{"target", "{{ .TargetName }}-{{ .TargetOs }}-{{ .TargetArch }}", "myapp-linux-amd64"},
+		{"plain text", "no actions here", "no actions here"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := renderTemplateFile(config, &payloadBuild{}, "etc/app.ini", []byte(tt.template))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("rendered %q, want %q", out, tt.want)
+			}
+		})
+	}
+
+	if !matchTemplateFile(config, "etc/app.ini", nil) || matchTemplateFile(config, "etc/app.txt", nil) {
+		t.Error("templates matched by the wrong patterns")
+	}
+}
+
+func TestRenderTemplateFileErrors(t *testing.T) {
+	config := Config{Templates: []string{"app.ini"}}
+
+	tests := []struct {
+		name     string
+		template string
+		err      string
+	}{
+		{"missing key", "{{ .Undefined }}", "failed to render template app.ini"},
+		{"malformed", "{{ .Version ", "failed to parse template app.ini"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := renderTemplateFile(config, &payloadBuild{}, "app.ini", []byte(tt.template)); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+
+			// which is what fails the build.
+			entry := newBytesPayloadEntry("app.ini", []byte(tt.template))
+			if file, _, err := openPayloadFile(config, &payloadBuild{}, entry); err == nil {
+				file.Close()
+				t.Error("template error did not fail the payload")
+			}
+		})
+	}
+
+	// files that aren't templates are left alone.
+	entry := newBytesPayloadEntry("other.ini", []byte("{{ .Undefined }}"))
+	file, _, err := openPayloadFile(config, &payloadBuild{}, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if data, _ := io.ReadAll(file); string(data) != "{{ .Undefined }}" {
+		t.Errorf("other.ini = %q", data)
+	}
+}
+
+func TestGetBuildTime(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	if got := getBuildTime(); got != "2023-11-14T22:13:20Z" {
+		t.Errorf("build time = %s, want 2023-11-14T22:13:20Z", got)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	got, err := time.Parse(time.RFC3339, getBuildTime())
+	if err != nil || time.Since(got) > time.Minute {
+		t.Errorf("build time = %s, want now", got)
+	}
+}
@@ -0,0 +1,9 @@
+#!/bin/sh
+# Regenerates the ELF fixtures of the RUNPATH and strip tests.
+set -e
+cd "$(dirname "$0")"
+flags="-shared -fPIC -nostdlib -Wl,--build-id -Wl,--no-as-needed -Wl,-z,noseparate-code -Wl,-z,max-page-size=4096"
+gcc $flags -s -o norunpath.elf lib.c -lc
+gcc $flags -s -Wl,--enable-new-dtags -Wl,-rpath,/opt/original/runpath/of/the/fixture -o runpath.elf lib.c -lc
+gcc $flags -s -Wl,--disable-new-dtags -Wl,-rpath,/opt/original/rpath/of/the/fixture -o rpath.elf lib.c -lc
+gcc $flags -g -o debug.elf lib.c -lc
@@ -0,0 +1,157 @@
+//go:build ignore
+
+// Regenerates the Mach-O fixtures of the install name tests (there's no
+// Mach-O linker on most systems): run `go run gen.go` in this directory.
+//
+// The fixtures are minimal 64-bit dylibs with an id, a dependency on a
+// Homebrew library and one on libSystem, followed by a single __text
+// section:
+//
+//   - lib.dylib: x86_64, with room for longer load commands.
+//   - tight.dylib: x86_64, with no room to spare.
+//   - signed.dylib: x86_64, with a code signature load command.
+//   - fat.dylib: lib.dylib for x86_64 and arm64 in a fat file.
+package main
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"os"
+)
+
+const (
+	id      = "/opt/homebrew/opt/foo/lib/libfoo.1.dylib"
+	dep     = "/opt/homebrew/opt/bar/lib/libbar.2.dylib"
+	system  = "/usr/lib/libSystem.B.dylib"
+	textOff = 0x400
+)
+
+func pad(b []byte, align int) []byte {
+	for len(b)%align != 0 {
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+func dylibCommand(cmd macho.LoadCmd, name string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(cmd))
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 24)
+	b = binary.LittleEndian.AppendUint32(b, 2)
+	b = binary.LittleEndian.AppendUint32(b, 0x10000)
+	b = binary.LittleEndian.AppendUint32(b, 0x10000)
+	b = pad(append(b, name+"\x00"...), 8)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+
+	return b
+}
+
+func name16(s string) []byte {
+	b := make([]byte, 16)
+	copy(b, s)
+	return b
+}
+
+func dylib(cpu macho.Cpu, subCpu uint32, textOff uint32, signed bool) []byte {
+	text := []byte{0xc3, 0x90, 0x90, 0x90}
+	size := uint64(textOff) + uint64(len(text))
+
+	seg := binary.LittleEndian.AppendUint32(nil, uint32(macho.LoadCmdSegment64))
+	seg = binary.LittleEndian.AppendUint32(seg, 72+80)
+	seg = append(seg, name16("__TEXT")...)
+	seg = binary.LittleEndian.AppendUint64(seg, 0)
+	seg = binary.LittleEndian.AppendUint64(seg, 0x1000)
+	seg = binary.LittleEndian.AppendUint64(seg, 0)
+	seg = binary.LittleEndian.AppendUint64(seg, size)
+	seg = binary.LittleEndian.AppendUint32(seg, 5)
+	seg = binary.LittleEndian.AppendUint32(seg, 5)
+	seg = binary.LittleEndian.AppendUint32(seg, 1)
+	seg = binary.LittleEndian.AppendUint32(seg, 0)
+
+	seg = append(seg, name16("__text")...)
+	seg = append(seg, name16("__TEXT")...)
+	seg = binary.LittleEndian.AppendUint64(seg, uint64(textOff))
+	seg = binary.LittleEndian.AppendUint64(seg, uint64(len(text)))
+	seg = binary.LittleEndian.AppendUint32(seg, textOff)
+	seg = binary.LittleEndian.AppendUint32(seg, 2)
+	seg = binary.LittleEndian.AppendUint32(seg, 0)
+	seg = binary.LittleEndian.AppendUint32(seg, 0)
+	seg = binary.LittleEndian.AppendUint32(seg, 0x80000400)
+	seg = append(seg, make([]byte, 12)...)
+
+	cmds := [][]byte{
+		seg,
+		dylibCommand(0xd, id),
+		dylibCommand(macho.LoadCmdDylib, dep),
+		dylibCommand(macho.LoadCmdDylib, system),
+	}
+
+	if signed {
+		sig := binary.LittleEndian.AppendUint32(nil, 0x1d)
+		sig = binary.LittleEndian.AppendUint32(sig, 16)
+		sig = binary.LittleEndian.AppendUint32(sig, uint32(size))
+		sig = binary.LittleEndian.AppendUint32(sig, 0)
+		cmds = append(cmds, sig)
+	}
+
+	all := bytes.Join(cmds, nil)
+
+	out := binary.LittleEndian.AppendUint32(nil, macho.Magic64)
+	out = binary.LittleEndian.AppendUint32(out, uint32(cpu))
+	out = binary.LittleEndian.AppendUint32(out, subCpu)
+	out = binary.LittleEndian.AppendUint32(out, uint32(macho.TypeDylib))
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(cmds)))
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(all)))
+	out = binary.LittleEndian.AppendUint32(out, 0x100085)
+	out = binary.LittleEndian.AppendUint32(out, 0)
+	out = append(out, all...)
+
+	if len(out) > int(textOff) {
+		panic("load commands overlap __text")
+	}
+
+	out = append(out, make([]byte, int(textOff)-len(out))...)
+	return append(out, text...)
+}
+
+func fat(slices ...[]byte) []byte {
+	cpus := []macho.Cpu{macho.CpuAmd64, macho.CpuArm64}
+	subCpus := []uint32{3, 0}
+
+	out := binary.BigEndian.AppendUint32(nil, macho.MagicFat)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(slices)))
+
+	offset := 0x1000
+	for i, s := range slices {
+		out = binary.BigEndian.AppendUint32(out, uint32(cpus[i]))
+		out = binary.BigEndian.AppendUint32(out, subCpus[i])
+		out = binary.BigEndian.AppendUint32(out, uint32(offset))
+		out = binary.BigEndian.AppendUint32(out, uint32(len(s)))
+		out = binary.BigEndian.AppendUint32(out, 12)
+		offset += (len(s) + 0xfff) &^ 0xfff
+	}
+
+	for _, s := range slices {
+		out = append(pad(out, 0x1000), s...)
+	}
+
+	return out
+}
+
+func main() {
+	lib := dylib(macho.CpuAmd64, 3, textOff, false)
+	files := map[string][]byte{
+		"lib.dylib":    lib,
+		"tight.dylib":  dylib(macho.CpuAmd64, 3, 0x180, false),
+		"signed.dylib": dylib(macho.CpuAmd64, 3, textOff, true),
+		"fat.dylib":    fat(lib, dylib(macho.CpuArm64, 0, textOff, false)),
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			panic(err)
+		}
+	}
+}
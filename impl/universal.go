@@ -0,0 +1,188 @@
+package impl
+
+import (
+	"bytes"
+	"debug/macho"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The arch of executables that run on every architecture of their OS.
+const UniversalArch = "universal"
+
+// The environment variable the stub of a universal Linux installer finds
+// its payload with, as it runs from a copy of its own.
+const PayloadEnv = "EXWRAP_PAYLOAD"
+
+// A universal Linux installer is a shell script followed by the stub of
+// every architecture and then the attachments:
+//
+//	script | stub | stub | ... | attachments
+//
+// The script and the stubs are padded to whole blocks, so the script
+// can copy the stub of the machine out with dd and run it on the
+// installer. To the container, the script and the stubs are all stub.
+const universalBlockSize = 4096
+
+// The architectures of universal Linux installers, with the machine
+// names (as in uname -m) they run on.
+var universalLinuxArchs = []struct {
+	arch     string
+	machines string
+}{
+	{"amd64", "x86_64|amd64"},
+	{"arm64", "aarch64|arm64|armv8b|armv8l"},
+	{"arm", "arm*"},
+	{"386", "i386|i486|i586|i686|x86"},
+}
+
+// The architectures of universal MacOS executables, which are fat
+// Mach-O files of their stubs.
+var universalDarwinArchs = []string{"amd64", "arm64"}
+
+const universalLinuxScript = `#!/bin/sh
+# This installer runs on %s Linux. The part of it for this machine
+# is copied out and run on the rest.
+case "$(uname -m)" in
+%s*) echo "Unsupported architecture: $(uname -m)" >&2; exit 1 ;;
+esac
+dir=$(mktemp -d "${TMPDIR:-/tmp}/exwrap.XXXXXX") || exit 1
+trap 'rm -rf "$dir"' EXIT
+stub="$dir/$(basename "$0")"
+dd if="$0" of="$stub" bs=%d skip="$skip" count="$count" 2>/dev/null || exit 1
+chmod +x "$stub"
+payload="$(cd "$(dirname "$0")" && pwd)/$(basename "$0")"
+%s="$payload" "$stub" "$@"
+exit $?
+`
+
+var cachedPayloadPath string = ""
+
+// GetPayloadPath returns the path of the file the attachments of the
+// running executable are found in.
+func GetPayloadPath() (string, error) {
+	if cachedPayloadPath == "" {
+		if payload := os.Getenv(PayloadEnv); payload != "" {
+			cachedPayloadPath = payload
+		} else if exe, err := os.Executable(); err == nil {
+			cachedPayloadPath = exe
+		} else {
+			return "", err
+		}
+	}
+
+	return cachedPayloadPath, nil
+}
+
+// writeUniversalStub writes the stub of a universal executable for the
+// target OS to dest, returning the architectures it runs on.
+func writeUniversalStub(config Config, dest string) ([]string, error) {
+	if config.TargetOs == "darwin" {
+		return writeUniversalDarwinStub(dest)
+	}
+
+	return writeUniversalLinuxStub(dest)
+}
+
+func getPaddedBlocks(size int64) int64 {
+	return (size + universalBlockSize - 1) / universalBlockSize
+}
+
+// writeUniversalLinuxStub writes the script and the stubs of a
+// universal Linux installer to dest, returning the architectures it
+// runs on.
+func writeUniversalLinuxStub(dest string) ([]string, error) {
+	stubs := make([]string, 0)
+	archs := make([]string, 0)
+	cases := ""
+
+	// the script takes the first block.
+	skip := int64(1)
+	for _, x := range universalLinuxArchs {
+		stub := getPkgExeName("linux", x.arch)
+		stat, err := os.Stat(stub)
+		if err != nil {
+			return nil, err
+		}
+
+		count := getPaddedBlocks(stat.Size())
+		cases += fmt.Sprintf("%s) skip=%d; count=%d ;;\n", x.machines, skip, count)
+		skip += count
+
+		stubs = append(stubs, stub)
+		archs = append(archs, x.arch)
+	}
+
+	script := fmt.Sprintf(universalLinuxScript, strings.Join(archs, ", "), cases, universalBlockSize, PayloadEnv)
+	if len(script) > universalBlockSize {
+		return nil, fmt.Errorf("the installer script takes more than %d bytes", universalBlockSize)
+	}
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	// the shell never reads past exit, the padding is just for dd.
+	if _, err = out.WriteString(script + strings.Repeat("\n", universalBlockSize-len(script))); err != nil {
+		return nil, err
+	}
+
+	for _, stub := range stubs {
+		file, err := os.Open(stub)
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := io.Copy(out, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		padding := getPaddedBlocks(size)*universalBlockSize - size
+		if _, err = out.Write(bytes.Repeat([]byte{0}, int(padding))); err != nil {
+			return nil, err
+		}
+	}
+
+	return archs, out.Close()
+}
+
+// writeUniversalDarwinStub merges the stubs of universal MacOS
+// executables into a fat Mach-O file at dest, returning the
+// architectures it runs on. The stubs are copied as they are, so each
+// one keeps its own code signature.
+func writeUniversalDarwinStub(dest string) ([]string, error) {
+	slices := make([]fatSlice, 0, len(universalDarwinArchs))
+
+	for _, arch := range universalDarwinArchs {
+		data, err := os.ReadFile(getPkgExeName("darwin", arch))
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := macho.NewFile(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("the %s stub is not a Mach-O file: %s", arch, err)
+		}
+
+		// slices are aligned to pages, which are 16K on arm64.
+		align := uint32(12)
+		if file.Cpu == macho.CpuArm64 {
+			align = 14
+		}
+
+		slices = append(slices, fatSlice{
+			Cpu:    file.Cpu,
+			SubCpu: file.SubCpu,
+			Align:  align,
+			Data:   data,
+		})
+	}
+
+	return universalDarwinArchs, os.WriteFile(dest, buildFatMachO(slices), 0755)
+}
@@ -0,0 +1,131 @@
+package impl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// writeTestUniversalStubs writes fake wrapper stubs for every universal
+// Linux architecture into the pkg directory next to exwrap. Each one is
+// a script printing its architecture, of a different size.
+func writeTestUniversalStubs(t *testing.T) map[string][]byte {
+	t.Helper()
+
+	dir := t.TempDir()
+	old := cachedAppDir
+	cachedAppDir = dir
+	t.Cleanup(func() { cachedAppDir = old })
+
+	os.MkdirAll(filepath.Join(dir, "pkg"), 0755)
+	stubs := make(map[string][]byte, 0)
+	for i, x := range universalLinuxArchs {
+		// the stub runs on the installer it was copied out of.
+		stub := fmt.Sprintf("#!/bin/sh\necho %s \"$%s\"\nexit 0\n", x.arch, PayloadEnv)
+		stub += strings.Repeat("# filler\n", 500*(i+1)+i)
+
+		stubs[x.arch] = []byte(stub)
+		if err := os.WriteFile(filepath.Join(dir, "pkg", "wrapper-linux-"+x.arch), stubs[x.arch], 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return stubs
+}
+
+func TestWriteUniversalLinuxStub(t *testing.T) {
+	stubs := writeTestUniversalStubs(t)
+
+	dest := filepath.Join(t.TempDir(), "installer")
+	archs, err := writeUniversalLinuxStub(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data)%universalBlockSize != 0 {
+		t.Errorf("%d bytes, not whole blocks", len(data))
+	}
+
+	// the script fits in the first block, padded with new lines.
+	script := strings.TrimRight(string(data[:universalBlockSize]), "\n")
+	if !strings.HasPrefix(script, "#!/bin/sh\n") || !strings.HasSuffix(script, "exit $?") {
+		t.Errorf("script = %q", script)
+	}
+
+	// the offsets in the script point at each stub.
+	sections, err := getUniversalLinuxStubs(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != len(archs) {
+		t.Fatalf("%d stubs found, want %d", len(sections), len(archs))
+	}
+	for i, section := range sections {
+		got, _ := io.ReadAll(section)
+		stub := stubs[archs[i]]
+		if len(got) != int(getPaddedBlocks(int64(len(stub))))*universalBlockSize {
+			t.Errorf("%s: %d bytes, want %d padded to whole blocks", archs[i], len(got), len(stub))
+			continue
+		}
+		if !bytes.HasPrefix(got, stub) || len(bytes.Trim(got[len(stub):], "\x00")) > 0 {
+			t.Errorf("%s: the offsets don't match the stub", archs[i])
+		}
+	}
+
+	if got := describeUniversalStub(bytes.NewReader(data)); strings.Count(got, "unknown (") != len(archs) {
+		t.Errorf("description = %q, want %d stubs", got, len(archs))
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	// machines run the stub of their architecture, with uname faked.
+	bin := t.TempDir()
+	uname := "#!/bin/sh\necho \"$EXWRAP_TEST_MACHINE\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "uname"), []byte(uname), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		machine string
+		want    string
+	}{
+		{"x86_64", "amd64"},
+		{"aarch64", "arm64"},
+		{"armv8l", "arm64"},
+		{"armv7l", "arm"},
+		{"armv6l", "arm"},
+		{"i686", "386"},
+		{"riscv64", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.machine, func(t *testing.T) {
+			cmd := exec.Command("sh", dest)
+			cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"), "EXWRAP_TEST_MACHINE="+tt.machine)
+			out, err := cmd.CombinedOutput()
+
+			if tt.want == "" {
+				if err == nil || !strings.Contains(string(out), "Unsupported architecture: riscv64") {
+					t.Errorf("error = %v\n%s", err, out)
+				}
+				return
+			}
+
+			if want := tt.want + " " + dest + "\n"; err != nil || string(out) != want {
+				t.Errorf("output = %q (%v), want %q", out, err, want)
+			}
+		})
+	}
+}
@@ -10,15 +10,27 @@ import (
 )
 
 func Unzip(src, dest string) error {
-	r, err := zip.OpenReader(src)
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return UnzipReader(file, stat.Size(), dest)
+}
+
+// UnzipReader extracts the zip archive of size bytes read from r into
+// dest, without needing the archive as a file (E.g. an attachment).
+func UnzipReader(ra io.ReaderAt, size int64, dest string) error {
+	r, err := zip.NewReader(ra, size)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := r.Close(); err != nil {
-			panic(err)
-		}
-	}()
 
 	os.MkdirAll(dest, 0755)
 
@@ -8,26 +8,32 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
 var cachedAppDir string = ""
 var cachedBuildDir string = ""
 
-func listFiles(root string) []string {
+// listFiles returns the names of the files in fsys. Symbolic links to
+// files are listed under their own name, while the ones to directories
+// are left alone.
+func listFiles(fsys fs.FS) []string {
 	files := make([]string, 0)
 
-	if err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
-		// make sure we resolve the path first for symbolic links before
-		// we proceed.
-		// this is where we ensure that only the actual files are being
-		// included in the final artefact.
-		path, info = resolveFile(path, info)
-		if err == nil && !info.IsDir() {
-			files = append(files, path)
+	if err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
 		}
 
-		return err
+		if d.Type()&fs.ModeSymlink != 0 {
+			if stat, err := fs.Stat(fsys, name); err != nil || stat.IsDir() {
+				return nil
+			}
+		}
+
+		files = append(files, name)
+		return nil
 	}); err != nil {
 		log.Fatalln("Failed to read root directory:", err.Error())
 	}
@@ -45,6 +51,16 @@ func stringListContains(list []string, key string) bool {
 	return false
 }
 
+func getSortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
 func hasMatchInList(list []string, key string) bool {
 	for _, x := range list {
 		if x == key || strings.HasPrefix(key, x) {
@@ -55,31 +71,84 @@ func hasMatchInList(list []string, key string) bool {
 	return false
 }
 
-func getFileAbsPath(path string) (string, error) {
-	if absPath, err := filepath.Abs(path); err == nil {
-		return absPath, nil
-	} else {
-		return "", err
+func hasGlobMatchInList(list []string, name string) bool {
+	for _, x := range list {
+		if matchGlob(x, name) {
+			return true
+		}
 	}
+
+	return false
+}
+
+// matchGlob reports whether the slash separated name matches pattern.
+// On top of the path.Match syntax, a "**" segment matches any number
+// of path segments.
+func matchGlob(pattern string, name string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
 }
 
-func resolveFile(file string, info fs.FileInfo) (string, fs.FileInfo) {
-	if info.Mode()&os.ModeSymlink != 0 {
-		// is symlink
-		if link, err := os.Readlink(file); err == nil {
-			if !filepath.IsAbs(link) {
-				link = path.Join(path.Dir(file), link)
+// matchGlobPath reports whether pattern matches name or one of the
+// directories it is in, returning the part of name below the matched
+// directory (or the base name of name when it matched itself).
+func matchGlobPath(pattern string, name string) (string, bool) {
+	patterns := strings.Split(pattern, "/")
+	segments := strings.Split(name, "/")
+
+	for i := 1; i <= len(segments); i++ {
+		if matchGlobSegments(patterns, segments[:i]) {
+			if i == len(segments) {
+				return path.Base(name), true
 			}
 
-			if stat, err := os.Stat(link); err == nil {
-				return link, stat
+			return strings.Join(segments[i:], "/"), true
+		}
+	}
+
+	return "", false
+}
+
+func matchGlobSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobSegments(pattern[1:], name[i:]) {
+					return true
+				}
 			}
 
-			return link, info
+			return false
 		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
+
+func getFileAbsPath(path string) (string, error) {
+	if absPath, err := filepath.Abs(path); err == nil {
+		return absPath, nil
+	} else {
+		return "", err
+	}
+}
+
+func getRelativeSlashPath(base string, target string) string {
+	if rel, err := filepath.Rel(filepath.FromSlash(base), filepath.FromSlash(target)); err == nil {
+		return filepath.ToSlash(rel)
 	}
 
-	return file, info
+	return target
 }
 
 func trimRoot(path string, root string) string {
@@ -161,6 +230,10 @@ func getLaunchScriptForDarwinApp(config Config) string {
 	return fmt.Sprintf("%s.launch", config.TargetName)
 }
 
+func getRelocationsForDarwinApp(config Config) string {
+	return fmt.Sprintf("%s.relocate", config.TargetName)
+}
+
 func getSetupScriptTempName() string {
 	return fmt.Sprintf("%s.json", EmbededSetupScript)
 }